@@ -0,0 +1,203 @@
+package timing
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Calendar tells how a dataset counts quarters, half years and years. The
+// zero Calendar counts calendar years. A fiscal calendar starts its years in
+// YearStart and names them after the calendar year they end in, e.g. with
+// April "FY2018" runs from April 2017 to March 2018 and "FY2018 Q1" from
+// April to June 2017. Days, weeks and months are the same in every calendar.
+type Calendar struct {
+	// YearStart is the first month of the year, January if zero
+	YearStart time.Month
+}
+
+// NewCalendar returns the calendar whose years start in the given month,
+// 1 to 12. Other months give the calendar year.
+func NewCalendar(yearStart int) Calendar {
+	if yearStart < 1 || yearStart > 12 {
+		return Calendar{}
+	}
+	return Calendar{YearStart: time.Month(yearStart)}
+}
+
+// IsFiscal reports whether the years of c do not start in January
+func (c Calendar) IsFiscal() bool {
+	return c.YearStart > time.January
+}
+
+// months returns the number of months of a period counted from the start of
+// a fiscal year, 0 if c counts the period like the calendar year
+func (c Calendar) months(period string) int {
+	if !c.IsFiscal() {
+		return 0
+	}
+	switch period {
+	case PeriodQuarter:
+		return 3
+	case PeriodHalfYear:
+		return 6
+	case PeriodYear:
+		return 12
+	}
+	return 0
+}
+
+// fiscalYear returns the year the fiscal year of t ends in and the number of
+// months of it before the month of t
+func (c Calendar) fiscalYear(t time.Time) (year int, offset int) {
+	year = t.Year()
+	if t.Month() >= c.YearStart {
+		year++
+	}
+	return year, (int(t.Month()) - int(c.YearStart) + 12) % 12
+}
+
+// beginning returns the first day of the period of n months containing t
+func (c Calendar) beginning(t time.Time, n int) time.Time {
+	_, offset := c.fiscalYear(t)
+	return time.Date(t.Year(), t.Month()-time.Month(offset%n), 1, 0, 0, 0, 0, t.Location())
+}
+
+// BeginningOfPeriod returns the beginning time of period containing the given time
+func (c Calendar) BeginningOfPeriod(t time.Time, period string) time.Time {
+	if n := c.months(period); n > 0 {
+		return c.beginning(t, n)
+	}
+	return BeginningOfPeriod(t, period)
+}
+
+// EndOfPeriod returns the end time of period containing the given time
+func (c Calendar) EndOfPeriod(t time.Time, period string) time.Time {
+	if n := c.months(period); n > 0 {
+		return c.beginning(t, n).AddDate(0, n, 0).Add(-time.Nanosecond)
+	}
+	return EndOfPeriod(t, period)
+}
+
+// Backward returns the beginning of the period before the given time.
+func (c Calendar) Backward(t time.Time, period string) time.Time {
+	if n := c.months(period); n > 0 {
+		return c.beginning(t, n).AddDate(0, -n, 0)
+	}
+	return Backward(t, period)
+}
+
+// Forward returns the beginning of the period after the given time.
+func (c Calendar) Forward(t time.Time, period string) time.Time {
+	if n := c.months(period); n > 0 {
+		return c.beginning(t, n).AddDate(0, n, 0)
+	}
+	return Forward(t, period)
+}
+
+// BackwardN returns the beginning of the period n periods before the given time.
+func (c Calendar) BackwardN(t time.Time, period string, n int) time.Time {
+	t = c.BeginningOfPeriod(t, period)
+	for i := 0; i < n; i++ {
+		t = c.Backward(t, period)
+	}
+	return t
+}
+
+// ForwardN returns the beginning of the period n periods after the given time.
+func (c Calendar) ForwardN(t time.Time, period string, n int) time.Time {
+	t = c.BeginningOfPeriod(t, period)
+	for i := 0; i < n; i++ {
+		t = c.Forward(t, period)
+	}
+	return t
+}
+
+// AlignPeriodRange adjusts time range by period.
+func (c Calendar) AlignPeriodRange(beginning time.Time, end time.Time, period string) (time.Time, time.Time) {
+	if end.IsZero() {
+		end = time.Now().UTC()
+	}
+	end = c.EndOfPeriod(end, period)
+
+	if beginning.IsZero() {
+		beginning = end
+		for i := 1; i < DefaultPeriodRangeLength; i++ {
+			beginning = c.Backward(beginning, period)
+		}
+	} else {
+		beginning = c.BeginningOfPeriod(beginning, period)
+	}
+
+	return beginning, end
+}
+
+// FormatTime formats the given time like the package FormatTime, fiscal
+// quarters, half years and years as "FY2018 Q1", "FY2018 H1" and "FY2018".
+func (c Calendar) FormatTime(t time.Time, period string) string {
+	if n := c.months(period); n > 0 {
+		year, offset := c.fiscalYear(t)
+		return fiscalLabel(year, offset/n+1, period, false)
+	}
+	return FormatTime(t, period)
+}
+
+// FormatTimeIn formats the given time like FormatTime in the way of a
+// locale. Chinese locales get "2018财年第1季度", "2018财年上半年" and
+// "2018财年" for fiscal periods.
+func (c Calendar) FormatTimeIn(t time.Time, period string, locale string) string {
+	if n := c.months(period); n > 0 {
+		year, offset := c.fiscalYear(t)
+		return fiscalLabel(year, offset/n+1, period, isChinese(locale))
+	}
+	return FormatTimeIn(t, period, locale)
+}
+
+// fiscalLabel writes the n-th period of a fiscal year, in Chinese if zh
+func fiscalLabel(year int, n int, period string, zh bool) string {
+	switch period {
+	case PeriodQuarter:
+		if zh {
+			return fmt.Sprintf("%d财年第%d季度", year, n)
+		}
+		return fmt.Sprintf("FY%d Q%d", year, n)
+	case PeriodHalfYear:
+		if zh {
+			return fmt.Sprintf("%d财年%s", year, halvesInChinese[n-1])
+		}
+		return fmt.Sprintf("FY%d H%d", year, n)
+	default:
+		if zh {
+			return fmt.Sprintf("%d财年", year)
+		}
+		return fmt.Sprintf("FY%d", year)
+	}
+}
+
+// parseFiscalLabel reads back a label written by fiscalLabel in English
+func parseFiscalLabel(label string) (year int, n int, period string, ok bool) {
+	if !strings.HasPrefix(label, "FY") {
+		return 0, 0, "", false
+	}
+	fields := strings.Split(label[2:], " ")
+	year, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return 0, 0, "", false
+	}
+	switch {
+	case len(fields) == 1:
+		return year, 1, PeriodYear, true
+	case len(fields) != 2 || len(fields[1]) != 2:
+		return 0, 0, "", false
+	}
+	n, err = strconv.Atoi(fields[1][1:])
+	switch {
+	case err != nil:
+	case fields[1][0] == 'Q' && n >= 1 && n <= 4:
+		return year, n, PeriodQuarter, true
+	case fields[1][0] == 'H' && n >= 1 && n <= 2:
+		return year, n, PeriodHalfYear, true
+	}
+	return 0, 0, "", false
+}
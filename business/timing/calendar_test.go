@@ -0,0 +1,120 @@
+package timing
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFiscalPeriods(t *testing.T) {
+	testCases := []struct {
+		yearStart int
+		t         time.Time
+		period    string
+		label     string
+		beginning time.Time
+		end       time.Time
+		backward  time.Time
+		forward   time.Time
+	}{
+		// April
+		{4, date(2017, 5, 15), PeriodQuarter, "FY2018 Q1",
+			date(2017, 4, 1), date(2017, 7, 1), date(2017, 1, 1), date(2017, 7, 1)},
+		{4, date(2018, 2, 10), PeriodQuarter, "FY2018 Q4",
+			date(2018, 1, 1), date(2018, 4, 1), date(2017, 10, 1), date(2018, 4, 1)},
+		{4, date(2017, 11, 1), PeriodHalfYear, "FY2018 H2",
+			date(2017, 10, 1), date(2018, 4, 1), date(2017, 4, 1), date(2018, 4, 1)},
+		{4, date(2018, 3, 31), PeriodYear, "FY2018",
+			date(2017, 4, 1), date(2018, 4, 1), date(2016, 4, 1), date(2018, 4, 1)},
+		// July
+		{7, date(2018, 7, 1), PeriodQuarter, "FY2019 Q1",
+			date(2018, 7, 1), date(2018, 10, 1), date(2018, 4, 1), date(2018, 10, 1)},
+		{7, date(2019, 6, 30), PeriodYear, "FY2019",
+			date(2018, 7, 1), date(2019, 7, 1), date(2017, 7, 1), date(2019, 7, 1)},
+		// February, whose quarters are not calendar quarters
+		{2, date(2018, 1, 15), PeriodQuarter, "FY2018 Q4",
+			date(2017, 11, 1), date(2018, 2, 1), date(2017, 8, 1), date(2018, 2, 1)},
+		{2, date(2018, 2, 1), PeriodQuarter, "FY2019 Q1",
+			date(2018, 2, 1), date(2018, 5, 1), date(2017, 11, 1), date(2018, 5, 1)},
+		{2, date(2018, 12, 5), PeriodHalfYear, "FY2019 H2",
+			date(2018, 8, 1), date(2019, 2, 1), date(2018, 2, 1), date(2019, 2, 1)},
+		{2, date(2018, 2, 1), PeriodYear, "FY2019",
+			date(2018, 2, 1), date(2019, 2, 1), date(2017, 2, 1), date(2019, 2, 1)},
+		// months are the same in every calendar
+		{4, date(2018, 3, 31), PeriodMonth, "2018/03",
+			date(2018, 3, 1), date(2018, 4, 1), date(2018, 2, 1), date(2018, 4, 1)},
+	}
+
+	for i, tc := range testCases {
+		cal := NewCalendar(tc.yearStart)
+		if out := cal.FormatTime(tc.t, tc.period); out != tc.label {
+			t.Error(i, ":", "want", tc.label, "got", out)
+		}
+		if out := cal.BeginningOfPeriod(tc.t, tc.period); !out.Equal(tc.beginning) {
+			t.Error(i, ":", "want", tc.beginning, "got", out)
+		}
+		// periods end a nanosecond before the next one begins
+		if out := cal.EndOfPeriod(tc.t, tc.period).Add(time.Nanosecond); !out.Equal(tc.end) {
+			t.Error(i, ":", "want", tc.end, "got", out)
+		}
+		if out := cal.Backward(tc.t, tc.period); !out.Equal(tc.backward) {
+			t.Error(i, ":", "want", tc.backward, "got", out)
+		}
+		if out := cal.Forward(tc.t, tc.period); !out.Equal(tc.forward) {
+			t.Error(i, ":", "want", tc.forward, "got", out)
+		}
+	}
+}
+
+func TestFiscalAlignPeriodRange(t *testing.T) {
+	testCases := []struct {
+		yearStart  int
+		beginning  time.Time
+		end        time.Time
+		period     string
+		outBegin   time.Time
+		outEndNext time.Time
+	}{
+		{4, date(2017, 12, 15), date(2018, 5, 10), PeriodQuarter, date(2017, 10, 1), date(2018, 7, 1)},
+		{7, date(2017, 3, 1), date(2018, 8, 1), PeriodYear, date(2016, 7, 1), date(2019, 7, 1)},
+		{2, date(2017, 3, 1), date(2018, 1, 20), PeriodYear, date(2017, 2, 1), date(2018, 2, 1)},
+		{2, date(2017, 12, 31), date(2018, 2, 1), PeriodQuarter, date(2017, 11, 1), date(2018, 5, 1)},
+	}
+
+	for i, tc := range testCases {
+		beginning, end := NewCalendar(tc.yearStart).AlignPeriodRange(tc.beginning, tc.end, tc.period)
+		if !beginning.Equal(tc.outBegin) || !end.Add(time.Nanosecond).Equal(tc.outEndNext) {
+			t.Error(i, ":", "want", tc.outBegin, tc.outEndNext, "got", beginning, end)
+		}
+	}
+
+	// 4 quarters back from FY2018 Q1 of an April calendar is FY2017 Q1
+	if out := NewCalendar(4).BackwardN(date(2017, 5, 1), PeriodQuarter, 4); !out.Equal(date(2016, 4, 1)) {
+		t.Error("want", date(2016, 4, 1), "got", out)
+	}
+	if out := NewCalendar(2).ForwardN(date(2018, 1, 31), PeriodQuarter, 2); !out.Equal(date(2018, 5, 1)) {
+		t.Error("want", date(2018, 5, 1), "got", out)
+	}
+}
+
+func TestFiscalLabels(t *testing.T) {
+	testCases := []struct {
+		label string
+		zh    string
+	}{
+		{"FY2018 Q1", "2018财年第1季度"},
+		{"FY2019 H2", "2019财年下半年"},
+		{"FY2019", "2019财年"},
+	}
+
+	for i, tc := range testCases {
+		if out := LocalizeLabel(tc.label, "zh-CN"); out != tc.zh {
+			t.Error(i, ":", "want", tc.zh, "got", out)
+		}
+		if out := LocalizeLabel(tc.label, "en"); out != tc.label {
+			t.Error(i, ":", "want", tc.label, "got", out)
+		}
+	}
+	if out := NewCalendar(2).FormatTimeIn(date(2018, 1, 15), PeriodQuarter, "zh"); out != "2018财年第4季度" {
+		t.Error("want", "2018财年第4季度", "got", out)
+	}
+}
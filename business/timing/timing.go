@@ -1,30 +1,45 @@
 package timing
 
 import (
+	"context"
 	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
 	sq "github.com/Masterminds/squirrel"
+	"github.com/bluecover/lm/models"
 	"github.com/jinzhu/gorm"
 	"github.com/jinzhu/now"
 	"github.com/sirupsen/logrus"
 )
 
 const (
-	PeriodDate    = "date"
-	PeriodMonth   = "month"
-	PeriodQuarter = "quarter"
-	PeriodYear    = "year"
+	PeriodDate     = "date"
+	PeriodWeek     = "week"
+	PeriodMonth    = "month"
+	PeriodQuarter  = "quarter"
+	PeriodHalfYear = "half_year"
+	PeriodYear     = "year"
 )
 
 const (
 	DefaultPeriodRangeLength = 90
 )
 
+// IsValidPeriod reports whether period is one of the known period names.
+func IsValidPeriod(period string) bool {
+	switch period {
+	case PeriodDate, PeriodWeek, PeriodMonth, PeriodQuarter, PeriodHalfYear, PeriodYear:
+		return true
+	}
+	return false
+}
+
 // GetDateRangeOfTable get the min and max date from table in db
-func GetDateRangeOfTable(table string, period string, db *gorm.DB,
+func GetDateRangeOfTable(ctx context.Context, table string, period string, db *gorm.DB,
 	filters func(b sq.SelectBuilder) sq.SelectBuilder) (time.Time, time.Time, error) {
-	table = fmt.Sprintf(`"%s"`, table)
+	table = models.QuoteIdentifier(table)
 	sb := sq.Select("min(date) as min, max(date) as max").From(table).Where(sq.Eq{"period": period})
 	if filters != nil {
 		sb = filters(sb)
@@ -33,7 +48,7 @@ func GetDateRangeOfTable(table string, period string, db *gorm.DB,
 	if err != nil {
 		return time.Time{}, time.Time{}, err
 	}
-	rows, err := db.Raw(sql, args...).Rows()
+	rows, err := models.RawRows(ctx, db, sql, args...)
 	if err != nil {
 		return time.Time{}, time.Time{}, err
 	}
@@ -52,21 +67,7 @@ func GetDateRangeOfTable(table string, period string, db *gorm.DB,
 
 // AlignPeriodRange adjusts time range by period.
 func AlignPeriodRange(beginning time.Time, end time.Time, period string) (time.Time, time.Time) {
-	if end.IsZero() {
-		end = time.Now().UTC()
-	}
-	end = EndOfPeriod(end, period)
-
-	if beginning.IsZero() {
-		beginning = end
-		for i := 1; i < DefaultPeriodRangeLength; i++ {
-			beginning = Backward(beginning, period)
-		}
-	} else {
-		beginning = BeginningOfPeriod(beginning, period)
-	}
-
-	return beginning, end
+	return Calendar{}.AlignPeriodRange(beginning, end, period)
 }
 
 // Backward returns the previous passed time before a given time by specific period.
@@ -76,6 +77,9 @@ func Backward(t time.Time, period string) time.Time {
 		justBeforeThisDay := now.New(t).BeginningOfDay().Add(-time.Second)
 		return now.New(justBeforeThisDay).BeginningOfDay()
 
+	case PeriodWeek:
+		return beginningOfISOWeek(t).AddDate(0, 0, -7)
+
 	case PeriodMonth:
 		justBeforeThisMonth := now.New(t).BeginningOfMonth().Add(-time.Second)
 		return now.New(justBeforeThisMonth).BeginningOfMonth()
@@ -84,6 +88,9 @@ func Backward(t time.Time, period string) time.Time {
 		justBeforeThisQuarter := now.New(t).BeginningOfQuarter().Add(-time.Second)
 		return now.New(justBeforeThisQuarter).BeginningOfQuarter()
 
+	case PeriodHalfYear:
+		return beginningOfHalfYear(t).AddDate(0, -6, 0)
+
 	case PeriodYear:
 		justBeforeThisYear := now.New(t).BeginningOfYear().Add(-time.Second)
 		return now.New(justBeforeThisYear).BeginningOfYear()
@@ -101,6 +108,9 @@ func Forward(t time.Time, period string) time.Time {
 		justAfterThisDay := now.New(t).EndOfDay().Add(time.Second)
 		return now.New(justAfterThisDay).BeginningOfDay()
 
+	case PeriodWeek:
+		return beginningOfISOWeek(t).AddDate(0, 0, 7)
+
 	case PeriodMonth:
 		justAfterThisMonth := now.New(t).EndOfMonth().Add(time.Second)
 		return now.New(justAfterThisMonth).BeginningOfMonth()
@@ -109,6 +119,9 @@ func Forward(t time.Time, period string) time.Time {
 		justAfterThisQuarter := now.New(t).EndOfQuarter().Add(time.Second)
 		return now.New(justAfterThisQuarter).BeginningOfQuarter()
 
+	case PeriodHalfYear:
+		return beginningOfHalfYear(t).AddDate(0, 6, 0)
+
 	case PeriodYear:
 		justAfterThisYear := now.New(t).EndOfYear().Add(time.Second)
 		return now.New(justAfterThisYear).BeginningOfYear()
@@ -119,14 +132,25 @@ func Forward(t time.Time, period string) time.Time {
 	return t
 }
 
-// NextPeriodLevel return next period level after given period.
+// BackwardN returns the beginning of the period n periods before the given time.
+func BackwardN(t time.Time, period string, n int) time.Time {
+	return Calendar{}.BackwardN(t, period, n)
+}
+
+// ForwardN returns the beginning of the period n periods after the given time.
+func ForwardN(t time.Time, period string, n int) time.Time {
+	return Calendar{}.ForwardN(t, period, n)
+}
+
+// NextPeriodLevel return next period level after given period. Weeks,
+// which do not nest in months, go to months like days.
 func NextPeriodLevel(period string) string {
 	switch period {
-	case PeriodDate:
+	case PeriodDate, PeriodWeek:
 		return PeriodMonth
 	case PeriodMonth:
 		return PeriodQuarter
-	case PeriodQuarter:
+	case PeriodQuarter, PeriodHalfYear:
 		return PeriodYear
 	case PeriodYear:
 		return PeriodYear
@@ -141,10 +165,14 @@ func BeginningOfPeriod(t time.Time, period string) time.Time {
 	switch period {
 	case PeriodDate:
 		return now.New(t).BeginningOfDay()
+	case PeriodWeek:
+		return beginningOfISOWeek(t)
 	case PeriodMonth:
 		return now.New(t).BeginningOfMonth()
 	case PeriodQuarter:
 		return now.New(t).BeginningOfQuarter()
+	case PeriodHalfYear:
+		return beginningOfHalfYear(t)
 	case PeriodYear:
 		return now.New(t).BeginningOfYear()
 	default:
@@ -158,10 +186,14 @@ func EndOfPeriod(t time.Time, period string) time.Time {
 	switch period {
 	case PeriodDate:
 		return now.New(t).EndOfDay()
+	case PeriodWeek:
+		return beginningOfISOWeek(t).AddDate(0, 0, 7).Add(-time.Nanosecond)
 	case PeriodMonth:
 		return now.New(t).EndOfMonth()
 	case PeriodQuarter:
 		return now.New(t).EndOfQuarter()
+	case PeriodHalfYear:
+		return beginningOfHalfYear(t).AddDate(0, 6, 0).Add(-time.Nanosecond)
 	case PeriodYear:
 		return now.New(t).EndOfYear()
 	default:
@@ -170,18 +202,137 @@ func EndOfPeriod(t time.Time, period string) time.Time {
 	return time.Now().UTC()
 }
 
-// FormatTime formats the given time accordingly
+// beginningOfISOWeek returns the Monday starting the ISO week of t
+func beginningOfISOWeek(t time.Time) time.Time {
+	day := now.New(t).BeginningOfDay()
+	return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+}
+
+// beginningOfHalfYear returns January or July 1st before t
+func beginningOfHalfYear(t time.Time) time.Time {
+	month := time.January
+	if t.Month() > time.June {
+		month = time.July
+	}
+	return time.Date(t.Year(), month, 1, 0, 0, 0, 0, t.Location())
+}
+
+// half returns 1 or 2, the half of the year of t
+func half(t time.Time) int {
+	return int(t.Month()-1)/6 + 1
+}
+
+// FormatTime formats the given time accordingly. Weeks are written as ISO
+// weeks of their ISO year, e.g. "2018/W05", half years as "2018/H1".
 func FormatTime(t time.Time, period string) string {
 	switch period {
 	default:
 		fallthrough
 	case PeriodDate:
 		return t.Format("2006/01/02")
+	case PeriodWeek:
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d/W%02d", year, week)
 	case PeriodMonth:
 		return t.Format("2006/01")
 	case PeriodQuarter:
-		return fmt.Sprintf("%s/Q%d", t.Format("2006"), int(t.Month()-1)%3+1)
+		return fmt.Sprintf("%s/Q%d", t.Format("2006"), int(t.Month()-1)/3+1)
+	case PeriodHalfYear:
+		return fmt.Sprintf("%s/H%d", t.Format("2006"), half(t))
 	case PeriodYear:
 		return t.Format("2006")
 	}
 }
+
+// ParseLabel reads back a label written by FormatTime, returning the start
+// of its period and the period
+func ParseLabel(label string) (time.Time, string, bool) {
+	for _, f := range []struct {
+		sep    string
+		max    int
+		period string
+	}{
+		{"/Q", 4, PeriodQuarter},
+		{"/H", 2, PeriodHalfYear},
+		{"/W", 53, PeriodWeek},
+	} {
+		i := strings.Index(label, f.sep)
+		if i <= 0 {
+			continue
+		}
+		year, err1 := strconv.Atoi(label[:i])
+		n, err2 := strconv.Atoi(label[i+2:])
+		if err1 != nil || err2 != nil || n < 1 || n > f.max {
+			return time.Time{}, "", false
+		}
+		switch f.period {
+		case PeriodQuarter:
+			return time.Date(year, time.Month(n*3-2), 1, 0, 0, 0, 0, time.UTC), f.period, true
+		case PeriodHalfYear:
+			return time.Date(year, time.Month(n*6-5), 1, 0, 0, 0, 0, time.UTC), f.period, true
+		default:
+			// January 4th is always in the first ISO week
+			first := beginningOfISOWeek(time.Date(year, time.January, 4, 0, 0, 0, 0, time.UTC))
+			t := first.AddDate(0, 0, 7*(n-1))
+			if y, _ := t.ISOWeek(); y != year {
+				return time.Time{}, "", false
+			}
+			return t, f.period, true
+		}
+	}
+	for _, f := range []struct{ layout, period string }{
+		{"2006/01/02", PeriodDate},
+		{"2006/01", PeriodMonth},
+		{"2006", PeriodYear},
+	} {
+		if t, err := time.Parse(f.layout, label); err == nil {
+			return t, f.period, true
+		}
+	}
+	return time.Time{}, "", false
+}
+
+// FormatTimeIn formats the given time like FormatTime in the way of a locale.
+// Chinese locales get "2018年01月", "2018年第1季度", "2018年第5周",
+// "2018年上半年", others FormatTime.
+func FormatTimeIn(t time.Time, period string, locale string) string {
+	if !isChinese(locale) {
+		return FormatTime(t, period)
+	}
+	switch period {
+	default:
+		return t.Format("2006年01月02日")
+	case PeriodWeek:
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d年第%d周", year, week)
+	case PeriodMonth:
+		return t.Format("2006年01月")
+	case PeriodQuarter:
+		return fmt.Sprintf("%s年第%d季度", t.Format("2006"), int(t.Month()-1)/3+1)
+	case PeriodHalfYear:
+		return t.Format("2006年") + halvesInChinese[half(t)-1]
+	case PeriodYear:
+		return t.Format("2006年")
+	}
+}
+
+// halvesInChinese names the halves of a year
+var halvesInChinese = [...]string{"上半年", "下半年"}
+
+// isChinese reports whether dates are written the Chinese way in a locale
+func isChinese(locale string) bool {
+	return strings.HasPrefix(strings.ToLower(locale), "zh")
+}
+
+// LocalizeLabel rewrites a label written by FormatTime or Calendar.FormatTime
+// for a locale. Labels it can not read are returned as they are.
+func LocalizeLabel(label string, locale string) string {
+	if year, n, period, ok := parseFiscalLabel(label); ok {
+		return fiscalLabel(year, n, period, isChinese(locale))
+	}
+	t, period, ok := ParseLabel(label)
+	if !ok {
+		return label
+	}
+	return FormatTimeIn(t, period, locale)
+}
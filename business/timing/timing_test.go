@@ -0,0 +1,105 @@
+package timing
+
+import (
+	"testing"
+	"time"
+)
+
+func date(year int, month time.Month, day int) time.Time {
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+func TestPeriodBounds(t *testing.T) {
+	testCases := []struct {
+		t         time.Time
+		period    string
+		beginning time.Time
+		end       time.Time
+	}{
+		// 2018/12/31 is a Monday in the first ISO week of 2019
+		{date(2018, 12, 31), PeriodWeek, date(2018, 12, 31), date(2019, 1, 7)},
+		{date(2019, 1, 6), PeriodWeek, date(2018, 12, 31), date(2019, 1, 7)},
+		// 2021/01/03 is a Sunday in week 53 of 2020
+		{date(2021, 1, 3), PeriodWeek, date(2020, 12, 28), date(2021, 1, 4)},
+		{date(2018, 6, 30), PeriodHalfYear, date(2018, 1, 1), date(2018, 7, 1)},
+		{date(2018, 7, 1), PeriodHalfYear, date(2018, 7, 1), date(2019, 1, 1)},
+		{date(2018, 12, 31), PeriodHalfYear, date(2018, 7, 1), date(2019, 1, 1)},
+	}
+
+	for i, tc := range testCases {
+		if out := BeginningOfPeriod(tc.t, tc.period); !out.Equal(tc.beginning) {
+			t.Error(i, ":", "want", tc.beginning, "got", out)
+		}
+		// periods end a nanosecond before the next one begins
+		if out := EndOfPeriod(tc.t, tc.period).Add(time.Nanosecond); !out.Equal(tc.end) {
+			t.Error(i, ":", "want", tc.end, "got", out)
+		}
+	}
+}
+
+func TestForwardBackward(t *testing.T) {
+	testCases := []struct {
+		t        time.Time
+		period   string
+		backward time.Time
+		forward  time.Time
+	}{
+		{date(2019, 1, 2), PeriodWeek, date(2018, 12, 24), date(2019, 1, 7)},
+		{date(2020, 12, 30), PeriodWeek, date(2020, 12, 21), date(2021, 1, 4)},
+		{date(2021, 1, 4), PeriodWeek, date(2020, 12, 28), date(2021, 1, 11)},
+		{date(2018, 3, 15), PeriodHalfYear, date(2017, 7, 1), date(2018, 7, 1)},
+		{date(2018, 9, 15), PeriodHalfYear, date(2018, 1, 1), date(2019, 1, 1)},
+	}
+
+	for i, tc := range testCases {
+		if out := Backward(tc.t, tc.period); !out.Equal(tc.backward) {
+			t.Error(i, ":", "want", tc.backward, "got", out)
+		}
+		if out := Forward(tc.t, tc.period); !out.Equal(tc.forward) {
+			t.Error(i, ":", "want", tc.forward, "got", out)
+		}
+	}
+
+	// 52 weeks back from the first week of 2021 is the second week of 2020,
+	// which had 53
+	if out := FormatTime(BackwardN(date(2021, 1, 4), PeriodWeek, 52), PeriodWeek); out != "2020/W02" {
+		t.Error("want", "2020/W02", "got", out)
+	}
+}
+
+func TestFormatAndParseLabel(t *testing.T) {
+	testCases := []struct {
+		t      time.Time
+		period string
+		label  string
+		zh     string
+	}{
+		{date(2018, 12, 31), PeriodWeek, "2019/W01", "2019年第1周"},
+		{date(2021, 1, 3), PeriodWeek, "2020/W53", "2020年第53周"},
+		{date(2018, 2, 1), PeriodWeek, "2018/W05", "2018年第5周"},
+		{date(2018, 6, 30), PeriodHalfYear, "2018/H1", "2018年上半年"},
+		{date(2018, 7, 1), PeriodHalfYear, "2018/H2", "2018年下半年"},
+		{date(2018, 4, 1), PeriodQuarter, "2018/Q2", "2018年第2季度"},
+	}
+
+	for i, tc := range testCases {
+		label := FormatTime(tc.t, tc.period)
+		if label != tc.label {
+			t.Error(i, ":", "want", tc.label, "got", label)
+		}
+		if out := FormatTimeIn(tc.t, tc.period, "zh-CN"); out != tc.zh {
+			t.Error(i, ":", "want", tc.zh, "got", out)
+		}
+		start, period, ok := ParseLabel(label)
+		if beginning := BeginningOfPeriod(tc.t, tc.period); !ok || period != tc.period || !start.Equal(beginning) {
+			t.Error(i, ":", "want", beginning, tc.period, "got", start, period, ok)
+		}
+	}
+
+	// 2018 had 52 ISO weeks
+	for i, label := range []string{"2018/W53", "2018/W00", "2018/H3", "2018/Q5"} {
+		if _, _, ok := ParseLabel(label); ok {
+			t.Error(i, ":", "want", label, "rejected")
+		}
+	}
+}
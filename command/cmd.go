@@ -39,6 +39,29 @@ func RunCommand(db *gorm.DB) {
 			PushAllFigures(*figpath, *dataset, db)
 		}
 
+	case "lint":
+		lintcmd := pflag.NewFlagSet("lint", pflag.ExitOnError)
+		figpath := lintcmd.StringP("path", "p", "./figures", "figure file dir")
+		dataset := lintcmd.StringP("dataset", "d", "", "name of dataset dir")
+		nodb := lintcmd.BoolP("nodb", "n", false, "skip checks against database schema")
+		lintcmd.Parse(os.Args[2:])
+
+		if *nodb {
+			db = nil
+		}
+		problems, err := LintAllFigures(*figpath, *dataset, db)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(2)
+		}
+		for _, p := range problems {
+			fmt.Println(p)
+		}
+		if len(problems) > 0 {
+			fmt.Printf("%d problems found\n", len(problems))
+			os.Exit(1)
+		}
+
 	case "mock":
 		mocking.CreateMockingData(db)
 
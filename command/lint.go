@@ -0,0 +1,260 @@
+package command
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+
+	"github.com/bluecover/lm/figure_parser"
+	"github.com/bluecover/lm/models"
+	"github.com/bluecover/lm/util"
+	"github.com/jinzhu/gorm"
+)
+
+// LintProblem is an issue found by the figure linter
+type LintProblem struct {
+	File    string
+	Message string
+}
+
+func (p LintProblem) String() string {
+	return fmt.Sprintf("%s: %s", p.File, p.Message)
+}
+
+type datasetLinter struct {
+	dir      string
+	problems []LintProblem
+
+	figures     map[string]*figure_parser.FigureSpec
+	figureFiles map[string]string
+	pages       map[string]*figure_parser.PageSpec
+	pageFiles   map[string]string
+}
+
+func (l *datasetLinter) report(file string, format string, a ...interface{}) {
+	l.problems = append(l.problems, LintProblem{File: file, Message: fmt.Sprintf(format, a...)})
+}
+
+// LintAllFigures lints every dataset under figRootDir, or only datasetName if given.
+// A nil db skips the database schema checks.
+func LintAllFigures(figRootDir string, datasetName string, db *gorm.DB) ([]LintProblem, error) {
+	dir, err := ioutil.ReadDir(figRootDir)
+	if err != nil {
+		return nil, fmt.Errorf("open dir %s failed %s", figRootDir, err)
+	}
+
+	problems := make([]LintProblem, 0)
+	for _, f := range dir {
+		if !f.IsDir() {
+			continue
+		}
+		if len(datasetName) > 0 && f.Name() != datasetName {
+			continue
+		}
+		problems = append(problems, LintDataset(path.Join(figRootDir, f.Name()), db)...)
+	}
+	return problems, nil
+}
+
+// LintDataset cross-checks the figures, pages and dataset.json of a dataset dir
+// with each other and with the database.
+func LintDataset(datasetDir string, db *gorm.DB) []LintProblem {
+	l := &datasetLinter{
+		dir:         datasetDir,
+		figures:     make(map[string]*figure_parser.FigureSpec),
+		figureFiles: make(map[string]string),
+		pages:       make(map[string]*figure_parser.PageSpec),
+		pageFiles:   make(map[string]string),
+	}
+
+	l.loadFigures(path.Join(datasetDir, "figures"))
+	l.loadPages(path.Join(datasetDir, "pages"))
+	l.checkPageReferences()
+	l.checkDataset(path.Join(datasetDir, "dataset.json"))
+	if db != nil {
+		l.checkSchema(db)
+	}
+	return l.problems
+}
+
+func (l *datasetLinter) readDir(dir string, fn func(file string, bytes []byte)) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		l.report(dir, "open dir failed %s", err)
+		return
+	}
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		file := path.Join(dir, f.Name())
+		bytes, err := ioutil.ReadFile(file)
+		if err != nil {
+			l.report(file, "%s", err)
+			continue
+		}
+		fn(file, bytes)
+	}
+}
+
+func (l *datasetLinter) reportInvalid(file string, err error) {
+	if errs, ok := err.(figure_parser.ValidationErrors); ok {
+		for _, e := range errs {
+			l.report(file, "%s", e)
+		}
+	} else if err != nil {
+		l.report(file, "%s", err)
+	}
+}
+
+func (l *datasetLinter) loadFigures(dir string) {
+	l.readDir(dir, func(file string, bytes []byte) {
+		fig, err := figure_parser.DecodeFigure(bytes)
+		if err != nil {
+			l.reportInvalid(file, err)
+			return
+		}
+		l.reportInvalid(file, fig.Validate())
+		if len(fig.ID) == 0 {
+			return
+		}
+		if other, ok := l.figureFiles[fig.ID]; ok {
+			l.report(file, "figure id %s is also defined in %s", fig.ID, other)
+			return
+		}
+		l.figures[fig.ID] = fig
+		l.figureFiles[fig.ID] = file
+	})
+}
+
+func (l *datasetLinter) loadPages(dir string) {
+	l.readDir(dir, func(file string, bytes []byte) {
+		page, err := figure_parser.DecodePage(bytes)
+		if err != nil {
+			l.reportInvalid(file, err)
+			return
+		}
+		l.reportInvalid(file, page.Validate())
+		if len(page.ID) == 0 {
+			return
+		}
+		if other, ok := l.pageFiles[page.ID]; ok {
+			l.report(file, "page id %s is also defined in %s", page.ID, other)
+			return
+		}
+		l.pages[page.ID] = page
+		l.pageFiles[page.ID] = file
+	})
+}
+
+func (l *datasetLinter) checkPageReferences() {
+	referenced := make(map[string]bool)
+	for _, id := range sortedKeys(l.pageFiles) {
+		for _, figureID := range l.pages[id].FigureIDs() {
+			referenced[figureID] = true
+			if _, ok := l.figures[figureID]; !ok {
+				l.report(l.pageFiles[id], "figure %s has no figure file", figureID)
+			}
+		}
+	}
+
+	for _, id := range sortedKeys(l.figureFiles) {
+		if !referenced[id] {
+			l.report(l.figureFiles[id], "figure %s is not referenced by any page", id)
+		}
+	}
+}
+
+func (l *datasetLinter) checkDataset(file string) {
+	bytes, err := ioutil.ReadFile(file)
+	if err != nil {
+		l.report(file, "%s", err)
+		return
+	}
+	ds, err := figure_parser.DecodeDataset(bytes)
+	if err != nil {
+		l.report(file, "%s", err)
+		return
+	}
+	for _, id := range ds.PageIDs() {
+		if _, ok := l.pages[id]; !ok {
+			l.report(file, "figure page %s does not exist", id)
+		}
+	}
+}
+
+func (l *datasetLinter) checkSchema(db *gorm.DB) {
+	type use struct {
+		file   string
+		path   string
+		column string
+	}
+	uses := make(map[string][]use)
+
+	for _, id := range sortedKeys(l.figureFiles) {
+		fig, file := l.figures[id], l.figureFiles[id]
+		if fig.IsTable() {
+			uses[fig.Table] = append(uses[fig.Table], use{file: file, path: "$.table"})
+			for _, c := range fig.ReferencedColumns() {
+				uses[fig.Table] = append(uses[fig.Table], use{file: file, path: "$.columns", column: c})
+			}
+		}
+		if fig.Queries == nil {
+			continue
+		}
+		fig.Queries.Each("$.#query", func(p string, q figure_parser.QuerySpec) {
+			for _, t := range q.SourceTables() {
+				uses[t] = append(uses[t], use{file: file, path: p + ".table"})
+				for _, c := range q.ReferencedColumns() {
+					uses[t] = append(uses[t], use{file: file, path: p, column: c})
+				}
+			}
+		})
+	}
+	for _, id := range sortedKeys(l.pageFiles) {
+		if table := l.pages[id].Table; len(table) > 0 {
+			uses[table] = append(uses[table], use{file: l.pageFiles[id], path: "$.table"})
+		}
+	}
+
+	tables := make([]string, 0, len(uses))
+	for t := range uses {
+		if len(t) > 0 {
+			tables = append(tables, t)
+		}
+	}
+	sort.Strings(tables)
+
+	schema, err := models.GetTableColumns(db, tables)
+	if err != nil {
+		l.report(l.dir, "read database schema failed %s", err)
+		return
+	}
+
+	for _, t := range tables {
+		columns, ok := schema[t]
+		reported := make(map[string]bool)
+		for _, u := range uses[t] {
+			var msg string
+			if !ok {
+				msg = fmt.Sprintf("%s: table %s does not exist", u.path, t)
+			} else if len(u.column) > 0 && !util.Contains(columns, u.column) {
+				msg = fmt.Sprintf("%s: column %s does not exist in table %s", u.path, u.column, t)
+			}
+			if len(msg) > 0 && !reported[u.file+msg] {
+				reported[u.file+msg] = true
+				l.report(u.file, "%s", msg)
+			}
+		}
+	}
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
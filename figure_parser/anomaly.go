@@ -0,0 +1,214 @@
+package figure_parser
+
+import (
+	"math"
+
+	"github.com/gonum/stat"
+)
+
+// Methods of an AnomalySpec
+const (
+	AnomalyZScore   = "zscore"
+	AnomalySeasonal = "seasonal"
+)
+
+// Defaults of an AnomalySpec
+const (
+	DefaultAnomalyWindow    = 7
+	DefaultAnomalyThreshold = 3
+)
+
+// AnomalySpec tells a query to flag unusual points of its series, e.g.
+//
+//	{"method": "zscore", "window": 7, "threshold": 3}
+//	{"method": "seasonal", "season": 7}
+//
+// "zscore" scores a point against the mean and deviation of the window
+// periods before it. "seasonal" removes a centered trend and the average of
+// each position in the season and scores the residuals; series shorter than
+// two seasons are scored by "zscore". Points scoring beyond the threshold
+// either way are returned in "anomaly_dates" and "anomaly_scores", shaped
+// like "data".
+type AnomalySpec struct {
+	Method    string
+	Window    int
+	Threshold float64
+	// Season is the number of periods of a season, by default 7 days,
+	// 52 weeks, 12 months, 4 quarters or 2 half years
+	Season *int
+
+	errs ValidationErrors
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (a *AnomalySpec) UnmarshalJSON(b []byte) error {
+	d := newFieldDecoder(b)
+	d.decode("method", &a.Method)
+	d.decode("window", &a.Window)
+	d.decode("threshold", &a.Threshold)
+	d.decode("season", &a.Season)
+	a.errs = d.errs
+	return nil
+}
+
+func (a AnomalySpec) validate(path string, errs *ValidationErrors) {
+	errs.merge(path, a.errs)
+	switch a.Method {
+	case "", AnomalyZScore, AnomalySeasonal:
+	default:
+		errs.add(joinPath(path, "method"), "must be %q or %q", AnomalyZScore, AnomalySeasonal)
+	}
+	if a.Window < 0 || a.Window == 1 {
+		errs.add(joinPath(path, "window"), "must be at least 2")
+	}
+	if a.Threshold < 0 {
+		errs.add(joinPath(path, "threshold"), "must not be negative")
+	}
+	if a.Season != nil && *a.Season < 2 {
+		errs.add(joinPath(path, "season"), "must be at least 2")
+	}
+}
+
+// scores returns the anomaly score of every value, NaN where there is none
+func (a AnomalySpec) scores(values []float64, period string) []float64 {
+	if a.Method == AnomalySeasonal {
+		m := defaultSeason(period)
+		if a.Season != nil {
+			m = *a.Season
+		}
+		if m >= 2 && known(values) >= 2*m {
+			return seasonalScores(values, m)
+		}
+	}
+	window := a.Window
+	if window == 0 {
+		window = DefaultAnomalyWindow
+	}
+	return rollingScores(values, window)
+}
+
+// known counts the values which are not NaN
+func known(values []float64) int {
+	n := 0
+	for _, f := range values {
+		if !math.IsNaN(f) {
+			n++
+		}
+	}
+	return n
+}
+
+// rollingScores scores each value against the window known values before
+// it. Values after a constant window are not scored.
+func rollingScores(values []float64, window int) []float64 {
+	scores := make([]float64, len(values))
+	prev := make([]float64, 0, window)
+	for i, f := range values {
+		scores[i] = math.NaN()
+		if math.IsNaN(f) {
+			continue
+		}
+		if len(prev) >= 2 {
+			mean, sd := stat.MeanStdDev(prev, nil)
+			if sd > 0 {
+				scores[i] = (f - mean) / sd
+			}
+		}
+		if len(prev) == window {
+			prev = prev[1:]
+		}
+		prev = append(prev, f)
+	}
+	return scores
+}
+
+// seasonalScores scores the residuals of values once a centered trend and
+// the mean of each of the m positions of a season are removed
+func seasonalScores(values []float64, m int) []float64 {
+	n := len(values)
+	detrended := make([]float64, n)
+	for i := range values {
+		sum, count := 0.0, 0
+		for j := i - m/2; j <= i+m/2; j++ {
+			if j >= 0 && j < n && !math.IsNaN(values[j]) {
+				sum += values[j]
+				count++
+			}
+		}
+		detrended[i] = math.NaN()
+		if count > 0 {
+			detrended[i] = values[i] - sum/float64(count)
+		}
+	}
+
+	season := make([]float64, m)
+	for k := range season {
+		sum, count := 0.0, 0
+		for i := k; i < n; i += m {
+			if !math.IsNaN(detrended[i]) {
+				sum += detrended[i]
+				count++
+			}
+		}
+		if count > 0 {
+			season[k] = sum / float64(count)
+		}
+	}
+
+	residuals := make([]float64, n)
+	observed := make([]float64, 0, n)
+	for i := range residuals {
+		residuals[i] = detrended[i] - season[i%m]
+		if !math.IsNaN(residuals[i]) {
+			observed = append(observed, residuals[i])
+		}
+	}
+	mean, sd := stat.MeanStdDev(observed, nil)
+	scores := make([]float64, n)
+	for i, r := range residuals {
+		scores[i] = math.NaN()
+		if sd > 0 {
+			scores[i] = (r - mean) / sd
+		}
+	}
+	return scores
+}
+
+// flag returns the dates and the scores of the anomalies of a series
+func (a AnomalySpec) flag(values []float64, periodRange []string, period string) (dates []string, scores []string) {
+	threshold := a.Threshold
+	if threshold == 0 {
+		threshold = DefaultAnomalyThreshold
+	}
+	dates, scores = make([]string, 0), make([]string, 0)
+	for i, score := range a.scores(values, period) {
+		if i < len(periodRange) && math.Abs(score) > threshold {
+			dates = append(dates, periodRange[i])
+			scores = append(scores, formatDerived(math.Round(score*100)/100))
+		}
+	}
+	return dates, scores
+}
+
+// applyAnomaly adds the anomalies of the series in "data" of a result
+func applyAnomaly(result map[string]interface{}, a *AnomalySpec, period string) error {
+	if a == nil {
+		return nil
+	}
+	s, err := toSeriesSet(result["data"], false)
+	if err != nil {
+		return err
+	}
+	periodRange, _ := result["date_range"].([]string)
+	dates := make([][]string, len(s.series))
+	scores := make([][]string, len(s.series))
+	for i, values := range s.series {
+		dates[i], scores[i] = a.flag(values, periodRange, period)
+	}
+	if s.flat {
+		result["anomaly_dates"], result["anomaly_scores"] = dates[0], scores[0]
+	} else {
+		result["anomaly_dates"], result["anomaly_scores"] = dates, scores
+	}
+	return nil
+}
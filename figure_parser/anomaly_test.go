@@ -0,0 +1,107 @@
+package figure_parser
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestRollingScores(t *testing.T) {
+	nan := math.NaN()
+	scores := rollingScores([]float64{1, 3, nan, 1, 3, 2, 2}, 4)
+	want := []float64{nan, nan, nan, -0.7071, 1.1547, 0, -0.2611}
+	for i := range want {
+		if math.IsNaN(want[i]) != math.IsNaN(scores[i]) ||
+			!math.IsNaN(want[i]) && math.Abs(want[i]-scores[i]) > 1e-4 {
+			t.Error(i, ":", "want", want[i], "got", scores[i])
+		}
+	}
+
+	// a constant window does not score
+	scores = rollingScores([]float64{5, 5, 5, 9}, 3)
+	if !math.IsNaN(scores[3]) {
+		t.Error("want NaN got", scores[3])
+	}
+}
+
+func TestApplyAnomaly(t *testing.T) {
+	periodRange := []string{"d1", "d2", "d3", "d4", "d5", "d6", "d7", "d8"}
+	testCases := []struct {
+		anomaly AnomalySpec
+		data    interface{}
+		dates   interface{}
+		scores  interface{}
+	}{
+		{
+			AnomalySpec{},
+			[]string{"10", "11", "9", "10", "11", "9", "10", "40"},
+			[]string{"d8"},
+			[]string{"36.74"},
+		},
+		{
+			AnomalySpec{Window: 3, Threshold: 2.5},
+			[][]string{{"10", "11", "9", "-", "10", "12", "5", "10"}, {"1", "1", "1", "1", "1", "1", "1", "1"}},
+			[][]string{{"d7"}, {}},
+			[][]string{{"-3.49"}, {}},
+		},
+	}
+
+	for i, tc := range testCases {
+		result := map[string]interface{}{"date_range": periodRange, "data": tc.data}
+		if err := applyAnomaly(result, &tc.anomaly, PeriodDate); err != nil {
+			t.Error(i, ":", err)
+			continue
+		}
+		if !reflect.DeepEqual(tc.dates, result["anomaly_dates"]) {
+			t.Error(i, ":", "want", tc.dates, "got", result["anomaly_dates"])
+		}
+		if !reflect.DeepEqual(tc.scores, result["anomaly_scores"]) {
+			t.Error(i, ":", "want", tc.scores, "got", result["anomaly_scores"])
+		}
+	}
+}
+
+func TestSeasonalAnomaly(t *testing.T) {
+	pattern := []float64{10, 2, 0, 1, 3, 0, -16}
+	values := make([]float64, 28)
+	for i := range values {
+		values[i] = 100 + pattern[i%7] + float64(i%3)*0.1
+	}
+	values[17] += 8
+
+	// the weekly pattern hides the spike from a rolling window
+	a := AnomalySpec{Method: AnomalySeasonal, Threshold: 3}
+	periodRange := make([]string, len(values))
+	for i := range periodRange {
+		periodRange[i] = string(rune('a' + i))
+	}
+	dates, _ := a.flag(values, periodRange, PeriodDate)
+	if !reflect.DeepEqual([]string{periodRange[17]}, dates) {
+		t.Error("want", []string{periodRange[17]}, "got", dates)
+	}
+	dates, _ = AnomalySpec{Threshold: 3}.flag(values, periodRange, PeriodDate)
+	if reflect.DeepEqual([]string{periodRange[17]}, dates) {
+		t.Error("want zscore to miss the seasonal spike")
+	}
+}
+
+func TestValidateAnomaly(t *testing.T) {
+	query, _ := DecodeQuery([]byte(`{"type": "select_column", "table": "t", "column": "c",
+		"anomaly": {"method": "iqr", "window": 1, "threshold": -1, "season": 1}}`))
+	want := ValidationErrors{
+		{"$.anomaly.method", `must be "zscore" or "seasonal"`},
+		{"$.anomaly.window", "must be at least 2"},
+		{"$.anomaly.threshold", "must not be negative"},
+		{"$.anomaly.season", "must be at least 2"},
+	}
+	if err := query.Validate(); !reflect.DeepEqual(want, err) {
+		t.Error("want", want, "got", err)
+	}
+
+	query, _ = DecodeQuery([]byte(`{"type": "element", "table": "t", "function": "sum(c)",
+		"anomaly": {}}`))
+	want = ValidationErrors{{"$.anomaly", "is not supported by element query"}}
+	if err := query.Validate(); !reflect.DeepEqual(want, err) {
+		t.Error("want", want, "got", err)
+	}
+}
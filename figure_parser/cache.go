@@ -0,0 +1,347 @@
+package figure_parser
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/bluecover/lm/business/timing"
+	"github.com/bluecover/lm/models"
+	"github.com/bluecover/lm/module/cache"
+	"github.com/bluecover/lm/util"
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultVersionCheck is how long the data version of a table is trusted
+// before it is read again
+const DefaultVersionCheck = time.Minute
+
+const cacheKeyPrefix = "lm:query:"
+
+var (
+	resultCache  cache.Store
+	inflight     cache.Group
+	versionCheck = DefaultVersionCheck
+
+	versionsMu sync.Mutex
+	versions   = make(map[string]tableVersion)
+	columns    = make(map[string]tableColumns)
+	calendars  = make(map[string]datasetCalendar)
+)
+
+type tableVersion struct {
+	version string
+	checked time.Time
+}
+
+type tableColumns struct {
+	columns []string
+	checked time.Time
+}
+
+type datasetCalendar struct {
+	calendar timing.Calendar
+	checked  time.Time
+}
+
+func init() {
+	// concrete types held by query results, so that gob keeps them
+	gob.Register([][]string{})
+	gob.Register([]interface{}{})
+	gob.Register([][]interface{}{})
+	gob.Register(map[string]string{})
+	gob.Register(map[string]interface{}{})
+}
+
+// SetCache makes ParseQuery keep query results in store, nil turns caching
+// off. Cached results of a table are dropped when its data version changes,
+// which is checked at most once per check interval.
+func SetCache(store cache.Store, check time.Duration) {
+	resultCache = store
+	if check > 0 {
+		versionCheck = check
+	}
+}
+
+// datasetOf returns the dataset of a table, the part of its name before the dot
+func datasetOf(table string) string {
+	return strings.SplitN(table, ".", 2)[0]
+}
+
+// dataVersion returns the version of the data of a table: its latest date and
+// the index update time of its dataset.
+func dataVersion(ctx context.Context, table string, db *gorm.DB) (string, error) {
+	versionsMu.Lock()
+	v, ok := versions[table]
+	versionsMu.Unlock()
+	if ok && time.Since(v.checked) < versionCheck {
+		return v.version, nil
+	}
+
+	statement, _, err := sq.Select("max(date)").From(models.QuoteIdentifier(table)).ToSql()
+	if err != nil {
+		return "", err
+	}
+	var maxDate *time.Time
+	if err := rawScan(ctx, db, statement, nil, &maxDate); err != nil {
+		return "", err
+	}
+	version := ""
+	if maxDate != nil {
+		version = maxDate.UTC().Format(time.RFC3339)
+	}
+	version += "/" + models.GetDatasetIndexUpdatedAt(db, datasetOf(table)).UTC().Format(time.RFC3339Nano)
+
+	versionsMu.Lock()
+	versions[table] = tableVersion{version, time.Now()}
+	versionsMu.Unlock()
+	return version, nil
+}
+
+// columnsOfTable returns the column names of a table, read again from the
+// database after the version check interval like the data version
+func columnsOfTable(table string, db *gorm.DB) ([]string, error) {
+	versionsMu.Lock()
+	c, ok := columns[table]
+	versionsMu.Unlock()
+	if ok && time.Since(c.checked) < versionCheck {
+		return c.columns, nil
+	}
+
+	schema, err := models.GetTableColumns(db, []string{table})
+	if err != nil {
+		return nil, err
+	}
+	cols, ok := schema[table]
+	if !ok {
+		return nil, fmt.Errorf("table %s does not exist", table)
+	}
+
+	versionsMu.Lock()
+	columns[table] = tableColumns{cols, time.Now()}
+	versionsMu.Unlock()
+	return cols, nil
+}
+
+// CalendarOfDataset returns the calendar the named dataset reports on, read
+// again from the database after the version check interval
+func CalendarOfDataset(dataset string, db *gorm.DB) timing.Calendar {
+	versionsMu.Lock()
+	c, ok := calendars[dataset]
+	versionsMu.Unlock()
+	if ok && time.Since(c.checked) < versionCheck {
+		return c.calendar
+	}
+
+	calendar := timing.NewCalendar(models.GetDatasetFiscalYearStart(db, dataset))
+
+	versionsMu.Lock()
+	calendars[dataset] = datasetCalendar{calendar, time.Now()}
+	versionsMu.Unlock()
+	return calendar
+}
+
+// cacheKey hashes what a cached value depends on, including the data
+// versions of the tables it is read from
+func cacheKey(ctx context.Context, kind string, tables []string, db *gorm.DB, parts ...interface{}) (string, error) {
+	versions := make([]string, len(tables))
+	for i, table := range tables {
+		version, err := dataVersion(ctx, table, db)
+		if err != nil {
+			return "", err
+		}
+		versions[i] = version
+	}
+	b, err := json.Marshal(append([]interface{}{kind, tables, versions}, parts...))
+	if err != nil {
+		return "", err
+	}
+	return cacheKeyPrefix + kind + ":" + util.SHA256(b), nil
+}
+
+// errNotCacheable is shared by load with the callers waiting for a value gob
+// can not encode
+var errNotCacheable = errors.New("value can not be cached")
+
+// detached returns a context for a load shared by the requests waiting on
+// it: it is not cancelled with ctx, while its statements still take the
+// statement slots of ctx
+func detached(ctx context.Context) context.Context {
+	detached := context.Background()
+	if slots := ctx.Value(statementSlotsKey{}); slots != nil {
+		detached = context.WithValue(detached, statementSlotsKey{}, slots)
+	}
+	return detached
+}
+
+// cached returns the value of key from the cache, or runs load once for all
+// concurrent callers and caches its value. The value is decoded into out.
+// The load runs on its own context with a figure budget, so that a caller
+// giving up only stops its own wait. Values gob can not encode are logged
+// and returned uncached.
+func cached(ctx context.Context, key string, out interface{},
+	load func(ctx context.Context) (interface{}, error)) error {
+
+	if b, err := resultCache.Get(key); err == nil {
+		if err := decodeCached(b, out); err == nil {
+			return nil
+		}
+		logrus.Errorf("decode cached %s error %s", key, err)
+	} else if err != cache.ErrNotFound {
+		logrus.Errorf("get cached %s error %s", key, err)
+	}
+
+	var value interface{}
+	results := inflight.DoChan(key, func() ([]byte, error) {
+		loadCtx, cancel := withFigureBudget(detached(ctx))
+		defer cancel()
+		v, err := load(loadCtx)
+		if err != nil {
+			return nil, timeoutError(loadCtx, err)
+		}
+		value = v
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+			logrus.Errorf("encode cached %s error %s", key, err)
+			return nil, errNotCacheable
+		}
+		if err := resultCache.Set(key, buf.Bytes()); err != nil {
+			logrus.Errorf("set cached %s error %s", key, err)
+		}
+		return buf.Bytes(), nil
+	})
+
+	var r cache.Result
+	select {
+	case r = <-results:
+	case <-ctx.Done():
+		return timeoutError(ctx, ctx.Err())
+	}
+	if r.Err == errNotCacheable {
+		// the value is not shared, so that no caller changes another's
+		if r.Shared {
+			var err error
+			if value, err = load(ctx); err != nil {
+				return err
+			}
+		}
+		return setValue(out, value)
+	}
+	if r.Err != nil {
+		return r.Err
+	}
+	return decodeCached(r.Value, out)
+}
+
+// decodeCached decodes a cached value into the pointer out. gob decodes empty
+// slices to nil, which JSON writes as null, so they are made empty again.
+func decodeCached(b []byte, out interface{}) error {
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(out); err != nil {
+		return err
+	}
+	o := reflect.ValueOf(out).Elem()
+	o.Set(withEmptySlices(o))
+	return nil
+}
+
+// withEmptySlices returns v with the nil slices it holds made empty
+func withEmptySlices(v reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Interface:
+		if !v.IsNil() {
+			return withEmptySlices(v.Elem())
+		}
+	case reflect.Slice:
+		if v.IsNil() {
+			return reflect.MakeSlice(v.Type(), 0, 0)
+		}
+		for i := 0; i < v.Len(); i++ {
+			v.Index(i).Set(withEmptySlices(v.Index(i)))
+		}
+	case reflect.Map:
+		for _, k := range v.MapKeys() {
+			v.SetMapIndex(k, withEmptySlices(v.MapIndex(k)))
+		}
+	}
+	return v
+}
+
+// setValue stores value into the pointer out
+func setValue(out interface{}, value interface{}) error {
+	v := reflect.ValueOf(value)
+	o := reflect.ValueOf(out).Elem()
+	if !v.IsValid() {
+		o.Set(reflect.Zero(o.Type()))
+		return nil
+	}
+	if !v.Type().AssignableTo(o.Type()) {
+		return fmt.Errorf("can not store %T into %T", value, out)
+	}
+	o.Set(v)
+	return nil
+}
+
+// cachedParse runs parser.Parse through the result cache
+func cachedParse(ctx context.Context, parser QueryParser, query QuerySpec, args ParseArgs, db *gorm.DB) (map[string]interface{}, error) {
+	// traced queries run their statements, so that they can be recorded
+	tables := query.SourceTables()
+	if resultCache == nil || len(tables) == 0 || queryTraceFrom(ctx) != nil {
+		return parser.Parse(ctx, query, args, db)
+	}
+	// results do not depend on the locale they are later written in
+	keyArgs := args
+	keyArgs.Locale = ""
+	key, err := cacheKey(ctx, "parse", tables, db, query.Raw, keyArgs)
+	if err != nil {
+		logrus.Errorf("cache key of %s error %s", strings.Join(tables, ","), err)
+		return parser.Parse(ctx, query, args, db)
+	}
+
+	var result map[string]interface{}
+	err = cached(ctx, key, &result, func(ctx context.Context) (interface{}, error) {
+		return parser.Parse(ctx, query, args, db)
+	})
+	return result, err
+}
+
+// tableDateRange runs timing.GetDateRangeOfTable in a statement slot of ctx
+func tableDateRange(ctx context.Context, table string, period string, filters []Filter,
+	db *gorm.DB) (time.Time, time.Time, error) {
+
+	release, err := acquireStatement(ctx)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	defer release()
+	return timing.GetDateRangeOfTable(ctx, table, period, db, adaptSetFilters(filters))
+}
+
+// DateRangeOfTable runs timing.GetDateRangeOfTable through the result cache
+func DateRangeOfTable(ctx context.Context, table string, period string, filters []Filter,
+	db *gorm.DB) (time.Time, time.Time, error) {
+
+	if resultCache == nil {
+		return tableDateRange(ctx, table, period, filters, db)
+	}
+	key, err := cacheKey(ctx, "range", []string{table}, db, period, filters)
+	if err != nil {
+		logrus.Errorf("cache key of %s error %s", table, err)
+		return tableDateRange(ctx, table, period, filters, db)
+	}
+
+	var dateRange [2]time.Time
+	err = cached(ctx, key, &dateRange, func(ctx context.Context) (interface{}, error) {
+		min, max, err := tableDateRange(ctx, table, period, filters, db)
+		return [2]time.Time{min, max}, err
+	})
+	return dateRange[0], dateRange[1], err
+}
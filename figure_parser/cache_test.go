@@ -0,0 +1,367 @@
+package figure_parser
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bluecover/lm/module/cache"
+	"github.com/jinzhu/gorm"
+)
+
+func TestCached(t *testing.T) {
+	store, err := cache.NewMemoryStore(time.Minute, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resultCache = store
+	defer func() { resultCache = nil }()
+
+	want := map[string]interface{}{
+		"date_range":   []string{"2018/01", "2018/02"},
+		"data":         [][]string{{"1", "2"}},
+		"group_values": []string{"a"},
+		"inc_or_dec":   1,
+		"change":       "N/A",
+	}
+	loads := 0
+	load := func(context.Context) (interface{}, error) {
+		loads++
+		return want, nil
+	}
+	for i := 0; i < 2; i++ {
+		var out map[string]interface{}
+		if err := cached(context.Background(), "key", &out, load); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(want, out) {
+			t.Error(i, ":", "want", want, "got", out)
+		}
+	}
+	if loads != 1 {
+		t.Error("want", 1, "load", "got", loads)
+	}
+}
+
+func TestCachedCallerGivesUp(t *testing.T) {
+	store, err := cache.NewMemoryStore(time.Minute, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resultCache = store
+	defer func() { resultCache = nil }()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var loads int32
+	load := func(ctx context.Context) (interface{}, error) {
+		if atomic.AddInt32(&loads, 1) == 1 {
+			close(started)
+		}
+		select {
+		case <-release:
+			return "v", nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	// the first caller runs out of its budget while the load is running
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	first := make(chan error, 1)
+	go func() {
+		var out string
+		first <- cached(ctx, "shared", &out, load)
+	}()
+	<-started
+	second := make(chan error, 1)
+	var out string
+	go func() {
+		second <- cached(context.Background(), "shared", &out, load)
+	}()
+
+	if err := <-first; err != ErrTimeout {
+		t.Error("want", ErrTimeout, "got", err)
+	}
+	close(release)
+	if err := <-second; err != nil {
+		t.Fatal(err)
+	}
+	if out != "v" {
+		t.Error("want", "v", "got", out)
+	}
+	if loads != 1 {
+		t.Error("want", 1, "load", "got", loads)
+	}
+}
+
+// fakeDriver answers each statement with the next of its rows, so that
+// parsers can run without a database
+type fakeDriver struct {
+	mu         sync.Mutex
+	results    [][][]driver.Value
+	statements []string
+}
+
+func (d *fakeDriver) Open(string) (driver.Conn, error) { return fakeConn{d}, nil }
+
+func (d *fakeDriver) next() [][]driver.Value {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.results) == 0 {
+		return nil
+	}
+	rows := d.results[0]
+	d.results = d.results[1:]
+	return rows
+}
+
+type fakeConn struct{ d *fakeDriver }
+
+func (c fakeConn) Prepare(statement string) (driver.Stmt, error) {
+	c.d.mu.Lock()
+	defer c.d.mu.Unlock()
+	c.d.statements = append(c.d.statements, statement)
+	return fakeStmt(c), nil
+}
+func (fakeConn) Close() error              { return nil }
+func (fakeConn) Begin() (driver.Tx, error) { return nil, errors.New("no transactions") }
+
+type fakeStmt struct{ d *fakeDriver }
+
+func (fakeStmt) Close() error  { return nil }
+func (fakeStmt) NumInput() int { return -1 }
+func (fakeStmt) Exec([]driver.Value) (driver.Result, error) {
+	return nil, errors.New("no statements")
+}
+func (s fakeStmt) Query([]driver.Value) (driver.Rows, error) {
+	return &fakeRows{rows: s.d.next()}, nil
+}
+
+type fakeRows struct {
+	rows [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string {
+	if len(r.rows) == 0 {
+		return nil
+	}
+	return make([]string, len(r.rows[0]))
+}
+func (*fakeRows) Close() error { return nil }
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+var (
+	fake         = &fakeDriver{}
+	registerFake sync.Once
+)
+
+// fakeDB returns a database answering with the given rows, one per statement
+func fakeDB(t *testing.T, results ...[][]driver.Value) *gorm.DB {
+	registerFake.Do(func() { sql.Register("figure_parser_fake", fake) })
+	fake.results = results
+	fake.statements = nil
+	sqlDB, err := sql.Open("figure_parser_fake", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := gorm.Open("common", sqlDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestCachedParsers(t *testing.T) {
+	store, err := cache.NewMemoryStore(time.Minute, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resultCache = store
+	defer func() { resultCache = nil }()
+
+	jan := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	feb := time.Date(2018, 2, 1, 0, 0, 0, 0, time.UTC)
+	mar := time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC)
+	args := ParseArgs{Start: jan, End: time.Date(2018, 3, 31, 0, 0, 0, 0, time.UTC), Period: PeriodMonth}
+
+	// derived queries are computed from their siblings and not cached
+	testCases := []struct {
+		query   string
+		results [][][]driver.Value
+	}{
+		{`{"type": "element", "table": "t", "function": "sum(v)"}`,
+			[][][]driver.Value{{{"42"}}}},
+		{`{"type": "select_column", "table": "t", "column": "v"}`,
+			[][][]driver.Value{{{jan, "1"}, {mar, "3"}}}},
+		{`{"type": "select_column", "table": "t", "column": "v", "raise_dimension": true}`,
+			[][][]driver.Value{{{jan, "1"}}}},
+		{`{"type": "select_column", "table": "t", "column": "v", "anomaly": {}}`,
+			[][][]driver.Value{{{jan, "1"}}}},
+		{`{"type": "aggregate", "table": "t", "group_key": "g", "function": "sum(v)"}`,
+			[][][]driver.Value{{{jan, "a", "1"}, {feb, "b", "2"}}}},
+		{`{"type": "period_series", "table": "t", "column": "v"}`,
+			[][][]driver.Value{{{jan, "1"}, {jan, "2"}}}},
+		{`{"type": "xox", "table": "t", "function": "sum(v)"}`,
+			[][][]driver.Value{{{feb, 1.0}, {mar, 2.0}}}},
+		{`{"type": "xox", "table": "t", "function": "sum(v)", "series": true}`,
+			[][][]driver.Value{{{feb, 1.0}, {mar, 2.0}}}},
+		{`{"type": "distinct", "table": "t", "column": "v"}`,
+			[][][]driver.Value{{{"a"}, {"b"}}}},
+		{`{"type": "histogram", "table": "t", "column": "v", "buckets": {"quantiles": 2}}`,
+			[][][]driver.Value{{{1.0, 10.0, "{5}"}}, {{jan, int64(0), int64(3)}, {feb, int64(1), int64(2)}}}},
+		{`{"type": "percentiles", "table": "t", "column": "v"}`,
+			[][][]driver.Value{{{jan, 1.0, 1.0}, {jan, 3.0, 1.0}, {feb, 2.0, 1.0}}}},
+		{`{"type": "pivot", "table": "t", "row_key": "r", "column_key": "c", "function": "sum(v)"}`,
+			[][][]driver.Value{{{"a", "x", 1.0, int64(0)}, {"a", nil, 1.0, int64(1)},
+				{nil, "x", 1.0, int64(2)}, {nil, nil, 1.0, int64(3)}}}},
+		{`{"type": "forecast", "table": "t", "column": "v"}`,
+			[][][]driver.Value{{{jan, "1"}, {feb, "2"}, {mar, "4"}}}},
+		{`{"type": "scatter", "table": "t", "x": "a", "y": "b"}`,
+			[][][]driver.Value{{{jan, 1.0, 2.0}, {feb, 2.0, 4.0}, {mar, 3.0, 5.0}}}},
+		{`{"type": "compare", "tables": ["A.t", "B.t"], "function": "sum(v)"}`,
+			[][][]driver.Value{{{jan, "1"}}, {{feb, "2"}}}},
+	}
+	for i, tc := range testCases {
+		query, err := DecodeQuery([]byte(tc.query))
+		if err != nil {
+			t.Fatal(err)
+		}
+		parser, err := newParser(query.Type)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db := fakeDB(t, tc.results...)
+		want, err := parser.Parse(context.Background(), query, args, db)
+		if err != nil {
+			t.Error(i, ":", query.Type, err)
+			continue
+		}
+		if err := applyAnomaly(want, query.Anomaly, args.Period); err != nil {
+			t.Error(i, ":", query.Type, err)
+			continue
+		}
+
+		key := fmt.Sprintf("parsers:%d", i)
+		var out map[string]interface{}
+		err = cached(context.Background(), key, &out, func(context.Context) (interface{}, error) {
+			return want, nil
+		})
+		if err != nil {
+			t.Error(i, ":", query.Type, err)
+		}
+		if _, err := store.Get(key); err != nil {
+			t.Error(i, ":", query.Type, "not cached:", err)
+		}
+		if !reflect.DeepEqual(want, out) {
+			t.Error(i, ":", query.Type, "want", want, "got", out)
+		}
+	}
+}
+
+func TestCachedNotEncodable(t *testing.T) {
+	store, err := cache.NewMemoryStore(time.Minute, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resultCache = store
+	defer func() { resultCache = nil }()
+
+	type point struct{ X, Y float64 }
+	want := map[string]interface{}{"data": []point{{1, 2}}}
+	var out map[string]interface{}
+	err = cached(context.Background(), "not-encodable", &out, func(context.Context) (interface{}, error) {
+		return want, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(want, out) {
+		t.Error("want", want, "got", out)
+	}
+	if _, err := store.Get("not-encodable"); err != cache.ErrNotFound {
+		t.Error("want", cache.ErrNotFound, "got", err)
+	}
+}
+
+// countingParser counts its calls
+type countingParser struct{ calls *int }
+
+func (p countingParser) Parse(ctx context.Context, query QuerySpec, args ParseArgs,
+	db *gorm.DB) (map[string]interface{}, error) {
+	*p.calls++
+	return map[string]interface{}{"data": []string{"1"}}, nil
+}
+
+func TestCachedParseSourceTables(t *testing.T) {
+	store, err := cache.NewMemoryStore(time.Minute, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resultCache = store
+	defer func() { resultCache = nil }()
+
+	jan := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	testCases := []struct {
+		query  string
+		tables []string
+	}{
+		{`{"type": "compare", "datasets": ["CACHE1", "CACHE2"], "table": "hotel", "function": "avg(adr)"}`,
+			[]string{"CACHE1.hotel", "CACHE2.hotel"}},
+		{`{"type": "compare", "tables": ["CACHE3.hotel", "CACHE4.inn"], "function": "avg(adr)"}`,
+			[]string{"CACHE3.hotel", "CACHE4.inn"}},
+	}
+
+	for i, tc := range testCases {
+		query, _ := DecodeQuery([]byte(tc.query))
+		versionsMu.Lock()
+		for _, table := range tc.tables {
+			delete(versions, table)
+		}
+		versionsMu.Unlock()
+		calls := 0
+		for run := 0; run < 2; run++ {
+			// the latest date of each table, then the index time of its dataset
+			db := fakeDB(t, [][]driver.Value{{jan}}, nil, [][]driver.Value{{jan}}, nil)
+			if _, err := cachedParse(context.Background(), countingParser{&calls}, query, ParseArgs{}, db); err != nil {
+				t.Error(i, ":", err)
+			}
+			if run > 0 {
+				continue
+			}
+			var versioned []string
+			for _, s := range fake.statements {
+				if strings.HasPrefix(s, "SELECT max(date) FROM") {
+					versioned = append(versioned, s)
+				}
+			}
+			want := []string{
+				fmt.Sprintf("SELECT max(date) FROM %q", tc.tables[0]),
+				fmt.Sprintf("SELECT max(date) FROM %q", tc.tables[1]),
+			}
+			if !reflect.DeepEqual(want, versioned) {
+				t.Error(i, ":", "want", want, "got", versioned)
+			}
+		}
+		if calls != 1 {
+			t.Error(i, ":", "want", 1, "parse", "got", calls)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package figure_parser
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/bluecover/lm/business/timing"
+	"github.com/bluecover/lm/models"
+	"github.com/jinzhu/gorm"
+)
+
+// Fills of the gaps of a compare query. Without one gaps stay "-".
+const (
+	FillZero     = "zero"
+	FillPrevious = "previous"
+	FillLinear   = "linear"
+)
+
+const maxCompareTables = 10
+
+// compareParser aggregates the same "function" of several tables on one
+// period axis, e.g.
+// {"type": "compare", "tables": ["HTHT.hotel", "JJ.hotel"], "function": "avg(adr)"}
+// or the table of the same name in several datasets
+// {"type": "compare", "table": "hotel", "datasets": ["HTHT", "JJ"], "function": "avg(adr)"}
+// The date range spans all tables. "data" holds one series per table, named
+// by "labels", the datasets or the tables in "group_values", with gaps
+// filled by "fill": "zero", "previous" or "linear" between known values.
+// The series share their periods, so the datasets must start their fiscal
+// years in the same month.
+type compareParser struct{}
+
+// SourceTables returns the tables the query reads
+func (q QuerySpec) SourceTables() []string {
+	if q.Type != "compare" {
+		if len(q.Table) == 0 {
+			return nil
+		}
+		return []string{q.Table}
+	}
+	if len(q.Datasets) == 0 {
+		return q.Tables
+	}
+	tables := make([]string, len(q.Datasets))
+	for i, d := range q.Datasets {
+		tables[i] = d + "." + q.Table
+	}
+	return tables
+}
+
+// calendarOfTables returns the calendar the tables of a query report on. The
+// tables of a compare query share one period axis, so their datasets must
+// agree on it.
+func calendarOfTables(query QuerySpec, tables []string, db *gorm.DB) (timing.Calendar, error) {
+	first := datasetOf(tables[0])
+	cal := CalendarOfDataset(first, db)
+	for _, table := range tables[1:] {
+		if dataset := datasetOf(table); CalendarOfDataset(dataset, db) != cal {
+			field := "tables"
+			if len(query.Datasets) > 0 {
+				field = "datasets"
+			}
+			var errs ValidationErrors
+			errs.add(joinPath(rootPath, field), "must start their fiscal years in the same month, %s and %s do not",
+				first, dataset)
+			return cal, errs
+		}
+	}
+	return cal, nil
+}
+
+func (q QuerySpec) validateCompare(path string, errs *ValidationErrors) {
+	switch {
+	case len(q.Datasets) > 0 && len(q.Tables) > 0:
+		errs.add(joinPath(path, "datasets"), "must not be given with tables")
+	case len(q.Datasets) > 0 && len(q.Table) == 0:
+		errs.add(joinPath(path, "table"), "is required with datasets")
+	case len(q.Datasets) == 0 && len(q.Tables) == 0:
+		errs.add(joinPath(path, "tables"), "are required by compare query")
+	case len(q.Datasets) == 0 && len(q.Table) > 0:
+		errs.add(joinPath(path, "table"), "is only used with datasets")
+	}
+	for i, d := range q.Datasets {
+		if len(d) == 0 || strings.Contains(d, ".") {
+			errs.add(joinPath(path, "datasets"+indexPath(i)), "must be a dataset name")
+		}
+	}
+	for i, t := range q.Tables {
+		if len(t) == 0 {
+			errs.add(joinPath(path, "tables"+indexPath(i)), "must be a table name")
+		}
+	}
+
+	tables := q.SourceTables()
+	if len(tables) > maxCompareTables {
+		errs.add(path, "compares at most %d tables", maxCompareTables)
+	}
+	seen := make(map[string]bool)
+	for _, t := range tables {
+		if seen[t] {
+			errs.add(path, "compares table %s twice", t)
+		}
+		seen[t] = true
+	}
+	if len(q.Labels) > 0 && len(q.Labels) != len(tables) {
+		errs.add(joinPath(path, "labels"), "must name each of the %d tables", len(tables))
+	}
+	switch q.Fill {
+	case "", FillZero, FillPrevious, FillLinear:
+	default:
+		errs.add(joinPath(path, "fill"), "must be %q, %q or %q", FillZero, FillPrevious, FillLinear)
+	}
+}
+
+// labels names the series of the tables
+func (q QuerySpec) compareLabels() []string {
+	switch {
+	case len(q.Labels) > 0:
+		return q.Labels
+	case len(q.Datasets) > 0:
+		return q.Datasets
+	default:
+		return q.Tables
+	}
+}
+
+// Parse implement QueryParser.Parse
+func (p compareParser) Parse(ctx context.Context, query QuerySpec, args ParseArgs,
+	db *gorm.DB) (map[string]interface{}, error) {
+
+	periodRange := createPeriodRange(args.Calendar, args.Start, args.End, args.Period)
+	tables := query.SourceTables()
+	labels := query.compareLabels()
+	data := make([][]string, len(tables))
+	for i, table := range tables {
+		values, err := p.series(ctx, table, query.Function, args, db)
+		if err != nil {
+			return nil, err
+		}
+		data[i] = make([]string, len(periodRange))
+		for j, d := range periodRange {
+			if v, ok := values[d]; ok {
+				data[i][j] = v
+			} else {
+				data[i][j] = "-"
+			}
+		}
+		traceGaps(ctx, labels[i], query.Fill, periodRange, fillGaps(data[i], query.Fill))
+		traceGaps(ctx, labels[i], "-", periodRange, gapIndexes(data[i]))
+	}
+
+	return map[string]interface{}{
+		"date_range":   periodRange,
+		"group_values": labels,
+		"data":         data,
+	}, nil
+}
+
+// series returns the values of function by period label of a table
+func (compareParser) series(ctx context.Context, table string, function string, args ParseArgs,
+	db *gorm.DB) (map[string]string, error) {
+
+	builder := sq.Select("date", fmt.Sprintf("(%s)::text", function)).
+		From(models.QuoteIdentifier(table)).GroupBy("date").OrderBy("date ASC")
+	builder = applyArgs(builder, args)
+	statement, sargs, err := builder.ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := queryRows(ctx, db, statement, sargs...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	values := make(map[string]string)
+	for rows.Next() {
+		var date time.Time
+		var value sql.NullString
+		if err := rows.Scan(&date, &value); err != nil {
+			return nil, err
+		}
+		if value.Valid {
+			values[args.Calendar.FormatTime(date, args.Period)] = value.String
+		}
+	}
+	return values, rows.Err()
+}
+
+// fillGaps replaces the "-" of a series by fill and returns the indexes of
+// the values filled
+func fillGaps(row []string, fill string) []int {
+	filled := make([]int, 0)
+	last := -1
+	for i, s := range row {
+		if s != "-" {
+			if fill == FillLinear && last >= 0 && last < i-1 {
+				from, err1 := strconv.ParseFloat(row[last], 64)
+				to, err2 := strconv.ParseFloat(s, 64)
+				if err1 == nil && err2 == nil {
+					step := (to - from) / float64(i-last)
+					for j := last + 1; j < i; j++ {
+						row[j] = formatDerived(from + step*float64(j-last))
+						filled = append(filled, j)
+					}
+				}
+			}
+			last = i
+			continue
+		}
+		switch {
+		case fill == FillZero:
+			row[i] = "0"
+			filled = append(filled, i)
+		case fill == FillPrevious && last >= 0:
+			row[i] = row[last]
+			filled = append(filled, i)
+		}
+	}
+	return filled
+}
@@ -0,0 +1,149 @@
+package figure_parser
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bluecover/lm/business/timing"
+)
+
+func TestFillGaps(t *testing.T) {
+	testCases := []struct {
+		fill   string
+		in     []string
+		out    []string
+		filled []int
+	}{
+		{"", []string{"-", "1", "-", "3"}, []string{"-", "1", "-", "3"}, []int{}},
+		{FillZero, []string{"-", "1", "-", "3"}, []string{"0", "1", "0", "3"}, []int{0, 2}},
+		{FillPrevious, []string{"-", "1", "-", "-", "3", "-"}, []string{"-", "1", "1", "1", "3", "3"}, []int{2, 3, 5}},
+		{FillLinear, []string{"-", "1", "-", "-", "4", "-"}, []string{"-", "1", "2", "3", "4", "-"}, []int{2, 3}},
+		{FillLinear, []string{"1", "-", "x"}, []string{"1", "-", "x"}, []int{}},
+	}
+
+	for i, tc := range testCases {
+		row := append([]string{}, tc.in...)
+		filled := fillGaps(row, tc.fill)
+		if !reflect.DeepEqual(tc.out, row) || !reflect.DeepEqual(tc.filled, filled) {
+			t.Error(i, ":", "want", tc.out, tc.filled, "got", row, filled)
+		}
+	}
+}
+
+func TestSourceTables(t *testing.T) {
+	testCases := []struct {
+		query  string
+		tables []string
+		labels []string
+	}{
+		{`{"type": "select_column", "table": "HTHT.hotel", "column": "adr"}`, []string{"HTHT.hotel"}, nil},
+		{`{"type": "derived", "expression": "A"}`, nil, nil},
+		{
+			`{"type": "compare", "tables": ["HTHT.hotel", "HTHT.hotel_east"], "function": "avg(adr)"}`,
+			[]string{"HTHT.hotel", "HTHT.hotel_east"}, []string{"HTHT.hotel", "HTHT.hotel_east"},
+		},
+		{
+			`{"type": "compare", "table": "hotel", "datasets": ["HTHT", "JJ"], "function": "avg(adr)"}`,
+			[]string{"HTHT.hotel", "JJ.hotel"}, []string{"HTHT", "JJ"},
+		},
+		{
+			`{"type": "compare", "tables": ["HTHT.a", "HTHT.b"], "labels": ["A", "B"], "function": "sum(n)"}`,
+			[]string{"HTHT.a", "HTHT.b"}, []string{"A", "B"},
+		},
+	}
+
+	for i, tc := range testCases {
+		query, _ := DecodeQuery([]byte(tc.query))
+		if err := query.Validate(); err != nil {
+			t.Error(i, ":", err)
+		}
+		if tables := query.SourceTables(); !reflect.DeepEqual(tc.tables, tables) {
+			t.Error(i, ":", "want", tc.tables, "got", tables)
+		}
+		if query.Type != "compare" {
+			continue
+		}
+		if labels := query.compareLabels(); !reflect.DeepEqual(tc.labels, labels) {
+			t.Error(i, ":", "want", tc.labels, "got", labels)
+		}
+	}
+}
+
+func TestValidateCompare(t *testing.T) {
+	testCases := []struct {
+		query string
+		errs  ValidationErrors
+	}{
+		{
+			`{"type": "compare", "function": "avg(adr)"}`,
+			ValidationErrors{{"$.tables", "are required by compare query"}},
+		},
+		{
+			`{"type": "compare", "datasets": ["HTHT", "JJ.x"], "function": "avg(adr)", "fill": "mean"}`,
+			ValidationErrors{
+				{"$.table", "is required with datasets"},
+				{"$.datasets[1]", "must be a dataset name"},
+				{"$.fill", `must be "zero", "previous" or "linear"`},
+			},
+		},
+		{
+			`{"type": "compare", "tables": ["HTHT.a", "HTHT.a"], "labels": ["A"], "function": "avg(adr)"}`,
+			ValidationErrors{
+				{"$", "compares table HTHT.a twice"},
+				{"$.labels", "must name each of the 2 tables"},
+			},
+		},
+	}
+
+	for i, tc := range testCases {
+		query, _ := DecodeQuery([]byte(tc.query))
+		if err := query.Validate(); !reflect.DeepEqual(tc.errs, err) {
+			t.Error(i, ":", "want", tc.errs, "got", err)
+		}
+	}
+}
+
+func TestCalendarOfTables(t *testing.T) {
+	versionsMu.Lock()
+	for dataset, start := range map[string]int{"FY_APR1": 4, "FY_APR2": 4, "FY_JAN": 0} {
+		calendars[dataset] = datasetCalendar{timing.NewCalendar(start), time.Now()}
+	}
+	versionsMu.Unlock()
+	defer func() {
+		versionsMu.Lock()
+		delete(calendars, "FY_APR1")
+		delete(calendars, "FY_APR2")
+		delete(calendars, "FY_JAN")
+		versionsMu.Unlock()
+	}()
+
+	testCases := []struct {
+		query string
+		cal   timing.Calendar
+		errs  error
+	}{
+		{
+			`{"type": "compare", "datasets": ["FY_APR1", "FY_APR2"], "table": "hotel", "function": "avg(adr)"}`,
+			timing.NewCalendar(4), nil,
+		},
+		{
+			`{"type": "compare", "datasets": ["FY_APR1", "FY_JAN"], "table": "hotel", "function": "avg(adr)"}`,
+			timing.NewCalendar(4),
+			ValidationErrors{{"$.datasets", "must start their fiscal years in the same month, FY_APR1 and FY_JAN do not"}},
+		},
+		{
+			`{"type": "compare", "tables": ["FY_JAN.hotel", "FY_APR2.inn"], "function": "avg(adr)"}`,
+			timing.NewCalendar(0),
+			ValidationErrors{{"$.tables", "must start their fiscal years in the same month, FY_JAN and FY_APR2 do not"}},
+		},
+	}
+
+	for i, tc := range testCases {
+		query, _ := DecodeQuery([]byte(tc.query))
+		cal, err := calendarOfTables(query, query.SourceTables(), nil)
+		if cal != tc.cal || !reflect.DeepEqual(tc.errs, err) {
+			t.Error(i, ":", "want", tc.cal, tc.errs, "got", cal, err)
+		}
+	}
+}
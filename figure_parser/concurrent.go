@@ -0,0 +1,121 @@
+package figure_parser
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultConcurrency is the number of queries or figures, and of their
+// statements, run at the same time
+const DefaultConcurrency = 4
+
+var concurrency = DefaultConcurrency
+
+// SetConcurrency sets how many jobs RunConcurrently runs and how many
+// statements a request runs at the same time
+func SetConcurrency(n int) {
+	if n > 0 {
+		concurrency = n
+	}
+}
+
+// statementSlotsKey is the context key of the statement slots of a request
+type statementSlotsKey struct{}
+
+// withStatementSlots bounds the statements run under ctx to concurrency at a
+// time, unless an outer call did already
+func withStatementSlots(ctx context.Context) context.Context {
+	if ctx.Value(statementSlotsKey{}) != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, statementSlotsKey{}, make(chan struct{}, concurrency))
+}
+
+// acquireStatement waits for a statement slot of ctx and returns the func
+// giving it back. Without slots statements run right away.
+func acquireStatement(ctx context.Context) (release func(), err error) {
+	slots, _ := ctx.Value(statementSlotsKey{}).(chan struct{})
+	if slots == nil {
+		return func() {}, nil
+	}
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// RunConcurrently calls fn with 0 to n-1 on a bounded pool of goroutines.
+// When fn fails or ctx is done the jobs not yet started are dropped and the
+// context passed to running jobs is cancelled. It returns the first error,
+// or the error of ctx.
+//
+// Calls nest, e.g. figures running their queries concurrently, so jobs only
+// bound the goroutines. The statements of all nested calls share the slots of
+// the outermost one and never exceed the concurrency together.
+func RunConcurrently(ctx context.Context, n int, fn func(ctx context.Context, i int) error) error {
+	ctx, cancel := context.WithCancel(withStatementSlots(ctx))
+	defer cancel()
+
+	var once sync.Once
+	var firstErr error
+	fail := func(err error) {
+		once.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+
+	workers := concurrency
+	if n < workers {
+		workers = n
+	}
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				if ctx.Err() != nil {
+					continue
+				}
+				if err := runJob(ctx, i, fn); err != nil {
+					fail(err)
+				}
+			}
+		}()
+	}
+
+dispatch:
+	for i := 0; i < n; i++ {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break dispatch
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
+
+// runJob turns a panic of a job into an error, as it can not be recovered
+// by the caller of RunConcurrently
+func runJob(ctx context.Context, i int, fn func(ctx context.Context, i int) error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			logrus.Errorf("job %d panic: %v", i, r)
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	return fn(ctx, i)
+}
@@ -0,0 +1,102 @@
+package figure_parser
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRunConcurrently(t *testing.T) {
+	results := make([]int, 10)
+	err := RunConcurrently(context.Background(), len(results), func(ctx context.Context, i int) error {
+		results[i] = i * i
+		return nil
+	})
+	if err != nil {
+		t.Error("got", err)
+	}
+	for i, r := range results {
+		if r != i*i {
+			t.Error(i, ":", "want", i*i, "got", r)
+		}
+	}
+
+	var running, maxRunning int32
+	fail := errors.New("fail")
+	err = RunConcurrently(context.Background(), 100, func(ctx context.Context, i int) error {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			m := atomic.LoadInt32(&maxRunning)
+			if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+				break
+			}
+		}
+		if i == 5 {
+			return fail
+		}
+		return nil
+	})
+	if err != fail {
+		t.Error("want", fail, "got", err)
+	}
+	if maxRunning > DefaultConcurrency {
+		t.Error("want at most", DefaultConcurrency, "got", maxRunning)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var calls int32
+	err = RunConcurrently(ctx, 10, func(ctx context.Context, i int) error {
+		atomic.AddInt32(&calls, 1)
+		return nil
+	})
+	if err != context.Canceled || calls != 0 {
+		t.Error("want", context.Canceled, 0, "got", err, calls)
+	}
+
+	err = RunConcurrently(context.Background(), 1, func(ctx context.Context, i int) error {
+		panic("boom")
+	})
+	if err == nil || err.Error() != "boom" {
+		t.Error("want", "boom", "got", err)
+	}
+}
+
+func TestStatementSlotsNested(t *testing.T) {
+	var running, maxRunning int32
+	err := RunConcurrently(context.Background(), concurrency, func(ctx context.Context, i int) error {
+		return RunConcurrently(ctx, concurrency, func(ctx context.Context, j int) error {
+			release, err := acquireStatement(ctx)
+			if err != nil {
+				return err
+			}
+			defer release()
+			n := atomic.AddInt32(&running, 1)
+			defer atomic.AddInt32(&running, -1)
+			for {
+				m := atomic.LoadInt32(&maxRunning)
+				if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			return nil
+		})
+	})
+	if err != nil {
+		t.Error("got", err)
+	}
+	if maxRunning > int32(concurrency) {
+		t.Error("want at most", concurrency, "statements got", maxRunning)
+	}
+
+	// without RunConcurrently statements are not held back
+	release, err := acquireStatement(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+}
@@ -0,0 +1,269 @@
+package figure_parser
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/bluecover/lm/models"
+	"github.com/jinzhu/gorm"
+)
+
+type (
+	traceKey      struct{}
+	traceNameKey  struct{}
+	queryTraceKey struct{}
+)
+
+// Trace records what the queries of a figure did: their SQL, the arguments
+// they ran with, the rows they read, how long they took and which periods
+// missing from the rows were filled. Results are read from the database,
+// not from the cache, while tracing.
+type Trace struct {
+	mu      sync.Mutex
+	queries []*QueryTrace
+}
+
+// QueryTrace is the trace of one query. Query is its tag prefix, "#query"
+// or "#query.A".
+type QueryTrace struct {
+	Query      string           `json:"query"`
+	Type       string           `json:"type"`
+	Table      string           `json:"table,omitempty"`
+	Args       TraceArgs        `json:"args"`
+	Statements []StatementTrace `json:"statements"`
+	Rows       int              `json:"rows"`
+	Millis     float64          `json:"ms"`
+	Gaps       []GapTrace       `json:"gaps,omitempty"`
+	Error      string           `json:"error,omitempty"`
+
+	trace *Trace
+	start time.Time
+}
+
+// TraceArgs are the ParseArgs a query ran with, once its period and date
+// range are resolved against its table
+type TraceArgs struct {
+	Start   string   `json:"start"`
+	End     string   `json:"end"`
+	Period  string   `json:"period"`
+	Filters []Filter `json:"filters"`
+	Locale  string   `json:"locale,omitempty"`
+}
+
+// StatementTrace is one SQL statement run by a query
+type StatementTrace struct {
+	SQL    string        `json:"sql"`
+	Args   []interface{} `json:"args"`
+	Rows   int           `json:"rows"`
+	Millis float64       `json:"ms"`
+	Error  string        `json:"error,omitempty"`
+}
+
+// GapTrace lists the periods of a series which had no row and the value
+// they were filled with, "-" if they were left empty
+type GapTrace struct {
+	Series string   `json:"series,omitempty"`
+	Fill   string   `json:"fill"`
+	Dates  []string `json:"dates"`
+}
+
+// WithTrace returns a context tracing the queries parsed with it into the
+// returned Trace
+func WithTrace(ctx context.Context) (context.Context, *Trace) {
+	t := &Trace{}
+	return context.WithValue(ctx, traceKey{}, t), t
+}
+
+// MarshalJSON implements json.Marshaler
+func (t *Trace) MarshalJSON() ([]byte, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	queries := make([]*QueryTrace, len(t.queries))
+	copy(queries, t.queries)
+	return json.Marshal(map[string]interface{}{"queries": queries})
+}
+
+// withTraceName names the query traced with ctx by its tag prefix
+func withTraceName(ctx context.Context, name string) context.Context {
+	if ctx.Value(traceKey{}) == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, traceNameKey{}, name)
+}
+
+// traceQuery starts the trace of a query if ctx is traced. The statements
+// run with the returned context are recorded into it.
+func traceQuery(ctx context.Context, query QuerySpec) (context.Context, *QueryTrace) {
+	t, ok := ctx.Value(traceKey{}).(*Trace)
+	if !ok {
+		return ctx, nil
+	}
+	name, _ := ctx.Value(traceNameKey{}).(string)
+	qt := &QueryTrace{
+		Query:      name,
+		Type:       query.Type,
+		Table:      query.Table,
+		Statements: make([]StatementTrace, 0),
+		trace:      t,
+		start:      time.Now(),
+	}
+	t.mu.Lock()
+	t.queries = append(t.queries, qt)
+	t.mu.Unlock()
+	return context.WithValue(ctx, queryTraceKey{}, qt), qt
+}
+
+func queryTraceFrom(ctx context.Context) *QueryTrace {
+	qt, _ := ctx.Value(queryTraceKey{}).(*QueryTrace)
+	return qt
+}
+
+// setArgs records the resolved args of a traced query
+func (qt *QueryTrace) setArgs(args ParseArgs) {
+	if qt == nil {
+		return
+	}
+	qt.trace.mu.Lock()
+	defer qt.trace.mu.Unlock()
+	qt.Args = TraceArgs{
+		Start:   args.Start.Format(ResultTimeFormat),
+		End:     args.End.Format(ResultTimeFormat),
+		Period:  args.Period,
+		Filters: args.Filters,
+		Locale:  args.Locale,
+	}
+}
+
+// finish records the time taken by a traced query and its error
+func (qt *QueryTrace) finish(err error) {
+	if qt == nil {
+		return
+	}
+	qt.trace.mu.Lock()
+	defer qt.trace.mu.Unlock()
+	qt.Millis = millis(time.Since(qt.start))
+	if err != nil {
+		qt.Error = err.Error()
+	}
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d.Nanoseconds()/1e3) / 1e3
+}
+
+// traceGaps records the periods of a series at indexes which were filled
+// with fill
+func traceGaps(ctx context.Context, series string, fill string, periodRange []string, indexes []int) {
+	qt := queryTraceFrom(ctx)
+	if qt == nil || len(indexes) == 0 {
+		return
+	}
+	dates := make([]string, 0, len(indexes))
+	for _, i := range indexes {
+		if i < len(periodRange) {
+			dates = append(dates, periodRange[i])
+		}
+	}
+	qt.trace.mu.Lock()
+	defer qt.trace.mu.Unlock()
+	qt.Gaps = append(qt.Gaps, GapTrace{Series: series, Fill: fill, Dates: dates})
+}
+
+// gapIndexes returns the indexes of the "-" of a series
+func gapIndexes(row []string) []int {
+	indexes := make([]int, 0)
+	for i, s := range row {
+		if s == "-" {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes
+}
+
+// tracedRows counts the rows read of a statement and records the statement
+// into the trace of its query when closed
+type tracedRows struct {
+	*sql.Rows
+	qt        *QueryTrace
+	statement StatementTrace
+	start     time.Time
+	closed    bool
+	release   func()
+}
+
+// queryRows runs a statement like models.RawRows in a statement slot of ctx,
+// recording it into the query traced with ctx, if any. The slot is given
+// back when the rows are closed.
+func queryRows(ctx context.Context, db *gorm.DB, statement string, args ...interface{}) (*tracedRows, error) {
+	release, err := acquireStatement(ctx)
+	if err != nil {
+		return nil, err
+	}
+	qt := queryTraceFrom(ctx)
+	start := time.Now()
+	rows, err := models.RawRows(ctx, db, statement, args...)
+	r := &tracedRows{
+		Rows:      rows,
+		qt:        qt,
+		statement: StatementTrace{SQL: statement, Args: args},
+		start:     start,
+		release:   release,
+	}
+	if err != nil {
+		release()
+		r.statement.Error = err.Error()
+		r.record()
+		return nil, err
+	}
+	return r, nil
+}
+
+// rawScan runs a statement like models.RawScan in a statement slot of ctx
+func rawScan(ctx context.Context, db *gorm.DB, statement string, args []interface{}, dest ...interface{}) error {
+	release, err := acquireStatement(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return models.RawScan(ctx, db, statement, args, dest...)
+}
+
+// Next implements sql.Rows.Next
+func (r *tracedRows) Next() bool {
+	if !r.Rows.Next() {
+		return false
+	}
+	r.statement.Rows++
+	return true
+}
+
+// Close implements sql.Rows.Close
+func (r *tracedRows) Close() error {
+	err := r.Rows.Close()
+	if !r.closed {
+		r.closed = true
+		r.release()
+		if err := r.Rows.Err(); err != nil {
+			r.statement.Error = err.Error()
+		}
+		r.record()
+	}
+	return err
+}
+
+func (r *tracedRows) record() {
+	if r.qt == nil {
+		return
+	}
+	r.statement.Millis = millis(time.Since(r.start))
+	if r.statement.Args == nil {
+		r.statement.Args = make([]interface{}, 0)
+	}
+	r.qt.trace.mu.Lock()
+	defer r.qt.trace.mu.Unlock()
+	r.qt.Statements = append(r.qt.Statements, r.statement)
+	r.qt.Rows += r.statement.Rows
+}
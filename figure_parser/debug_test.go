@@ -0,0 +1,69 @@
+package figure_parser
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTrace(t *testing.T) {
+	ctx, trace := WithTrace(context.Background())
+
+	qctx, qt := traceQuery(withTraceName(ctx, "#query.A"), QuerySpec{Type: "select_column", Table: "HTHT.hotel"})
+	qt.setArgs(ParseArgs{
+		Start:  time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC),
+		End:    time.Date(2018, 3, 31, 0, 0, 0, 0, time.UTC),
+		Period: PeriodMonth,
+	})
+	periodRange := []string{"2018/01", "2018/02", "2018/03"}
+	traceGaps(qctx, "", "-", periodRange, []int{1})
+	traceGaps(qctx, "", "0", periodRange, nil)
+	qt.finish(nil)
+
+	_, qt = traceQuery(withTraceName(ctx, "#query.B"), QuerySpec{Type: "xox"})
+	qt.finish(errors.New("boom"))
+
+	b, err := json.Marshal(trace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out struct {
+		Queries []map[string]interface{}
+	}
+	json.Unmarshal(b, &out)
+	if len(out.Queries) != 2 {
+		t.Fatal("want 2 queries got", string(b))
+	}
+
+	a := out.Queries[0]
+	want := map[string]interface{}{
+		"query": "#query.A",
+		"type":  "select_column",
+		"table": "HTHT.hotel",
+		"args":  map[string]interface{}{"start": "2018/01/01", "end": "2018/03/31", "period": "month", "filters": nil},
+		"gaps":  []interface{}{map[string]interface{}{"fill": "-", "dates": []interface{}{"2018/02"}}},
+	}
+	for k, v := range want {
+		if !reflect.DeepEqual(v, a[k]) {
+			t.Error(k, ":", "want", v, "got", a[k])
+		}
+	}
+	if out.Queries[1]["error"] != "boom" {
+		t.Error("want", "boom", "got", out.Queries[1]["error"])
+	}
+}
+
+func TestTraceOff(t *testing.T) {
+	ctx := withTraceName(context.Background(), "#query")
+	ctx, qt := traceQuery(ctx, QuerySpec{Type: "element"})
+	if qt != nil || queryTraceFrom(ctx) != nil {
+		t.Error("want no trace got", qt)
+	}
+	// untraced queries record nothing
+	qt.setArgs(ParseArgs{})
+	qt.finish(nil)
+	traceGaps(ctx, "", "-", []string{"2018/01"}, []int{0})
+}
@@ -0,0 +1,390 @@
+package figure_parser
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+// derivedParser computes an arithmetic expression over the results of the
+// sibling queries in the same "#query", e.g. {"type": "derived", "expression": "A/B*100"}.
+// Identifiers refer to the "data" of a sibling query, or to another field of
+// its result with "A.change". Series are computed element-wise on their dates.
+type derivedParser struct{}
+
+// Parse implement QueryParser.Parse
+func (derivedParser) Parse(ctx context.Context, query QuerySpec, args ParseArgs,
+	db *gorm.DB) (map[string]interface{}, error) {
+	return nil, fmt.Errorf("derived query must be in a set of named queries")
+}
+
+// exprNode is a node of a parsed arithmetic expression
+type exprNode struct {
+	op    byte // 0 for leaf
+	num   float64
+	ref   string // sibling query reference if not empty
+	left  *exprNode
+	right *exprNode
+}
+
+type exprParser struct {
+	src    string
+	tokens []string
+	pos    int
+}
+
+// parseArithmetic parses expressions of numbers, query references,
+// + - * / and parentheses.
+func parseArithmetic(src string) (*exprNode, error) {
+	tokens, err := tokenizeArithmetic(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{src: src, tokens: tokens}
+	n, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q in expression %q", p.tokens[p.pos], src)
+	}
+	return n, nil
+}
+
+func tokenizeArithmetic(src string) ([]string, error) {
+	tokens := make([]string, 0)
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case strings.IndexByte("+-*/()", c) >= 0:
+			tokens = append(tokens, string(c))
+			i++
+		case c == '.' || c >= '0' && c <= '9':
+			j := i
+			for j < len(src) && (src[j] == '.' || src[j] >= '0' && src[j] <= '9') {
+				j++
+			}
+			tokens = append(tokens, src[i:j])
+			i = j
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			j := i
+			for j < len(src) && (src[j] == '_' || src[j] == '.' ||
+				src[j] >= 'a' && src[j] <= 'z' || src[j] >= 'A' && src[j] <= 'Z' || src[j] >= '0' && src[j] <= '9') {
+				j++
+			}
+			tokens = append(tokens, src[i:j])
+			i = j
+		default:
+			return nil, fmt.Errorf("invalid character %q in expression %q", c, src)
+		}
+	}
+	return tokens, nil
+}
+
+func (p *exprParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *exprParser) parseSum() (*exprNode, error) {
+	left, err := p.parseProduct()
+	if err != nil {
+		return nil, err
+	}
+	for t := p.peek(); t == "+" || t == "-"; t = p.peek() {
+		p.pos++
+		right, err := p.parseProduct()
+		if err != nil {
+			return nil, err
+		}
+		left = &exprNode{op: t[0], left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseProduct() (*exprNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for t := p.peek(); t == "*" || t == "/"; t = p.peek() {
+		p.pos++
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &exprNode{op: t[0], left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseUnary() (*exprNode, error) {
+	if p.peek() == "-" {
+		p.pos++
+		n, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &exprNode{op: '-', left: &exprNode{}, right: n}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (*exprNode, error) {
+	t := p.peek()
+	p.pos++
+	switch {
+	case t == "":
+		return nil, fmt.Errorf("unexpected end of expression %q", p.src)
+	case t == "(":
+		n, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, fmt.Errorf("missing ) in expression %q", p.src)
+		}
+		p.pos++
+		return n, nil
+	case t[0] == '.' || t[0] >= '0' && t[0] <= '9':
+		f, err := strconv.ParseFloat(t, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q in expression %q", t, p.src)
+		}
+		return &exprNode{num: f}, nil
+	case strings.IndexByte("+-*/)", t[0]) >= 0:
+		return nil, fmt.Errorf("unexpected %q in expression %q", t, p.src)
+	default:
+		return &exprNode{ref: t}, nil
+	}
+}
+
+// refs returns the query names the expression refers to
+func (n *exprNode) refs() []string {
+	if n == nil {
+		return nil
+	}
+	if len(n.ref) > 0 {
+		return []string{strings.SplitN(n.ref, ".", 2)[0]}
+	}
+	return append(n.left.refs(), n.right.refs()...)
+}
+
+// derivedValue is a scalar, or a series when dates is not nil
+type derivedValue struct {
+	dates  []string
+	values []float64
+}
+
+func (v derivedValue) isSeries() bool {
+	return v.dates != nil
+}
+
+func (v derivedValue) at(i int, dateIndex map[string]int, dates []string) float64 {
+	if !v.isSeries() {
+		return v.values[0]
+	}
+	if j, ok := dateIndex[dates[i]]; ok {
+		return v.values[j]
+	}
+	return math.NaN()
+}
+
+func parseResultNumber(v interface{}) float64 {
+	switch n := v.(type) {
+	case float64:
+		return n
+	case int:
+		return float64(n)
+	case string:
+		n = strings.Replace(strings.TrimSuffix(strings.TrimSpace(n), "%"), ",", "", -1)
+		f, err := strconv.ParseFloat(n, 64)
+		if err != nil {
+			return math.NaN()
+		}
+		return f
+	}
+	return math.NaN()
+}
+
+// derivedOperand converts the result of a sibling query to a derivedValue
+func derivedOperand(ref string, results map[string]interface{}) (derivedValue, error) {
+	keys := strings.SplitN(ref, ".", 2)
+	result, ok := results[keys[0]].(map[string]interface{})
+	if !ok {
+		return derivedValue{}, fmt.Errorf("unknown query %s in expression", keys[0])
+	}
+	field := "data"
+	if len(keys) == 2 {
+		field = keys[1]
+	}
+
+	switch data := result[field].(type) {
+	case []string:
+		dates, _ := result["date_range"].([]string)
+		if len(dates) != len(data) {
+			return derivedValue{}, fmt.Errorf("%s is not a date aligned series", ref)
+		}
+		v := derivedValue{dates: dates, values: make([]float64, len(data))}
+		for i, d := range data {
+			v.values[i] = parseResultNumber(d)
+		}
+		return v, nil
+	case [][]string:
+		dates, _ := result["date_range"].([]string)
+		if len(data) != 1 || len(dates) != len(data[0]) {
+			return derivedValue{}, fmt.Errorf("%s has more than one series", ref)
+		}
+		v := derivedValue{dates: dates, values: make([]float64, len(dates))}
+		for i, d := range data[0] {
+			v.values[i] = parseResultNumber(d)
+		}
+		return v, nil
+	default:
+		return derivedValue{values: []float64{parseResultNumber(data)}}, nil
+	}
+}
+
+func applyArithmetic(op byte, a, b float64) float64 {
+	switch op {
+	case '+':
+		return a + b
+	case '-':
+		return a - b
+	case '*':
+		return a * b
+	case '/':
+		if b == 0 {
+			return math.NaN()
+		}
+		return a / b
+	}
+	return math.NaN()
+}
+
+func (n *exprNode) eval(results map[string]interface{}) (derivedValue, error) {
+	if n.op == 0 {
+		if len(n.ref) > 0 {
+			return derivedOperand(n.ref, results)
+		}
+		return derivedValue{values: []float64{n.num}}, nil
+	}
+
+	left, err := n.left.eval(results)
+	if err != nil {
+		return derivedValue{}, err
+	}
+	right, err := n.right.eval(results)
+	if err != nil {
+		return derivedValue{}, err
+	}
+
+	if !left.isSeries() && !right.isSeries() {
+		return derivedValue{values: []float64{applyArithmetic(n.op, left.values[0], right.values[0])}}, nil
+	}
+
+	// the result is aligned on the dates of the first series operand
+	dates := left.dates
+	if !left.isSeries() {
+		dates = right.dates
+	}
+	leftIndex, rightIndex := dateIndex(left.dates), dateIndex(right.dates)
+	v := derivedValue{dates: dates, values: make([]float64, len(dates))}
+	for i := range dates {
+		v.values[i] = applyArithmetic(n.op, left.at(i, leftIndex, dates), right.at(i, rightIndex, dates))
+	}
+	return v, nil
+}
+
+func dateIndex(dates []string) map[string]int {
+	index := make(map[string]int, len(dates))
+	for i, d := range dates {
+		index[d] = i
+	}
+	return index
+}
+
+func formatDerived(f float64) string {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return "-"
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// evalDerived evaluates a derived query against the results of its siblings
+func evalDerived(query QuerySpec, results map[string]interface{}) (map[string]interface{}, error) {
+	n, err := parseArithmetic(query.Expression)
+	if err != nil {
+		return nil, err
+	}
+	v, err := n.eval(results)
+	if err != nil {
+		return nil, err
+	}
+
+	if !v.isSeries() {
+		if math.IsNaN(v.values[0]) || math.IsInf(v.values[0], 0) {
+			return map[string]interface{}{"data": nil}, nil
+		}
+		return map[string]interface{}{"data": formatDerived(v.values[0])}, nil
+	}
+
+	data := make([]string, len(v.values))
+	for i, f := range v.values {
+		data[i] = formatDerived(f)
+	}
+	var resultData interface{} = data
+	if query.RaiseDimension {
+		resultData = [][]string{data}
+	}
+	return map[string]interface{}{
+		"date_range": v.dates,
+		"data":       resultData,
+	}, nil
+}
+
+// derivedOrder sorts the derived queries of a set so every query comes
+// after the derived queries it refers to.
+func derivedOrder(queries map[string]QuerySpec) ([]string, error) {
+	order := make([]string, 0)
+	state := make(map[string]int) // 1 visiting, 2 done
+
+	var visit func(name string) error
+	visit = func(name string) error {
+		q, ok := queries[name]
+		if !ok || q.Type != "derived" || state[name] == 2 {
+			return nil
+		}
+		if state[name] == 1 {
+			return fmt.Errorf("derived query %s refers to itself", name)
+		}
+		state[name] = 1
+		n, err := parseArithmetic(q.Expression)
+		if err != nil {
+			return err
+		}
+		for _, ref := range n.refs() {
+			if err := visit(ref); err != nil {
+				return err
+			}
+		}
+		state[name] = 2
+		order = append(order, name)
+		return nil
+	}
+
+	for _, name := range (QuerySet{Named: queries}).Names() {
+		if err := visit(name); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
@@ -0,0 +1,88 @@
+package figure_parser
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEvalDerived(t *testing.T) {
+	results := map[string]interface{}{
+		"A": map[string]interface{}{"data": "200"},
+		"B": map[string]interface{}{"data": "50"},
+		"C": map[string]interface{}{
+			"date_range": []string{"2018/01", "2018/02", "2018/03"},
+			"data":       []string{"10", "-", "30"},
+		},
+		"D": map[string]interface{}{
+			"date_range": []string{"2018/02", "2018/03"},
+			"data":       [][]string{{"4", "0"}},
+		},
+		"X": map[string]interface{}{"change": "12.50%", "data": nil},
+	}
+
+	testCases := []struct {
+		expr string
+		out  map[string]interface{}
+	}{
+		{"A/B*100", map[string]interface{}{"data": "400"}},
+		{"(A - B) / -2", map[string]interface{}{"data": "-75"}},
+		{"A/0", map[string]interface{}{"data": nil}},
+		{"X.change * 2", map[string]interface{}{"data": "25"}},
+		{"X + 1", map[string]interface{}{"data": nil}},
+		{"C * 2 + A", map[string]interface{}{
+			"date_range": []string{"2018/01", "2018/02", "2018/03"},
+			"data":       []string{"220", "-", "260"},
+		}},
+		{"C / D", map[string]interface{}{
+			"date_range": []string{"2018/01", "2018/02", "2018/03"},
+			"data":       []string{"-", "-", "-"},
+		}},
+		{"D - C", map[string]interface{}{
+			"date_range": []string{"2018/02", "2018/03"},
+			"data":       []string{"-", "-30"},
+		}},
+	}
+
+	for i, tc := range testCases {
+		out, err := evalDerived(QuerySpec{Type: "derived", Expression: tc.expr}, results)
+		if err != nil {
+			t.Error(i, err)
+			continue
+		}
+		if !reflect.DeepEqual(tc.out, out) {
+			t.Error(i, ":", "want", tc.out, "got", out)
+		}
+	}
+}
+
+func TestValidateDerived(t *testing.T) {
+	testCases := []struct {
+		in  string
+		err string
+	}{
+		{`{"A": {"type": "element", "table": "t", "function": "sum(v)"},
+		   "B": {"type": "derived", "expression": "A * 2"},
+		   "C": {"type": "derived", "expression": "B - A"}}`, ""},
+		{`{"A": {"type": "derived", "expression": "A * 2"}}`,
+			"$.#query: derived query A refers to itself"},
+		{`{"A": {"type": "derived", "expression": "B * (2"}}`,
+			`$.#query.A.expression: missing ) in expression "B * (2"`},
+		{`{"A": {"type": "derived", "expression": "B;"}}`,
+			`$.#query.A.expression: invalid character ';' in expression "B;"`},
+		{`{"A": {"type": "derived", "expression": "B * 2"}}`,
+			`$.#query.A.expression: refers to unknown query "B"`},
+		{`{"type": "derived", "expression": "1"}`,
+			"$.#query.type: derived query must be in a set of named queries"},
+	}
+
+	for i, tc := range testCases {
+		fig, err := DecodeFigure([]byte(`{"id": "F", "type": "kvCard", "#query": ` + tc.in + `}`))
+		if err != nil {
+			t.Fatal(i, err)
+		}
+		err = fig.Validate()
+		if (err == nil && len(tc.err) > 0) || (err != nil && err.Error() != tc.err) {
+			t.Error(i, ":", "want", tc.err, "got", err)
+		}
+	}
+}
@@ -1,15 +1,14 @@
 package figure_parser
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
-	"math"
+	"sort"
 	"strconv"
-	"strings"
-	"text/template"
 	"time"
 
+	"github.com/bluecover/lm/business/timing"
 	"github.com/jinzhu/gorm"
 	"github.com/sirupsen/logrus"
 )
@@ -20,75 +19,94 @@ const (
 	templateKey    = "template"
 )
 
-var funcMap = template.FuncMap{"printNumber": PrintNumber}
-
 func matchQueryFlag(s string) bool {
 	return len(s) > 0 && s[0] == identifierFlag
 }
 
+// QueryTag is a string of a figure referring to a query result, found at
+// Path in the figure
 type QueryTag struct {
 	Container interface{}
 	Index     int
 	Key       string
 	Value     string
+	Path      string
 }
 
-func findQueryTagsInMap(container map[string]interface{}, queryTags *[]QueryTag) {
-	for name, obj := range container {
-		switch obj.(type) {
+func findQueryTagsInMap(container map[string]interface{}, path string, queryTags *[]QueryTag) {
+	names := make([]string, 0, len(container))
+	for name := range container {
+		names = append(names, name)
+	}
+	// sorted, so that unresolved tags are reported in a stable order
+	sort.Strings(names)
+	for _, name := range names {
+		switch obj := container[name].(type) {
 		case map[string]interface{}:
-			findQueryTagsInMap(obj.(map[string]interface{}), queryTags)
+			findQueryTagsInMap(obj, joinPath(path, name), queryTags)
 
 		case []interface{}:
-			findQueryTagsInSlice(obj.([]interface{}), queryTags)
+			findQueryTagsInSlice(obj, joinPath(path, name), queryTags)
 
 		case string:
-			if matchQueryFlag(obj.(string)) {
+			if matchQueryFlag(obj) {
 				*queryTags = append(*queryTags,
-					QueryTag{Container: container, Key: name, Value: obj.(string)})
+					QueryTag{Container: container, Key: name, Value: obj, Path: joinPath(path, name)})
 			}
 		}
 	}
 }
 
-func findQueryTagsInSlice(container []interface{}, queryTags *[]QueryTag) {
+func findQueryTagsInSlice(container []interface{}, path string, queryTags *[]QueryTag) {
 	for index, obj := range container {
-		switch obj.(type) {
+		switch obj := obj.(type) {
 		case map[string]interface{}:
-			findQueryTagsInMap(obj.(map[string]interface{}), queryTags)
+			findQueryTagsInMap(obj, joinPath(path, indexPath(index)), queryTags)
 
 		case []interface{}:
-			findQueryTagsInSlice(obj.([]interface{}), queryTags)
+			findQueryTagsInSlice(obj, joinPath(path, indexPath(index)), queryTags)
 
 		case string:
-			if matchQueryFlag(obj.(string)) {
+			if matchQueryFlag(obj) {
 				*queryTags = append(*queryTags,
-					QueryTag{Container: container, Index: index, Value: obj.(string)})
+					QueryTag{Container: container, Index: index, Value: obj, Path: joinPath(path, indexPath(index))})
 			}
 		}
 	}
 }
 
-func replaceQueryTags(queryTags []QueryTag, queryResults map[string]interface{}) {
+// replaceQueryTags fills the query results referred to by tags into their
+// containers, writing numbers in the format of the query they come from.
+// Tags which do not resolve take their fallback, or are returned as
+// ValidationErrors at their path.
+func replaceQueryTags(queryTags []QueryTag, queryResults map[string]interface{},
+	format func(name string) NumberFormat) error {
+
+	var errs ValidationErrors
 	for _, tag := range queryTags {
-		keys := strings.Split(tag.Value, ".")
-		switch tag.Container.(type) {
-		case map[string]interface{}:
-			container := tag.Container.(map[string]interface{})
-			if len(keys) == 2 {
-				container[tag.Key] = FormatNumber(queryResults[keys[1]])
-			} else if len(keys) == 3 {
-				container[tag.Key] = FormatNumber(queryResults[keys[1]].(map[string]interface{})[keys[2]])
+		p, err := parseQueryTag(tag.Value)
+		if err != nil {
+			errs.add(tag.Path, "malformed query tag %q: %s", tag.Value, err)
+			continue
+		}
+		value, err := p.resolve(queryResults)
+		if err != nil {
+			if !p.hasFallback {
+				errs.add(tag.Path, "query tag %q does not resolve: %s", tag.Value, err)
+				continue
 			}
+			value = p.fallback
+		} else {
+			value = format(p.name()).Format(value)
+		}
+		switch container := tag.Container.(type) {
+		case map[string]interface{}:
+			container[tag.Key] = value
 		case []interface{}:
-			container := tag.Container.([]interface{})
-			if len(keys) == 2 {
-				container[tag.Index] = FormatNumber(queryResults[keys[1]])
-			} else if len(keys) == 3 {
-				container[tag.Index] = FormatNumber(queryResults[keys[1]].(map[string]interface{})[keys[2]])
-			}
+			container[tag.Index] = value
 		}
 	}
+	return errs.orNil()
 }
 
 // ParseArgs represents common args for figure parser
@@ -96,106 +114,157 @@ type ParseArgs struct {
 	Start   time.Time
 	End     time.Time
 	Period  string
-	Filters []map[string]interface{}
+	Filters []Filter
+	// Locale is the BCP 47 locale numbers and dates are written in,
+	// DefaultLocale if empty
+	Locale string
+	// Calendar counts the quarters, half years and years of the dataset of
+	// a query, set from its first table by ParseQuery
+	Calendar timing.Calendar
 }
 
-// ParseFigureB
-func ParseFigureB(figBytes []byte, args ParseArgs, db *gorm.DB) (map[string]interface{}, error) {
-	var root map[string]interface{}
-	err := json.Unmarshal(figBytes, &root)
+// ParseFigureB decodes, validates and parses a figure definition
+func ParseFigureB(ctx context.Context, figBytes []byte, args ParseArgs, db *gorm.DB) (map[string]interface{}, error) {
+	fig, err := DecodeFigure(figBytes)
 	if err != nil {
 		return nil, err
 	}
+	return ParseFigure(ctx, fig, args, db)
+}
 
-	usingTemplate := false
-	tflag, ok := root["template"]
-	if ok {
-		b, ok := tflag.(bool)
-		if ok {
-			usingTemplate = b
+// ParseFigure runs the queries of a figure and fills their results into it.
+// Named queries run concurrently; the rest are dropped once ctx is done.
+func ParseFigure(ctx context.Context, fig *FigureSpec, args ParseArgs, db *gorm.DB) (map[string]interface{}, error) {
+	if err := fig.Validate(); err != nil {
+		return nil, err
+	}
+	ctx, cancel := withFigureBudget(ctx)
+	defer cancel()
+	result, err := parseDocument(ctx, fig, args, db)
+	return result, timeoutError(ctx, err)
+}
+
+// ParsePage validates a figure page and parses its own queries
+func ParsePage(ctx context.Context, page *PageSpec, args ParseArgs, db *gorm.DB) (map[string]interface{}, error) {
+	if err := page.Validate(); err != nil {
+		return nil, err
+	}
+	ctx, cancel := withFigureBudget(ctx)
+	defer cancel()
+	result, err := parseDocument(ctx, &FigureSpec{ID: page.ID, Raw: page.Raw, Queries: page.Queries, src: page.src}, args, db)
+	return result, timeoutError(ctx, err)
+}
+
+// runQueries runs the queries of a set and returns their results in the
+// shape query tags refer to
+func runQueries(ctx context.Context, queries *QuerySet, args ParseArgs, db *gorm.DB) (map[string]interface{}, error) {
+	if queries.Single != nil {
+		if err := ctx.Err(); err != nil {
+			return nil, err
 		}
+		return ParseQuery(withTraceName(ctx, queryKey), *queries.Single, args, db)
 	}
 
-	queries, ok := root[queryKey].(map[string]interface{})
-	if !ok {
+	names := make([]string, 0, len(queries.Named))
+	for _, name := range queries.Names() {
+		if queries.Named[name].Type != "derived" {
+			names = append(names, name)
+		}
+	}
+	results := make([]map[string]interface{}, len(names))
+	err := RunConcurrently(ctx, len(names), func(ctx context.Context, i int) error {
+		result, err := ParseQuery(withTraceName(ctx, joinPath(queryKey, names[i])), queries.Named[names[i]], args, db)
+		results[i] = result
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	queryResults := make(map[string]interface{})
+	for i, name := range names {
+		queryResults[name] = results[i]
+	}
+	derived, err := derivedOrder(queries.Named)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range derived {
+		result, err := evalDerived(queries.Named[name], queryResults)
+		if err != nil {
+			return nil, fmt.Errorf("derived query %s: %s", name, err)
+		}
+		queryResults[name] = result
+	}
+	return queryResults, nil
+}
+
+func parseDocument(ctx context.Context, fig *FigureSpec, args ParseArgs, db *gorm.DB) (map[string]interface{}, error) {
+	root, queries, usingTemplate := fig.Raw, fig.Queries, bool(fig.Template)
+
+	if queries == nil {
 		return root, nil
 	}
 	delete(root, queryKey)
 
 	queryTags := make([]QueryTag, 0)
-	findQueryTagsInMap(root, &queryTags)
+	findQueryTagsInMap(root, rootPath, &queryTags)
 	if len(queryTags) == 0 && !usingTemplate {
 		return root, nil
 	}
 
-	queryResults := make(map[string]interface{})
-	for k, q := range queries {
-		query, ok := q.(map[string]interface{})
-		if ok {
-			result, err := ParseQuery(query, args, db)
-			if err != nil {
-				return nil, err
-			}
-			queryResults[k] = result
-		}
-	}
-	if len(queryResults) == 0 {
-		queryResults, err = ParseQuery(queries, args, db)
-		if err != nil {
-			return nil, err
-		}
+	queryResults, err := runQueries(ctx, queries, args, db)
+	if err != nil {
+		return nil, err
 	}
 
-	figureType, ok := root["type"].(string)
+	transformer, ok := figureTransformer(fig.Type)
 	if ok {
-		switch figureType {
-		case "PieChart":
-			parsePieChart(queryResults)
-		case "LadderChart.Abs":
-			parseLadderChart(queryResults)
+		if err := transformer.Transform(fig, queryResults); err != nil {
+			return nil, fmt.Errorf("%s transformer: %s", fig.Type, err)
 		}
 	}
 
+	if len(args.Locale) > 0 {
+		localizeDateRanges(queryResults, args.Locale)
+	}
+
 	if usingTemplate {
-		figstr := strings.Replace(string(figBytes), `\"`, `"`, -1)
-		t := template.Must(template.New(root["id"].(string)).Funcs(funcMap).Parse(figstr))
-		var buf bytes.Buffer
-		err = t.Execute(&buf, queryResults)
-		if err != nil {
+		if err := executeTemplates(fig.templates, queryResults, args, fig.Formats); err != nil {
 			return nil, err
 		}
-		err = json.Unmarshal([]byte(buf.String()), &root)
+		delete(root, templateKey)
+	} else {
+		err := replaceQueryTags(queryTags, queryResults, func(name string) NumberFormat {
+			return args.numberFormat(fig.Formats, name)
+		})
 		if err != nil {
 			return nil, err
 		}
-		delete(root, queryKey)
-		delete(root, templateKey)
-	} else {
-		replaceQueryTags(queryTags, queryResults)
 	}
+	root[handledByKey] = handledBy(queries, transformer)
 
 	return root, nil
 }
 
-func parsePieChart(queryResult map[string]interface{}) {
+// parsePieChart turns the grouped series of a single aggregate query into
+// the share of each group
+func parsePieChart(queryResult map[string]interface{}, topN int, label string) error {
+	groupValues, ok := queryResult["group_values"].([]string)
+	if !ok {
+		return errors.New("PieChart needs a single unnamed aggregate query with group_by")
+	}
+	data, ok := queryResult["data"].([][]string)
+	if !ok || len(data) != len(groupValues) {
+		return errors.New("PieChart needs one series of data per group value")
+	}
 	result := make(map[string]string)
-	groupValues := queryResult["group_values"].([]string)
-	data := queryResult["data"].([][]string)
+	groupValues, data = foldTopN(groupValues, data, topN, label)
 	sums := make(map[string]float64)
 	total := 0.0
 	for k, v := range groupValues {
-		vsum := 0.0
-		for _, d := range data[k] {
-			f, e := strconv.ParseFloat(d, 64)
-			if e != nil {
-				continue
-			}
-			if math.IsNaN(f) {
-				f = 0.0
-			}
-			vsum += f
-			total += f
-		}
+		vsum := sumSeries(data[k])
+		total += vsum
 		sums[v] = vsum
 	}
 
@@ -203,6 +272,7 @@ func parsePieChart(queryResult map[string]interface{}) {
 		result[k] = fmt.Sprintf("%.2f", v/total*100)
 	}
 	queryResult["data"] = result
+	return nil
 }
 
 func parseLadderChart(queryResult map[string]interface{}) {
@@ -0,0 +1,167 @@
+package figure_parser
+
+import (
+	"fmt"
+	"strings"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/bluecover/lm/models"
+	"github.com/bluecover/lm/util"
+)
+
+// Filter operators
+const (
+	FilterIn       = "in"
+	FilterNotIn    = "not_in"
+	FilterBetween  = "between"
+	FilterGt       = "gt"
+	FilterGte      = "gte"
+	FilterLt       = "lt"
+	FilterLte      = "lte"
+	FilterPrefix   = "prefix"
+	FilterContains = "contains"
+	FilterIsNull   = "is_null"
+	FilterNotNull  = "not_null"
+)
+
+// filterArity is the number of values each operator takes, -1 for any
+var filterArity = map[string]int{
+	FilterIn:       -1,
+	FilterNotIn:    -1,
+	FilterBetween:  2,
+	FilterGt:       1,
+	FilterGte:      1,
+	FilterLt:       1,
+	FilterLte:      1,
+	FilterPrefix:   1,
+	FilterContains: 1,
+	FilterIsNull:   0,
+	FilterNotNull:  0,
+}
+
+// Filter restricts the rows of a table by one column. It is given in the
+// "filters" request parameter or in "filters" of a query, e.g.
+// {"key": "city", "values": ["Shanghai", "Beijing"]},
+// {"key": "age", "op": "between", "values": [18, 30]} or
+// {"key": "closed_at", "op": "is_null"}.
+// Op is "in" by default; "in" and "not_in" without values are ignored.
+type Filter struct {
+	Key    string
+	Op     string
+	Values []interface{}
+
+	errs ValidationErrors
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (f *Filter) UnmarshalJSON(b []byte) error {
+	d := newFieldDecoder(b)
+	d.decode("key", &f.Key)
+	d.decode("op", &f.Op)
+	d.decode("values", &f.Values)
+	f.errs = d.errs
+	if len(f.Op) == 0 {
+		f.Op = FilterIn
+	}
+	return nil
+}
+
+// ValidateFilters returns all problems of filters as ValidationErrors
+func ValidateFilters(filters []Filter) error {
+	var errs ValidationErrors
+	for i, f := range filters {
+		f.validate(indexPath(i), &errs)
+	}
+	return errs.orNil()
+}
+
+func (f Filter) validate(path string, errs *ValidationErrors) {
+	errs.merge(path, f.errs)
+	if len(f.Key) == 0 {
+		errs.add(joinPath(path, "key"), "is required")
+	}
+	n, ok := filterArity[f.Op]
+	if !ok {
+		errs.add(joinPath(path, "op"), "unknown filter operator %q", f.Op)
+		return
+	}
+	if n >= 0 && len(f.Values) != n {
+		errs.add(joinPath(path, "values"), "%s filter takes %d values", f.Op, n)
+	}
+	for i, v := range f.Values {
+		switch v.(type) {
+		case string, float64, bool:
+		default:
+			errs.add(joinPath(path, "values"+indexPath(i)), "must be a string, number or boolean")
+		}
+	}
+	if f.Op == FilterPrefix || f.Op == FilterContains {
+		for i, v := range f.Values {
+			if _, ok := v.(string); !ok {
+				errs.add(joinPath(path, "values"+indexPath(i)), "must be a string")
+			}
+		}
+	}
+}
+
+// checkFilterKeys checks every filter key is a column of the table
+func checkFilterKeys(filters []Filter, table string, columns []string) error {
+	var errs ValidationErrors
+	for i, f := range filters {
+		if !util.Contains(columns, f.Key) {
+			errs.add(joinPath("filters"+indexPath(i), "key"), "column %s does not exist in table %s", f.Key, table)
+		}
+	}
+	return errs.orNil()
+}
+
+// escapeLike escapes the wildcards of a LIKE pattern
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// predicate returns the WHERE condition of a valid filter, nil if it is a no-op
+func (f Filter) predicate() sq.Sqlizer {
+	key := models.QuoteIdentifier(f.Key)
+	switch f.Op {
+	case FilterIn:
+		if len(f.Values) == 0 {
+			return nil
+		}
+		return sq.Eq{key: f.Values}
+	case FilterNotIn:
+		if len(f.Values) == 0 {
+			return nil
+		}
+		return sq.NotEq{key: f.Values}
+	case FilterBetween:
+		return sq.And{sq.GtOrEq{key: f.Values[0]}, sq.LtOrEq{key: f.Values[1]}}
+	case FilterGt:
+		return sq.Gt{key: f.Values[0]}
+	case FilterGte:
+		return sq.GtOrEq{key: f.Values[0]}
+	case FilterLt:
+		return sq.Lt{key: f.Values[0]}
+	case FilterLte:
+		return sq.LtOrEq{key: f.Values[0]}
+	case FilterPrefix:
+		return sq.Expr(key+" LIKE ?", escapeLike(fmt.Sprint(f.Values[0]))+"%")
+	case FilterContains:
+		return sq.Expr(key+" LIKE ?", "%"+escapeLike(fmt.Sprint(f.Values[0]))+"%")
+	case FilterIsNull:
+		return sq.Eq{key: nil}
+	case FilterNotNull:
+		return sq.NotEq{key: nil}
+	}
+	return nil
+}
+
+// SetFilters adds the conditions of valid filters to sb
+func SetFilters(sb sq.SelectBuilder, filters []Filter) sq.SelectBuilder {
+	for _, f := range filters {
+		if p := f.predicate(); p != nil {
+			sb = sb.Where(p)
+		}
+	}
+	return sb
+}
@@ -0,0 +1,83 @@
+package figure_parser
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	sq "github.com/Masterminds/squirrel"
+)
+
+func TestValidateFilters(t *testing.T) {
+	testCases := []struct {
+		in   string
+		errs ValidationErrors
+	}{
+		{`[{"key": "city", "values": ["a", "b"]}]`, nil},
+		{`[{"key": "age", "op": "between", "values": [18, 30]}, {"key": "x", "op": "is_null"}]`, nil},
+		{`[{"key": "age", "op": "between", "values": [18]}]`,
+			ValidationErrors{{"[0].values", "between filter takes 2 values"}}},
+		{`[{"op": "like", "values": ["a"]}]`,
+			ValidationErrors{{"[0].key", "is required"}, {"[0].op", `unknown filter operator "like"`}}},
+		{`[{"key": "name", "op": "prefix", "values": [1]}]`,
+			ValidationErrors{{"[0].values[0]", "must be a string"}}},
+		{`[{"key": "city", "values": [{"a": 1}]}]`,
+			ValidationErrors{{"[0].values[0]", "must be a string, number or boolean"}}},
+		{`[{"key": 1, "values": ["a"]}]`,
+			ValidationErrors{{"[0].key", "must be a string"}, {"[0].key", "is required"}}},
+	}
+
+	for i, tc := range testCases {
+		var filters []Filter
+		if err := json.Unmarshal([]byte(tc.in), &filters); err != nil {
+			t.Error(i, ":", err)
+			continue
+		}
+		err := ValidateFilters(filters)
+		if tc.errs == nil && err != nil || tc.errs != nil && !reflect.DeepEqual(tc.errs, err) {
+			t.Error(i, ":", "want", tc.errs, "got", err)
+		}
+	}
+}
+
+func TestSetFilters(t *testing.T) {
+	testCases := []struct {
+		filters []Filter
+		sql     string
+		args    []interface{}
+	}{
+		{[]Filter{{Key: "city", Op: FilterIn, Values: []interface{}{"a"}}},
+			`SELECT * FROM t WHERE "city" IN (?)`, []interface{}{"a"}},
+		{[]Filter{{Key: "city", Op: FilterNotIn, Values: []interface{}{"a", "b"}}},
+			`SELECT * FROM t WHERE "city" NOT IN (?,?)`, []interface{}{"a", "b"}},
+		{[]Filter{{Key: "city", Op: FilterIn}}, "SELECT * FROM t", nil},
+		{[]Filter{{Key: "age", Op: FilterBetween, Values: []interface{}{18.0, 30.0}}},
+			`SELECT * FROM t WHERE ("age" >= ? AND "age" <= ?)`, []interface{}{18.0, 30.0}},
+		{[]Filter{{Key: "age", Op: FilterGt, Values: []interface{}{18.0}}},
+			`SELECT * FROM t WHERE "age" > ?`, []interface{}{18.0}},
+		{[]Filter{{Key: "name", Op: FilterContains, Values: []interface{}{"50%_off"}}},
+			`SELECT * FROM t WHERE "name" LIKE ?`, []interface{}{`%50\%\_off%`}},
+		{[]Filter{{Key: "x", Op: FilterIsNull}, {Key: `a"b`, Op: FilterNotNull}},
+			`SELECT * FROM t WHERE "x" IS NULL AND "a""b" IS NOT NULL`, nil},
+	}
+
+	for i, tc := range testCases {
+		sql, args, err := SetFilters(sq.Select("*").From("t"), tc.filters).ToSql()
+		if err != nil {
+			t.Error(i, ":", err)
+			continue
+		}
+		if sql != tc.sql || !reflect.DeepEqual(tc.args, args) {
+			t.Error(i, ":", "want", tc.sql, tc.args, "got", sql, args)
+		}
+	}
+}
+
+func TestCheckFilterKeys(t *testing.T) {
+	filters := []Filter{{Key: "city", Op: FilterIn}, {Key: "1=1; --", Op: FilterIsNull}}
+	err := checkFilterKeys(filters, "t", []string{"date", "city"})
+	want := ValidationErrors{{"filters[1].key", "column 1=1; -- does not exist in table t"}}
+	if !reflect.DeepEqual(want, err) {
+		t.Error("want", want, "got", err)
+	}
+}
@@ -0,0 +1,313 @@
+package figure_parser
+
+import (
+	"context"
+	"math"
+	"strconv"
+
+	"github.com/gonum/floats"
+	"github.com/gonum/stat"
+	"github.com/jinzhu/gorm"
+)
+
+// Models of a forecast query
+const (
+	ForecastLinear      = "linear"
+	ForecastHoltWinters = "holt_winters"
+)
+
+// Defaults of a forecast query
+const (
+	DefaultForecastHorizon    = 6
+	DefaultForecastConfidence = 0.95
+	maxForecastHorizon        = 120
+)
+
+// defaultSmoothing are alpha (level), beta (trend) and gamma (season) of
+// Holt-Winters
+var defaultSmoothing = []float64{0.5, 0.1, 0.1}
+
+// forecastParser projects the select_column series of "column" into the
+// future, e.g.
+// {"type": "forecast", "table": "HTHT.hotel", "column": "hotel_num",
+// "model": "holt_winters", "horizon": 6}
+// "linear" fits a least squares trend. "holt_winters" smooths level, trend
+// and an additive season of "season" periods, by default 7 days, 52 weeks,
+// 12 months, 4 quarters or 2 half years; "smoothing" overrides its
+// [alpha, beta, gamma]. "date_range" is extended by the forecast periods.
+// "data" holds the history, "forecast", "upper" and "lower" the projection
+// with its "confidence" band; the projection starts at the last observed
+// period so that the lines join.
+type forecastParser struct{}
+
+// defaultSeason returns the number of periods of a season of period
+func defaultSeason(period string) int {
+	switch period {
+	case PeriodDate:
+		return 7
+	case PeriodWeek:
+		return 52
+	case PeriodMonth:
+		return 12
+	case PeriodQuarter:
+		return 4
+	case PeriodHalfYear:
+		return 2
+	default:
+		return 0
+	}
+}
+
+func (q QuerySpec) validateForecast(path string, errs *ValidationErrors) {
+	switch q.Model {
+	case "", ForecastLinear, ForecastHoltWinters:
+	default:
+		errs.add(joinPath(path, "model"), "must be %q or %q", ForecastLinear, ForecastHoltWinters)
+	}
+	if q.Horizon < 0 || q.Horizon > maxForecastHorizon {
+		errs.add(joinPath(path, "horizon"), "must be between 1 and %d", maxForecastHorizon)
+	}
+	if q.Season != nil && *q.Season < 0 {
+		errs.add(joinPath(path, "season"), "must not be negative")
+	}
+	if q.Confidence != 0 && (q.Confidence <= 0 || q.Confidence >= 1) {
+		errs.add(joinPath(path, "confidence"), "must be between 0 and 1")
+	}
+	if len(q.Smoothing) > len(defaultSmoothing) {
+		errs.add(joinPath(path, "smoothing"), "takes at most alpha, beta and gamma")
+	}
+	for i, s := range q.Smoothing {
+		if s <= 0 || s > 1 {
+			errs.add(joinPath(path, "smoothing"+indexPath(i)), "must be in (0, 1]")
+		}
+	}
+}
+
+// forecast is the projection of a series
+type forecast struct {
+	model        string
+	values       []float64
+	lower, upper []float64
+}
+
+// observed returns the values of a series up to its last value, with inner
+// gaps interpolated
+func observed(data []string) []float64 {
+	values := make([]float64, 0, len(data))
+	known := make([]bool, 0, len(data))
+	last := -1
+	for i, s := range data {
+		f, err := strconv.ParseFloat(s, 64)
+		ok := err == nil && !math.IsNaN(f)
+		values = append(values, f)
+		known = append(known, ok)
+		if ok {
+			last = i
+		}
+	}
+	values, known = values[:last+1], known[:last+1]
+
+	first := -1
+	for i := range values {
+		if !known[i] {
+			continue
+		}
+		if first < 0 {
+			// leading gaps take the first value
+			for j := 0; j < i; j++ {
+				values[j] = values[i]
+			}
+		} else if first < i-1 {
+			step := (values[i] - values[first]) / float64(i-first)
+			for j := first + 1; j < i; j++ {
+				values[j] = values[first] + step*float64(j-first)
+			}
+		}
+		first = i
+	}
+	return values
+}
+
+// zScore returns the two-sided normal quantile of a confidence
+func zScore(confidence float64) float64 {
+	return math.Sqrt2 * math.Erfinv(confidence)
+}
+
+// linearForecast fits y = alpha + beta*x and projects steps periods with a
+// prediction interval
+func linearForecast(y []float64, steps int, confidence float64) forecast {
+	n := len(y)
+	x := make([]float64, n)
+	floats.Span(x, 0, float64(n-1))
+	alpha, beta := stat.LinearRegression(x, y, nil, false)
+
+	var sse float64
+	for i := range y {
+		r := y[i] - (alpha + beta*x[i])
+		sse += r * r
+	}
+	s := 0.0
+	if n > 2 {
+		s = math.Sqrt(sse / float64(n-2))
+	}
+	xMean := stat.Mean(x, nil)
+	var sxx float64
+	for _, xi := range x {
+		sxx += (xi - xMean) * (xi - xMean)
+	}
+
+	z := zScore(confidence)
+	f := forecast{model: ForecastLinear}
+	for h := 1; h <= steps; h++ {
+		x0 := float64(n - 1 + h)
+		v := alpha + beta*x0
+		width := z * s * math.Sqrt(1+1/float64(n)+(x0-xMean)*(x0-xMean)/sxx)
+		f.values = append(f.values, v)
+		f.lower = append(f.lower, v-width)
+		f.upper = append(f.upper, v+width)
+	}
+	return f
+}
+
+// holtWintersForecast smooths level, trend and an additive season of m
+// periods and projects steps periods. The band widens with the square root
+// of the steps ahead from the deviation of the one step errors.
+func holtWintersForecast(y []float64, m int, smoothing []float64, steps int, confidence float64) forecast {
+	alpha, beta, gamma := smoothing[0], smoothing[1], smoothing[2]
+	if m < 2 || len(y) < 2*m {
+		m = 0
+	}
+
+	// level and trend start one period before the series, the season from
+	// the detrended first season
+	season := make([]float64, m)
+	var level, trend float64
+	if m > 0 {
+		first, second := stat.Mean(y[:m], nil), stat.Mean(y[m:2*m], nil)
+		trend = (second - first) / float64(m)
+		level = first - trend*float64(m+1)/2
+		for i := range season {
+			season[i] = y[i] - (first + trend*(float64(i)-float64(m-1)/2))
+		}
+	} else {
+		trend = y[1] - y[0]
+		level = y[0] - trend
+	}
+	seasonal := func(t int) float64 {
+		if m == 0 {
+			return 0
+		}
+		return season[t%m]
+	}
+
+	errs := make([]float64, 0, len(y))
+	for t, v := range y {
+		s := seasonal(t)
+		errs = append(errs, v-(level+trend+s))
+		prev := level
+		level = alpha*(v-s) + (1-alpha)*(level+trend)
+		trend = beta*(level-prev) + (1-beta)*trend
+		if m > 0 {
+			season[t%m] = gamma*(v-level) + (1-gamma)*s
+		}
+	}
+	sigma := stat.StdDev(errs, nil)
+	if math.IsNaN(sigma) {
+		sigma = 0
+	}
+
+	z := zScore(confidence)
+	f := forecast{model: ForecastHoltWinters}
+	for h := 1; h <= steps; h++ {
+		v := level + float64(h)*trend + seasonal(len(y)+h-1)
+		width := z * sigma * math.Sqrt(float64(h))
+		f.values = append(f.values, v)
+		f.lower = append(f.lower, v-width)
+		f.upper = append(f.upper, v+width)
+	}
+	return f
+}
+
+// Parse implement QueryParser.Parse
+func (p forecastParser) Parse(ctx context.Context, query QuerySpec, args ParseArgs,
+	db *gorm.DB) (map[string]interface{}, error) {
+
+	query.RaiseDimension = false
+	history, err := selectColumnParser{}.Parse(ctx, query, args, db)
+	if err != nil {
+		return nil, err
+	}
+	periodRange, _ := history["date_range"].([]string)
+	data, _ := history["data"].([]string)
+
+	horizon := query.Horizon
+	if horizon == 0 {
+		horizon = DefaultForecastHorizon
+	}
+	d := args.Calendar.BeginningOfPeriod(args.End, args.Period)
+	for i := 0; i < horizon; i++ {
+		d = args.Calendar.Forward(d, args.Period)
+		periodRange = append(periodRange, args.Calendar.FormatTime(d, args.Period))
+	}
+	result := p.result(query, args.Period, data, len(periodRange))
+	result["date_range"] = periodRange
+	return result, nil
+}
+
+// formatForecast rounds a projected value to two decimals
+func formatForecast(f float64) string {
+	return formatDerived(math.Round(f*100) / 100)
+}
+
+// result projects data to n periods
+func (p forecastParser) result(query QuerySpec, period string, data []string, n int) map[string]interface{} {
+	series := make([]string, n)
+	projection := make([]string, n)
+	lower := make([]string, n)
+	upper := make([]string, n)
+	for i := range series {
+		series[i], projection[i], lower[i], upper[i] = "-", "-", "-", "-"
+	}
+	copy(series, data)
+	result := map[string]interface{}{
+		"data":     series,
+		"forecast": projection,
+		"lower":    lower,
+		"upper":    upper,
+	}
+
+	y := observed(data)
+	if len(y) < 3 {
+		// too short to fit, only the history is returned
+		return result
+	}
+	confidence := query.Confidence
+	if confidence == 0 {
+		confidence = DefaultForecastConfidence
+	}
+	steps := n - len(y)
+
+	var f forecast
+	if query.Model == ForecastHoltWinters {
+		m := defaultSeason(period)
+		if query.Season != nil {
+			m = *query.Season
+		}
+		smoothing := append([]float64{}, defaultSmoothing...)
+		copy(smoothing, query.Smoothing)
+		f = holtWintersForecast(y, m, smoothing, steps, confidence)
+	} else {
+		f = linearForecast(y, steps, confidence)
+	}
+
+	last := len(y) - 1
+	projection[last] = formatForecast(y[last])
+	lower[last], upper[last] = projection[last], projection[last]
+	for h := range f.values {
+		projection[last+1+h] = formatForecast(f.values[h])
+		lower[last+1+h] = formatForecast(f.lower[h])
+		upper[last+1+h] = formatForecast(f.upper[h])
+	}
+	result["model"] = f.model
+	return result
+}
@@ -0,0 +1,100 @@
+package figure_parser
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestObserved(t *testing.T) {
+	testCases := []struct {
+		in  []string
+		out []float64
+	}{
+		{[]string{"1", "-", "3", "-"}, []float64{1, 2, 3}},
+		{[]string{"-", "2", "-", "-", "8"}, []float64{2, 2, 4, 6, 8}},
+		{[]string{"-", "-"}, []float64{}},
+	}
+
+	for i, tc := range testCases {
+		out := observed(tc.in)
+		if !reflect.DeepEqual(tc.out, out) {
+			t.Error(i, ":", "want", tc.out, "got", out)
+		}
+	}
+}
+
+func TestLinearForecast(t *testing.T) {
+	f := linearForecast([]float64{1, 3, 5, 7}, 2, 0.95)
+	if !reflect.DeepEqual([]float64{9, 11}, f.values) {
+		t.Error("want", []float64{9, 11}, "got", f.values)
+	}
+	// a perfect fit has no band
+	if !reflect.DeepEqual(f.values, f.lower) || !reflect.DeepEqual(f.values, f.upper) {
+		t.Error("want no band got", f.lower, f.upper)
+	}
+
+	f = linearForecast([]float64{1, 4, 5, 8, 9}, 3, 0.95)
+	for h := range f.values {
+		if !(f.lower[h] < f.values[h] && f.values[h] < f.upper[h]) {
+			t.Error(h, ":", "want band around", f.values[h], "got", f.lower[h], f.upper[h])
+		}
+		if h > 0 && f.upper[h]-f.lower[h] <= f.upper[h-1]-f.lower[h-1] {
+			t.Error(h, ":", "want band widening")
+		}
+	}
+}
+
+func TestHoltWintersForecast(t *testing.T) {
+	pattern := []float64{5, -2, 0, -3}
+	y := make([]float64, 16)
+	for i := range y {
+		y[i] = 100 + 2*float64(i) + pattern[i%4]
+	}
+	f := holtWintersForecast(y, 4, []float64{0.5, 0.3, 0.3}, 4, 0.9)
+	if f.model != ForecastHoltWinters {
+		t.Error("want", ForecastHoltWinters, "got", f.model)
+	}
+	for h, v := range f.values {
+		want := 100 + 2*float64(16+h) + pattern[(16+h)%4]
+		if math.Abs(v-want) > 2 {
+			t.Error(h, ":", "want about", want, "got", v)
+		}
+	}
+
+	// too short for its season it falls back to a trend
+	f = holtWintersForecast([]float64{1, 2, 3, 4}, 12, defaultSmoothing, 1, 0.9)
+	if len(f.values) != 1 || math.Abs(f.values[0]-5) > 0.5 {
+		t.Error("want about 5 got", f.values)
+	}
+}
+
+func TestForecastResult(t *testing.T) {
+	query := QuerySpec{Type: "forecast", Model: ForecastLinear}
+	result := forecastParser{}.result(query, PeriodMonth, []string{"1", "2", "3", "-"}, 6)
+	want := map[string]interface{}{
+		"data":     []string{"1", "2", "3", "-", "-", "-"},
+		"forecast": []string{"-", "-", "3", "4", "5", "6"},
+		"lower":    []string{"-", "-", "3", "4", "5", "6"},
+		"upper":    []string{"-", "-", "3", "4", "5", "6"},
+		"model":    ForecastLinear,
+	}
+	if !reflect.DeepEqual(want, result) {
+		t.Error("want", want, "got", result)
+	}
+}
+
+func TestValidateForecast(t *testing.T) {
+	query, _ := DecodeQuery([]byte(`{"type": "forecast", "table": "t", "column": "c",
+		"model": "arima", "horizon": -1, "confidence": 1.5, "smoothing": [0.5, 0]}`))
+	err := query.Validate()
+	want := ValidationErrors{
+		{"$.model", `must be "linear" or "holt_winters"`},
+		{"$.horizon", "must be between 1 and 120"},
+		{"$.confidence", "must be between 0 and 1"},
+		{"$.smoothing[1]", "must be in (0, 1]"},
+	}
+	if !reflect.DeepEqual(want, err) {
+		t.Error("want", want, "got", err)
+	}
+}
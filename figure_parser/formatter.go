@@ -3,12 +3,7 @@ package figure_parser
 import (
 	"fmt"
 	"regexp"
-	"strconv"
-	"strings"
 	"time"
-
-	"golang.org/x/text/language"
-	"golang.org/x/text/message"
 )
 
 const (
@@ -16,37 +11,13 @@ const (
 )
 
 var (
-	englishPrinter = message.NewPrinter(language.English)
-	numberRe       = regexp.MustCompile(`\d+\.?\d*`)
+	numberRe = regexp.MustCompile(`\d+\.?\d*`)
 )
 
+// FormatNumber writes numbers, and strings holding a number, in the
+// default format
 func FormatNumber(v interface{}) interface{} {
-	switch n := v.(type) {
-	case string:
-		n = strings.TrimSpace(n)
-		if numberRe.MatchString(n) {
-			if strings.Contains(n, ".") {
-				f, err := strconv.ParseFloat(n, 64)
-				if err != nil {
-					return v
-				}
-				return FormatNumber(f)
-			} else {
-				i, err := strconv.ParseInt(n, 10, 64)
-				if err != nil {
-					return v
-				}
-				return FormatNumber(i)
-			}
-		}
-		return v
-	case int8, int16, int32, int64, int, uint8, uint16, uint32, uint64, uint:
-		return englishPrinter.Sprint(n)
-	case float32, float64:
-		return englishPrinter.Sprintf("%.2f", n)
-	default:
-		return v
-	}
+	return NumberFormat{}.Format(v)
 }
 
 func PrintNumber(v ...interface{}) string {
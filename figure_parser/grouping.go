@@ -0,0 +1,91 @@
+package figure_parser
+
+import (
+	"math"
+	"sort"
+	"strconv"
+)
+
+// DefaultOtherLabel names the series holding the groups folded by top_n
+const DefaultOtherLabel = "Other"
+
+func otherLabel(label string) string {
+	if len(label) == 0 {
+		return DefaultOtherLabel
+	}
+	return label
+}
+
+// rankGroups returns group indexes ordered by total descending, ties by name.
+func rankGroups(names []string, totals []float64) []int {
+	order := make([]int, len(names))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		ta, tb := totals[order[a]], totals[order[b]]
+		if ta != tb {
+			return ta > tb
+		}
+		return names[order[a]] < names[order[b]]
+	})
+	return order
+}
+
+func sumSeries(s []string) float64 {
+	total := 0.0
+	for _, v := range s {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || math.IsNaN(f) {
+			continue
+		}
+		total += f
+	}
+	return total
+}
+
+// foldTopN keeps the n groups with the biggest total over the series and
+// folds the rest into one series called label. Missing values stay "-"
+// unless one of the folded groups has a value at that date.
+func foldTopN(names []string, data [][]string, n int, label string) ([]string, [][]string) {
+	if n <= 0 || len(names) <= n {
+		return names, data
+	}
+
+	totals := make([]float64, len(names))
+	for i := range names {
+		totals[i] = sumSeries(data[i])
+	}
+	order := rankGroups(names, totals)
+
+	keptNames := make([]string, 0, n+1)
+	keptData := make([][]string, 0, n+1)
+	for _, i := range order[:n] {
+		keptNames = append(keptNames, names[i])
+		keptData = append(keptData, data[i])
+	}
+
+	length := len(data[order[0]])
+	other := make([]float64, length)
+	present := make([]bool, length)
+	for _, i := range order[n:] {
+		for j, v := range data[i] {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil || math.IsNaN(f) {
+				continue
+			}
+			other[j] += f
+			present[j] = true
+		}
+	}
+	otherData := make([]string, length)
+	for j := range other {
+		if present[j] {
+			otherData[j] = strconv.FormatFloat(other[j], 'f', -1, 64)
+		} else {
+			otherData[j] = "-"
+		}
+	}
+
+	return append(keptNames, otherLabel(label)), append(keptData, otherData)
+}
@@ -0,0 +1,57 @@
+package figure_parser
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFoldTopN(t *testing.T) {
+	names := []string{"Beijing", "Shanghai", "Wuhan", "Xian"}
+	data := [][]string{
+		{"10", "20"},
+		{"30", "40"},
+		{"1", "-"},
+		{"-", "-"},
+	}
+
+	gotNames, gotData := foldTopN(names, data, 2, "")
+	wantNames := []string{"Shanghai", "Beijing", "Other"}
+	wantData := [][]string{{"30", "40"}, {"10", "20"}, {"1", "-"}}
+	if !reflect.DeepEqual(wantNames, gotNames) || !reflect.DeepEqual(wantData, gotData) {
+		t.Error("want", wantNames, wantData, "got", gotNames, gotData)
+	}
+
+	gotNames, _ = foldTopN(names, data, 4, "")
+	if !reflect.DeepEqual(names, gotNames) {
+		t.Error("want", names, "got", gotNames)
+	}
+}
+
+func TestParsePieChartTopN(t *testing.T) {
+	result := map[string]interface{}{
+		"group_values": []string{"a", "b", "c", "d"},
+		"data":         [][]string{{"50"}, {"25"}, {"15"}, {"10"}},
+	}
+	if err := parsePieChart(result, 1, "Rest"); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"a": "50.00", "Rest": "50.00"}
+	if !reflect.DeepEqual(want, result["data"]) {
+		t.Error("want", want, "got", result["data"])
+	}
+}
+
+func TestParsePieChartInvalid(t *testing.T) {
+	testCases := []map[string]interface{}{
+		// named queries
+		{"A": map[string]interface{}{"data": []string{"1"}}},
+		// not aggregated by group
+		{"group_values": []string{"a"}, "data": []string{"1"}},
+		{"group_values": []string{"a", "b"}, "data": [][]string{{"1"}}},
+	}
+	for i, result := range testCases {
+		if err := parsePieChart(result, 0, ""); err == nil {
+			t.Error(i, ":", "want error got", result["data"])
+		}
+	}
+}
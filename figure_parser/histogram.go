@@ -0,0 +1,273 @@
+package figure_parser
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/bluecover/lm/models"
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+)
+
+const maxBuckets = 200
+
+// BucketSpec tells a histogram query how to bucket values. Exactly one rule is used:
+//
+//	{"width": 5000, "min": 0, "max": 50000}  fixed width buckets
+//	{"edges": [0, 1000, 5000, 20000]}        explicit bucket edges
+//	{"quantiles": 4}                          equal sized buckets of the selected data
+//
+// Values outside fixed or explicit edges are counted in "< min" and ">= max" buckets.
+type BucketSpec struct {
+	Width     float64
+	Min       float64
+	Max       float64
+	Edges     []float64
+	Quantiles int
+	// Labels optionally names the buckets between the edges
+	Labels []string
+
+	errs ValidationErrors
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (b *BucketSpec) UnmarshalJSON(data []byte) error {
+	d := newFieldDecoder(data)
+	d.decode("width", &b.Width)
+	d.decode("min", &b.Min)
+	d.decode("max", &b.Max)
+	d.decode("edges", &b.Edges)
+	d.decode("quantiles", &b.Quantiles)
+	d.decode("labels", &b.Labels)
+	b.errs = d.errs
+	return nil
+}
+
+func (b BucketSpec) validate(path string, errs *ValidationErrors) {
+	errs.merge(path, b.errs)
+
+	rules := 0
+	inner := 0
+	if b.Width != 0 {
+		rules++
+		if b.Width < 0 || b.Max <= b.Min {
+			errs.add(path, "fixed buckets need a positive width and max greater than min")
+		} else if inner = int(math.Ceil((b.Max - b.Min) / b.Width)); inner > maxBuckets {
+			errs.add(path, "too many buckets, at most %d", maxBuckets)
+		}
+	}
+	if len(b.Edges) > 0 {
+		rules++
+		inner = len(b.Edges) - 1
+		for i := 1; i < len(b.Edges); i++ {
+			if b.Edges[i] <= b.Edges[i-1] {
+				errs.add(joinPath(path, "edges"), "must be strictly increasing")
+				break
+			}
+		}
+		if len(b.Edges) > maxBuckets {
+			errs.add(joinPath(path, "edges"), "too many buckets, at most %d", maxBuckets)
+		}
+	}
+	if b.Quantiles != 0 {
+		rules++
+		inner = b.Quantiles
+		if b.Quantiles < 2 || b.Quantiles > 100 {
+			errs.add(joinPath(path, "quantiles"), "must be between 2 and 100")
+		}
+	}
+	if rules != 1 {
+		errs.add(path, "needs exactly one of width, edges or quantiles")
+		return
+	}
+	if len(b.Labels) > 0 && len(b.Labels) != inner {
+		errs.add(joinPath(path, "labels"), "needs %d labels", inner)
+	}
+}
+
+// edges returns the bucket edges of a fixed or explicit rule
+func (b BucketSpec) edges() []float64 {
+	if len(b.Edges) > 0 {
+		return b.Edges
+	}
+	n := int(math.Ceil((b.Max - b.Min) / b.Width))
+	edges := make([]float64, n+1)
+	for i := range edges {
+		edges[i] = b.Min + float64(i)*b.Width
+	}
+	return edges
+}
+
+func formatEdge(f float64) string {
+	return strconv.FormatFloat(math.Round(f*100)/100, 'f', -1, 64)
+}
+
+func bucketLabels(edges []float64, names []string) []string {
+	labels := make([]string, 0, len(edges)-1)
+	for i := 1; i < len(edges); i++ {
+		if len(names) > 0 {
+			labels = append(labels, names[i-1])
+		} else {
+			labels = append(labels, formatEdge(edges[i-1])+"-"+formatEdge(edges[i]))
+		}
+	}
+	return labels
+}
+
+func joinFloats(fs []float64) string {
+	s := make([]string, len(fs))
+	for i, f := range fs {
+		s[i] = strconv.FormatFloat(f, 'g', -1, 64)
+	}
+	return strings.Join(s, ",")
+}
+
+// histogramParser counts the values of "column" per bucket and period, e.g.
+// {"type": "histogram", "table": "YRD.loans_detail", "column": "amount", "buckets": {"quantiles": 4}}
+// The result has the same shape as aggregate with the bucket labels in "group_values".
+type histogramParser struct{}
+
+// bucketRule returns the thresholds passed to width_bucket and the labels
+// of the len(thresholds)+1 buckets it numbers from 0. edgeBuckets is true if
+// the first and last buckets hold values outside of the edges.
+func (histogramParser) bucketRule(ctx context.Context, query QuerySpec, args ParseArgs,
+	db *gorm.DB) (thresholds []float64, labels []string, edgeBuckets bool, err error) {
+
+	b := query.Buckets
+	if b.Quantiles == 0 {
+		thresholds = b.edges()
+		labels = append(labels, "< "+formatEdge(thresholds[0]))
+		labels = append(labels, bucketLabels(thresholds, b.Labels)...)
+		labels = append(labels, ">= "+formatEdge(thresholds[len(thresholds)-1]))
+		return thresholds, labels, true, nil
+	}
+
+	fractions := make([]float64, b.Quantiles-1)
+	for i := range fractions {
+		fractions[i] = float64(i+1) / float64(b.Quantiles)
+	}
+	table := models.QuoteIdentifier(query.Table)
+	builder := sq.Select(
+		fmt.Sprintf("min(%s)::float8", query.Column),
+		fmt.Sprintf("max(%s)::float8", query.Column),
+		fmt.Sprintf("percentile_cont(ARRAY[%s]) WITHIN GROUP (ORDER BY %s)", joinFloats(fractions), query.Column),
+	).From(table)
+	builder = applyArgs(builder, args)
+	statement, sargs, err := builder.ToSql()
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	var min, max *float64
+	var quantiles []float64
+	err = rawScan(ctx, db, statement, sargs, &min, &max, pq.Array(&quantiles))
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if min == nil || max == nil {
+		return nil, nil, false, nil
+	}
+
+	edges := []float64{*min}
+	for _, q := range quantiles {
+		if q > edges[len(edges)-1] {
+			edges = append(edges, q)
+		}
+	}
+	if *max > edges[len(edges)-1] || len(edges) == 1 {
+		edges = append(edges, *max)
+	}
+	names := b.Labels
+	if len(names) != len(edges)-1 {
+		names = nil
+	}
+	return edges[1 : len(edges)-1], bucketLabels(edges, names), false, nil
+}
+
+// Parse implement QueryParser.Parse
+func (p histogramParser) Parse(ctx context.Context, query QuerySpec, args ParseArgs,
+	db *gorm.DB) (map[string]interface{}, error) {
+
+	periodRange := createPeriodRange(args.Calendar, args.Start, args.End, args.Period)
+	thresholds, labels, edgeBuckets, err := p.bucketRule(ctx, query, args, db)
+	if err != nil {
+		return nil, err
+	}
+	if len(labels) == 0 {
+		return map[string]interface{}{
+			"date_range":   periodRange,
+			"group_values": []string{},
+			"data":         [][]string{},
+			"total":        []string{},
+		}, nil
+	}
+
+	bucket := "0"
+	if len(thresholds) > 0 {
+		bucket = fmt.Sprintf("width_bucket((%s)::float8, ARRAY[%s]::float8[])", query.Column, joinFloats(thresholds))
+	}
+	table := models.QuoteIdentifier(query.Table)
+	builder := sq.Select("date", bucket+" AS bucket", "count(*) AS cnt").From(table).
+		Where(query.Column+" IS NOT NULL").GroupBy("date", "bucket").OrderBy("date ASC")
+	builder = applyArgs(builder, args)
+	statement, sargs, err := builder.ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := queryRows(ctx, db, statement, sargs...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make([]map[string]int64, len(labels))
+	totals := make([]int64, len(labels))
+	for i := range counts {
+		counts[i] = make(map[string]int64)
+	}
+	for rows.Next() {
+		var date time.Time
+		var b int
+		var cnt int64
+		if err := rows.Scan(&date, &b, &cnt); err != nil {
+			return nil, err
+		}
+		if b < 0 || b >= len(labels) {
+			continue
+		}
+		counts[b][args.Calendar.FormatTime(date, args.Period)] += cnt
+		totals[b] += cnt
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	groupValues := make([]string, 0, len(labels))
+	data := make([][]string, 0, len(labels))
+	total := make([]string, 0, len(labels))
+	for i, label := range labels {
+		if edgeBuckets && (i == 0 || i == len(labels)-1) && totals[i] == 0 {
+			continue
+		}
+		series := make([]string, len(periodRange))
+		for j, d := range periodRange {
+			series[j] = strconv.FormatInt(counts[i][d], 10)
+		}
+		groupValues = append(groupValues, label)
+		data = append(data, series)
+		total = append(total, strconv.FormatInt(totals[i], 10))
+	}
+
+	return map[string]interface{}{
+		"date_range":   periodRange,
+		"group_values": groupValues,
+		"data":         data,
+		"total":        total,
+	}, nil
+}
@@ -0,0 +1,52 @@
+package figure_parser
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestBucketSpecValidate(t *testing.T) {
+	testCases := []struct {
+		in   string
+		errs int
+	}{
+		{`{"width": 1000, "min": 0, "max": 5000}`, 0},
+		{`{"edges": [0, 100, 1000]}`, 0},
+		{`{"quantiles": 4, "labels": ["Q1", "Q2", "Q3", "Q4"]}`, 0},
+		{`{}`, 1},
+		{`{"width": 10, "max": 10, "edges": [0, 1]}`, 1},
+		{`{"width": 10, "min": 5, "max": 5}`, 1},
+		{`{"width": 1, "min": 0, "max": 1000}`, 1},
+		{`{"edges": [0, 10, 5]}`, 1},
+		{`{"quantiles": 1}`, 1},
+		{`{"edges": [0, 10, 20], "labels": ["low"]}`, 1},
+		{`{"quantiles": "4"}`, 2},
+	}
+	for i, tc := range testCases {
+		var b BucketSpec
+		if err := json.Unmarshal([]byte(tc.in), &b); err != nil {
+			t.Error(i, ":", err)
+			continue
+		}
+		var errs ValidationErrors
+		b.validate("$.buckets", &errs)
+		if len(errs) != tc.errs {
+			t.Error(i, ":", "want", tc.errs, "errors", "got", errs)
+		}
+	}
+}
+
+func TestBucketLabels(t *testing.T) {
+	b := BucketSpec{Width: 2.5, Min: 0, Max: 6}
+	edges := b.edges()
+	if want := []float64{0, 2.5, 5, 7.5}; !reflect.DeepEqual(want, edges) {
+		t.Error("want", want, "got", edges)
+	}
+	if want, out := []string{"0-2.5", "2.5-5", "5-7.5"}, bucketLabels(edges, nil); !reflect.DeepEqual(want, out) {
+		t.Error("want", want, "got", out)
+	}
+	if want, out := []string{"a", "b", "c"}, bucketLabels(edges, []string{"a", "b", "c"}); !reflect.DeepEqual(want, out) {
+		t.Error("want", want, "got", out)
+	}
+}
@@ -0,0 +1,191 @@
+package figure_parser
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/bluecover/lm/business/timing"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+)
+
+// DefaultLocale formats numbers and dates unless a user or request picks
+// another one
+const DefaultLocale = "en-US"
+
+// Units of a NumberFormat
+const (
+	// UnitsCompact writes 1200000 as 1.2M
+	UnitsCompact = "compact"
+	// UnitsChinese writes 1200000 as 120万
+	UnitsChinese = "cn"
+)
+
+type unit struct {
+	size   float64
+	suffix string
+}
+
+var units = map[string][]unit{
+	UnitsCompact: {{1e12, "T"}, {1e9, "B"}, {1e6, "M"}, {1e3, "K"}},
+	UnitsChinese: {{1e8, "亿"}, {1e4, "万"}},
+}
+
+var printers sync.Map
+
+// printer returns the message printer of a locale, English if it is unknown
+func printer(locale string) *message.Printer {
+	if p, ok := printers.Load(locale); ok {
+		return p.(*message.Printer)
+	}
+	tag, err := language.Parse(locale)
+	if err != nil {
+		tag = language.English
+	}
+	p, _ := printers.LoadOrStore(locale, message.NewPrinter(tag))
+	return p.(*message.Printer)
+}
+
+// ValidLocale returns the canonical form of a BCP 47 locale, or false if it
+// is malformed or unknown
+func ValidLocale(locale string) (string, bool) {
+	tag, err := language.Parse(locale)
+	if err != nil || tag == language.Und {
+		return "", false
+	}
+	return tag.String(), true
+}
+
+// NumberFormat tells how the numbers of a query or table column are
+// written, given in "formats" of a figure, e.g.
+// "formats": {"A": {"precision": 1, "units": "cn", "currency": "¥"}}
+// keyed by query name, by result field for a single query, or by column for
+// a table figure. Locale comes from the request.
+type NumberFormat struct {
+	Locale string
+	// Precision is the number of decimals of fractional numbers, 2 if nil
+	Precision *int
+	Units     string
+	Currency  string
+
+	errs ValidationErrors
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (f *NumberFormat) UnmarshalJSON(b []byte) error {
+	d := newFieldDecoder(b)
+	d.decode("precision", &f.Precision)
+	d.decode("units", &f.Units)
+	d.decode("currency", &f.Currency)
+	f.errs = d.errs
+	return nil
+}
+
+func (f NumberFormat) validate(path string, errs *ValidationErrors) {
+	errs.merge(path, f.errs)
+	if f.Precision != nil && (*f.Precision < 0 || *f.Precision > 10) {
+		errs.add(joinPath(path, "precision"), "must be between 0 and 10")
+	}
+	if _, ok := units[f.Units]; len(f.Units) > 0 && !ok {
+		errs.add(joinPath(path, "units"), "must be %q or %q", UnitsCompact, UnitsChinese)
+	}
+}
+
+// Format writes numbers, and strings holding a number, in the format.
+// Other values are returned as they are.
+func (f NumberFormat) Format(v interface{}) interface{} {
+	switch n := v.(type) {
+	case string:
+		n = strings.TrimSpace(n)
+		if numberRe.MatchString(n) {
+			if strings.Contains(n, ".") {
+				fl, err := strconv.ParseFloat(n, 64)
+				if err != nil {
+					return v
+				}
+				return f.Format(fl)
+			}
+			i, err := strconv.ParseInt(n, 10, 64)
+			if err != nil {
+				return v
+			}
+			return f.Format(i)
+		}
+		return v
+	case int8, int16, int32, int64, int, uint8, uint16, uint32, uint64, uint:
+		fl, _ := strconv.ParseFloat(fmt.Sprint(n), 64)
+		return f.format(fl, true)
+	case float32:
+		return f.format(float64(n), false)
+	case float64:
+		return f.format(n, false)
+	default:
+		return v
+	}
+}
+
+func (f NumberFormat) format(v float64, integer bool) string {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return "-"
+	}
+	locale := f.Locale
+	if len(locale) == 0 {
+		locale = DefaultLocale
+	}
+	p := printer(locale)
+
+	precision := 2
+	if f.Precision != nil {
+		precision = *f.Precision
+	}
+	sign, abs := "", v
+	if v < 0 {
+		sign, abs = "-", -v
+	}
+	suffix := ""
+	for _, u := range units[f.Units] {
+		if abs >= u.size {
+			abs, suffix, integer = abs/u.size, u.suffix, false
+			if f.Precision == nil {
+				precision = 1
+			}
+			break
+		}
+	}
+
+	var s string
+	if integer {
+		s = p.Sprintf("%d", int64(abs))
+	} else {
+		s = p.Sprintf("%.*f", precision, abs)
+	}
+	return sign + f.Currency + s + suffix
+}
+
+// numberFormat returns the format of the numbers of a query or column named
+// name in the locale of the request
+func (args ParseArgs) numberFormat(formats map[string]NumberFormat, name string) NumberFormat {
+	f := formats[name]
+	f.Locale = args.Locale
+	return f
+}
+
+// localizeDateRanges rewrites the period labels of "date_range" in query
+// results for the locale
+func localizeDateRanges(results map[string]interface{}, locale string) {
+	for k, v := range results {
+		switch t := v.(type) {
+		case map[string]interface{}:
+			localizeDateRanges(t, locale)
+		case []string:
+			if k == "date_range" {
+				for i, label := range t {
+					t[i] = timing.LocalizeLabel(label, locale)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package figure_parser
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNumberFormat(t *testing.T) {
+	one, zero := 1, 0
+	testCases := []struct {
+		format NumberFormat
+		in     interface{}
+		out    interface{}
+	}{
+		{NumberFormat{}, 1234567.891, "1,234,567.89"},
+		{NumberFormat{Locale: "de-DE"}, 1234567.891, "1.234.567,89"},
+		{NumberFormat{Locale: "de-DE"}, 1234, "1.234"},
+		{NumberFormat{Precision: &zero}, "1234.5", "1,234"},
+		{NumberFormat{Units: UnitsCompact}, 1234567, "1.2M"},
+		{NumberFormat{Units: UnitsCompact}, 999, "999"},
+		{NumberFormat{Units: UnitsCompact, Precision: &zero}, -2600.0, "-3K"},
+		{NumberFormat{Units: UnitsChinese}, 123456789, "1.2亿"},
+		{NumberFormat{Units: UnitsChinese, Precision: &one}, "56000", "5.6万"},
+		{NumberFormat{Currency: "¥"}, -12.5, "-¥12.50"},
+		{NumberFormat{Currency: "$", Units: UnitsCompact}, 2.5e9, "$2.5B"},
+		{NumberFormat{}, "N/A", "N/A"},
+	}
+
+	for i, tc := range testCases {
+		out := tc.format.Format(tc.in)
+		if !reflect.DeepEqual(tc.out, out) {
+			t.Error(i, ":", "want", tc.out, "got", out)
+		}
+	}
+}
+
+func TestLocalizeDateRanges(t *testing.T) {
+	results := map[string]interface{}{
+		"A": map[string]interface{}{"date_range": []string{"2018/01/02", "2018/02", "2018/Q3", "2018", "2018/W05", "2018/H2", "2018/W53", "FY2018 Q1", "FY2018 H2", "FY2019", "FY2018 Q5", "x"}},
+		"B": map[string]interface{}{"data": []string{"2018/01"}},
+	}
+	localizeDateRanges(results, "zh-CN")
+
+	want := map[string]interface{}{
+		"A": map[string]interface{}{"date_range": []string{"2018年01月02日", "2018年02月", "2018年第3季度", "2018年", "2018年第5周", "2018年下半年", "2018/W53", "2018财年第1季度", "2018财年下半年", "2019财年", "FY2018 Q5", "x"}},
+		"B": map[string]interface{}{"data": []string{"2018/01"}},
+	}
+	if !reflect.DeepEqual(want, results) {
+		t.Error("want", want, "got", results)
+	}
+
+	results = map[string]interface{}{"date_range": []string{"2018/Q3", "FY2018 Q1"}}
+	localizeDateRanges(results, "en-US")
+	if out := results["date_range"].([]string); !reflect.DeepEqual(out, []string{"2018/Q3", "FY2018 Q1"}) {
+		t.Error("want", []string{"2018/Q3", "FY2018 Q1"}, "got", out)
+	}
+}
+
+func TestValidLocale(t *testing.T) {
+	testCases := []struct {
+		in  string
+		out string
+		ok  bool
+	}{
+		{"zh-cn", "zh-CN", true},
+		{"en-US", "en-US", true},
+		{"", "", false},
+		{"not a locale", "", false},
+	}
+
+	for i, tc := range testCases {
+		out, ok := ValidLocale(tc.in)
+		if out != tc.out || ok != tc.ok {
+			t.Error(i, ":", "want", tc.out, tc.ok, "got", out, ok)
+		}
+	}
+}
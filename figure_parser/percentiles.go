@@ -0,0 +1,210 @@
+package figure_parser
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/bluecover/lm/models"
+	"github.com/gonum/stat"
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+)
+
+// boxPlotStats are the statistics added by "box_plot", in the order of a box plot
+var boxPlotStats = []percentileStat{
+	{"min", 0},
+	{"q1", 25},
+	{"median", 50},
+	{"q3", 75},
+	{"max", 100},
+}
+
+type percentileStat struct {
+	label   string
+	percent float64
+}
+
+// percentilesParser returns percentiles of "column" per period, e.g.
+// {"type": "percentiles", "table": "YRD.loans_detail", "column": "amount",
+// "percentiles": [50, 90], "box_plot": true}
+// With "weight" every value counts as often as the weight column says. The
+// percentiles are computed by percentile_cont in postgres and with gonum/stat
+// for weighted values or other databases.
+// The result has the same shape as aggregate with one series per statistic.
+// With "box_plot" the result also has "box", the [min, q1, median, q3, max]
+// of every period.
+type percentilesParser struct{}
+
+func percentileLabel(p float64) string {
+	return "p" + strconv.FormatFloat(p, 'f', -1, 64)
+}
+
+// stats returns the statistics computed by the query
+func (percentilesParser) stats(query QuerySpec) []percentileStat {
+	stats := make([]percentileStat, 0, len(query.Percentiles)+len(boxPlotStats))
+	seen := make(map[float64]bool)
+	if query.BoxPlot {
+		for _, s := range boxPlotStats {
+			stats = append(stats, s)
+			seen[s.percent] = true
+		}
+	}
+	for _, p := range query.Percentiles {
+		if !seen[p] {
+			stats = append(stats, percentileStat{percentileLabel(p), p})
+			seen[p] = true
+		}
+	}
+	return stats
+}
+
+// inDatabase computes the percentiles of every period with percentile_cont
+func (percentilesParser) inDatabase(ctx context.Context, query QuerySpec, fractions []float64, args ParseArgs,
+	db *gorm.DB) (map[string][]float64, error) {
+
+	table := models.QuoteIdentifier(query.Table)
+	builder := sq.Select("date",
+		fmt.Sprintf("percentile_cont(ARRAY[%s]) WITHIN GROUP (ORDER BY (%s)::float8)",
+			joinFloats(fractions), query.Column),
+	).From(table).Where(query.Column + " IS NOT NULL").GroupBy("date").OrderBy("date ASC")
+	builder = applyArgs(builder, args)
+	statement, sargs, err := builder.ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := queryRows(ctx, db, statement, sargs...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	values := make(map[string][]float64)
+	for rows.Next() {
+		var date time.Time
+		var quantiles []float64
+		if err := rows.Scan(&date, pq.Array(&quantiles)); err != nil {
+			return nil, err
+		}
+		values[args.Calendar.FormatTime(date, args.Period)] = quantiles
+	}
+	return values, rows.Err()
+}
+
+// inMemory selects the values of every period and computes the percentiles
+// with gonum/stat
+func (percentilesParser) inMemory(ctx context.Context, query QuerySpec, fractions []float64, args ParseArgs,
+	db *gorm.DB) (map[string][]float64, error) {
+
+	weight := "1"
+	if len(query.Weight) > 0 {
+		weight = query.Weight
+	}
+	table := models.QuoteIdentifier(query.Table)
+	builder := sq.Select("date", query.Column, weight).From(table).
+		Where(query.Column + " IS NOT NULL").OrderBy("date ASC")
+	builder = applyArgs(builder, args)
+	statement, sargs, err := builder.ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := queryRows(ctx, db, statement, sargs...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	xs := make(map[string][]float64)
+	ws := make(map[string][]float64)
+	for rows.Next() {
+		var date time.Time
+		var x float64
+		var w sql.NullFloat64
+		if err := rows.Scan(&date, &x, &w); err != nil {
+			return nil, err
+		}
+		if !w.Valid || w.Float64 <= 0 {
+			continue
+		}
+		d := args.Calendar.FormatTime(date, args.Period)
+		xs[d] = append(xs[d], x)
+		ws[d] = append(ws[d], w.Float64)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	values := make(map[string][]float64)
+	for d, x := range xs {
+		values[d] = weightedQuantiles(x, ws[d], fractions)
+	}
+	return values, nil
+}
+
+// weightedQuantiles returns the empirical quantiles of x, sorting x and weights
+func weightedQuantiles(x, weights []float64, fractions []float64) []float64 {
+	stat.SortWeighted(x, weights)
+	quantiles := make([]float64, len(fractions))
+	for i, f := range fractions {
+		quantiles[i] = stat.Quantile(f, stat.Empirical, x, weights)
+	}
+	return quantiles
+}
+
+// Parse implement QueryParser.Parse
+func (p percentilesParser) Parse(ctx context.Context, query QuerySpec, args ParseArgs,
+	db *gorm.DB) (map[string]interface{}, error) {
+
+	stats := p.stats(query)
+	fractions := make([]float64, len(stats))
+	for i, s := range stats {
+		fractions[i] = s.percent / 100
+	}
+
+	var values map[string][]float64
+	var err error
+	if len(query.Weight) == 0 && db.Dialect().GetName() == "postgres" {
+		values, err = p.inDatabase(ctx, query, fractions, args, db)
+	} else {
+		values, err = p.inMemory(ctx, query, fractions, args, db)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	periodRange := createPeriodRange(args.Calendar, args.Start, args.End, args.Period)
+	result := map[string]interface{}{
+		"date_range": periodRange,
+	}
+	groupValues := make([]string, len(stats))
+	data := make([][]string, len(stats))
+	for i, s := range stats {
+		groupValues[i] = s.label
+		data[i] = make([]string, len(periodRange))
+		for j, d := range periodRange {
+			data[i][j] = "-"
+			if quantiles, ok := values[d]; ok && i < len(quantiles) {
+				data[i][j] = formatDerived(quantiles[i])
+			}
+		}
+	}
+	result["group_values"] = groupValues
+	result["data"] = data
+
+	if query.BoxPlot {
+		box := make([][]string, len(periodRange))
+		for j := range periodRange {
+			box[j] = make([]string, len(boxPlotStats))
+			for i := range boxPlotStats {
+				box[j][i] = data[i][j]
+			}
+		}
+		result["box"] = box
+	}
+	return result, nil
+}
@@ -0,0 +1,35 @@
+package figure_parser
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPercentileStats(t *testing.T) {
+	stats := percentilesParser{}.stats(QuerySpec{Percentiles: []float64{50, 90, 99.5}, BoxPlot: true})
+	labels := make([]string, len(stats))
+	for i, s := range stats {
+		labels[i] = s.label
+	}
+	if want := []string{"min", "q1", "median", "q3", "max", "p90", "p99.5"}; !reflect.DeepEqual(want, labels) {
+		t.Error("want", want, "got", labels)
+	}
+}
+
+func TestWeightedQuantiles(t *testing.T) {
+	testCases := []struct {
+		x       []float64
+		weights []float64
+		out     []float64
+	}{
+		{[]float64{5, 1, 4, 2, 3}, nil, []float64{1, 3, 5}},
+		{[]float64{5, 1, 4, 2, 3}, []float64{1, 1, 1, 1, 1}, []float64{1, 3, 5}},
+		{[]float64{10, 20}, []float64{9, 1}, []float64{10, 10, 20}},
+	}
+	for i, tc := range testCases {
+		out := weightedQuantiles(tc.x, tc.weights, []float64{0, 0.5, 1})
+		if !reflect.DeepEqual(tc.out, out) {
+			t.Error(i, ":", "want", tc.out, "got", out)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package figure_parser
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/bluecover/lm/models"
+	"github.com/jinzhu/gorm"
+)
+
+// Values of "percent" of a pivot query
+const (
+	PercentOfRow    = "row"
+	PercentOfColumn = "column"
+)
+
+// pivotTotalLabel titles the totals column of a pivot table
+const pivotTotalLabel = "Total"
+
+// pivotParser aggregates "function" over the date range grouped by two
+// dimensions, e.g.
+// {"type": "pivot", "table": "YRD.borrower", "row_key": "city",
+// "column_key": "education", "function": "count(*)", "percent": "row"}
+// The row, column and grand totals are aggregated by the database, so they
+// are right for any function, not only sums.
+// "data" holds one series per row value with one value per column value. With
+// "percent" the cells are given as percent of their row or column total.
+type pivotParser struct{}
+
+// pivotCell addresses one value of a pivot result. An empty row or column
+// stands for the total over it.
+type pivotCell struct {
+	row, column string
+}
+
+// Parse implement QueryParser.Parse
+func (p pivotParser) Parse(ctx context.Context, query QuerySpec, args ParseArgs,
+	db *gorm.DB) (map[string]interface{}, error) {
+
+	table := models.QuoteIdentifier(query.Table)
+	row, column := query.RowKey, query.ColumnKey
+	builder := sq.Select(
+		fmt.Sprintf("(%s)::text", row),
+		fmt.Sprintf("(%s)::text", column),
+		fmt.Sprintf("(%s)::float8", query.Function),
+		fmt.Sprintf("GROUPING(%s, %s)", row, column),
+	).From(table).GroupBy(fmt.Sprintf("GROUPING SETS ((%s, %s), (%s), (%s), ())", row, column, row, column))
+	builder = applyArgs(builder, args)
+	statement, sargs, err := builder.ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := queryRows(ctx, db, statement, sargs...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	values := make(map[pivotCell]float64)
+	rowSet := make(map[string]bool)
+	columnSet := make(map[string]bool)
+	for rows.Next() {
+		var r, c sql.NullString
+		var value sql.NullFloat64
+		var grouping int
+		if err := rows.Scan(&r, &c, &value, &grouping); err != nil {
+			return nil, err
+		}
+		if !value.Valid {
+			continue
+		}
+		// GROUPING sets bit 1 if row is aggregated over and bit 0 for column
+		var cell pivotCell
+		if grouping&2 == 0 {
+			cell.row = nullLabel(r)
+			rowSet[cell.row] = true
+		}
+		if grouping&1 == 0 {
+			cell.column = nullLabel(c)
+			columnSet[cell.column] = true
+		}
+		values[cell] = value.Float64
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return p.result(values, sortedKeys(rowSet), sortedKeys(columnSet), query.Percent), nil
+}
+
+func nullLabel(s sql.NullString) string {
+	if !s.Valid || len(s.String) == 0 {
+		return "-"
+	}
+	return s.String
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (pivotParser) result(values map[pivotCell]float64, rowValues, columnValues []string,
+	percent string) map[string]interface{} {
+
+	format := func(cell pivotCell) string {
+		v, ok := values[cell]
+		if !ok {
+			return "-"
+		}
+		switch percent {
+		case PercentOfRow:
+			v = percentOf(v, values[pivotCell{row: cell.row}])
+		case PercentOfColumn:
+			v = percentOf(v, values[pivotCell{column: cell.column}])
+		default:
+			return formatDerived(v)
+		}
+		if math.IsNaN(v) {
+			return "-"
+		}
+		return strconv.FormatFloat(v, 'f', 2, 64)
+	}
+
+	data := make([][]string, len(rowValues))
+	for i, r := range rowValues {
+		data[i] = make([]string, len(columnValues))
+		for j, c := range columnValues {
+			data[i][j] = format(pivotCell{r, c})
+		}
+	}
+	rowTotals := make([]string, len(rowValues))
+	for i, r := range rowValues {
+		rowTotals[i] = formatDerived(values[pivotCell{row: r}])
+	}
+	columnTotals := make([]string, len(columnValues))
+	for j, c := range columnValues {
+		columnTotals[j] = formatDerived(values[pivotCell{column: c}])
+	}
+
+	return map[string]interface{}{
+		"row_values":    rowValues,
+		"column_values": columnValues,
+		"data":          data,
+		"row_totals":    rowTotals,
+		"column_totals": columnTotals,
+		"total":         formatDerived(values[pivotCell{}]),
+	}
+}
+
+// parseHeatmap adds the cells of a pivot result as [column index, row index,
+// value] points with their "min" and "max", the form heatmap charts take.
+func parseHeatmap(queryResult map[string]interface{}) {
+	data, ok := queryResult["data"].([][]string)
+	if !ok {
+		return
+	}
+	points := make([][]interface{}, 0)
+	min, max := math.Inf(1), math.Inf(-1)
+	for i, row := range data {
+		for j, s := range row {
+			v, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				continue
+			}
+			points = append(points, []interface{}{j, i, s})
+			min, max = math.Min(min, v), math.Max(max, v)
+		}
+	}
+	queryResult["points"] = points
+	if len(points) > 0 {
+		queryResult["min"] = formatDerived(min)
+		queryResult["max"] = formatDerived(max)
+	}
+}
+
+// pivotTableColumns lays a pivot result out as the columns of a table
+// figure: the row values, one column per column value and the row totals.
+// Rows are sorted by the values of the column titled sortBy, if any, and
+// cut to the page.
+func pivotTableColumns(queryResult map[string]interface{}, rowTitle string, page, limit int,
+	sortBy string) ([]map[string]interface{}, int) {
+
+	rowValues, _ := queryResult["row_values"].([]string)
+	columnValues, _ := queryResult["column_values"].([]string)
+	data, _ := queryResult["data"].([][]string)
+	rowTotals, _ := queryResult["row_totals"].([]string)
+
+	titles := append([]string{rowTitle}, columnValues...)
+	titles = append(titles, pivotTotalLabel)
+	table := make([][]string, len(rowValues))
+	for i, r := range rowValues {
+		table[i] = append([]string{r}, data[i]...)
+		table[i] = append(table[i], rowTotals[i])
+	}
+
+	for k, title := range titles {
+		if k > 0 && title == sortBy {
+			sort.SliceStable(table, func(i, j int) bool {
+				return strToFloat(table[i][k]) > strToFloat(table[j][k])
+			})
+			break
+		}
+	}
+	total := len(table)
+	if limit > 0 {
+		from := limit * (page - 1)
+		if from < 0 {
+			from = 0
+		}
+		if from > len(table) {
+			from = len(table)
+		}
+		to := from + limit
+		if to > len(table) {
+			to = len(table)
+		}
+		table = table[from:to]
+	}
+
+	columns := make([]map[string]interface{}, len(titles))
+	for k, title := range titles {
+		columnData := make([]string, len(table))
+		for i := range table {
+			columnData[i] = table[i][k]
+		}
+		columns[k] = map[string]interface{}{
+			"title":      title,
+			"sortSymbol": title,
+			"size":       "medium",
+			"data":       columnData,
+		}
+	}
+	return columns, total
+}
@@ -0,0 +1,82 @@
+package figure_parser
+
+import (
+	"reflect"
+	"testing"
+)
+
+var pivotValues = map[pivotCell]float64{
+	{"Beijing", "College"}:  30,
+	{"Beijing", "Master"}:   10,
+	{"Shanghai", "College"}: 20,
+	{row: "Beijing"}:        40,
+	{row: "Shanghai"}:       20,
+	{column: "College"}:     50,
+	{column: "Master"}:      10,
+	{}:                      60,
+}
+
+func TestPivotResult(t *testing.T) {
+	rows := []string{"Beijing", "Shanghai"}
+	columns := []string{"College", "Master"}
+	testCases := []struct {
+		percent string
+		data    [][]string
+	}{
+		{"", [][]string{{"30", "10"}, {"20", "-"}}},
+		{PercentOfRow, [][]string{{"75.00", "25.00"}, {"100.00", "-"}}},
+		{PercentOfColumn, [][]string{{"60.00", "100.00"}, {"40.00", "-"}}},
+	}
+	for i, tc := range testCases {
+		out := pivotParser{}.result(pivotValues, rows, columns, tc.percent)
+		if !reflect.DeepEqual(tc.data, out["data"]) {
+			t.Error(i, ":", "want", tc.data, "got", out["data"])
+		}
+	}
+
+	out := pivotParser{}.result(pivotValues, rows, columns, "")
+	if want := []string{"40", "20"}; !reflect.DeepEqual(want, out["row_totals"]) {
+		t.Error("want", want, "got", out["row_totals"])
+	}
+	if want := []string{"50", "10"}; !reflect.DeepEqual(want, out["column_totals"]) {
+		t.Error("want", want, "got", out["column_totals"])
+	}
+	if out["total"] != "60" {
+		t.Error("want", "60", "got", out["total"])
+	}
+}
+
+func TestParseHeatmap(t *testing.T) {
+	result := map[string]interface{}{"data": [][]string{{"30", "10"}, {"20", "-"}}}
+	parseHeatmap(result)
+	want := [][]interface{}{{0, 0, "30"}, {1, 0, "10"}, {0, 1, "20"}}
+	if !reflect.DeepEqual(want, result["points"]) {
+		t.Error("want", want, "got", result["points"])
+	}
+	if result["min"] != "10" || result["max"] != "30" {
+		t.Error("want", "10", "30", "got", result["min"], result["max"])
+	}
+}
+
+func TestPivotTableColumns(t *testing.T) {
+	result := pivotParser{}.result(pivotValues, []string{"Beijing", "Shanghai"}, []string{"College", "Master"}, "")
+	columns, total := pivotTableColumns(result, "city", 1, 1, "-")
+	if total != 2 {
+		t.Error("want", 2, "got", total)
+	}
+	titles := make([]string, len(columns))
+	for i, c := range columns {
+		titles[i] = c["title"].(string)
+	}
+	if want := []string{"city", "College", "Master", "Total"}; !reflect.DeepEqual(want, titles) {
+		t.Error("want", want, "got", titles)
+	}
+	if want := []string{"Beijing"}; !reflect.DeepEqual(want, columns[0]["data"]) {
+		t.Error("want", want, "got", columns[0]["data"])
+	}
+
+	columns, _ = pivotTableColumns(result, "city", 1, 0, "College")
+	if want := []string{"Beijing", "Shanghai"}; !reflect.DeepEqual(want, columns[0]["data"]) {
+		t.Error("want", want, "got", columns[0]["data"])
+	}
+}
@@ -1,9 +1,12 @@
 package figure_parser
 
 import (
+	"context"
 	"fmt"
+	"strings"
 
 	sq "github.com/Masterminds/squirrel"
+	"github.com/bluecover/lm/models"
 	"github.com/jinzhu/gorm"
 )
 
@@ -37,14 +40,14 @@ func (q Query) GetOffset() int {
 	return 0
 }
 
-func (q Query) Run(db *gorm.DB) (qr QueryResult, err error) {
+func (q Query) Run(ctx context.Context, db *gorm.DB) (qr QueryResult, err error) {
 	// get total count of data
-	qr.Total, err = q.getTotalCount(db)
+	qr.Total, err = q.getTotalCount(ctx, db)
 	if err != nil {
 		return
 	}
 
-	sql := sq.Select(q.Columns...).From(quoteString(q.Table))
+	sql := sq.Select(q.Columns...).From(models.QuoteIdentifier(q.Table))
 	for _, w := range q.Where {
 		sql = sql.Where(w)
 	}
@@ -62,7 +65,7 @@ func (q Query) Run(db *gorm.DB) (qr QueryResult, err error) {
 		return
 	}
 
-	rows, err := db.Raw(raw, args...).Rows()
+	rows, err := queryRows(ctx, db, raw, args...)
 	if err != nil {
 		return
 	}
@@ -85,11 +88,12 @@ func (q Query) Run(db *gorm.DB) (qr QueryResult, err error) {
 		}
 		qr.Data = append(qr.Data, tableRow)
 	}
+	err = rows.Err()
 	return
 }
 
-func (q Query) getTotalCount(db *gorm.DB) (total int, err error) {
-	sql := sq.Select("count(*) AS cnt").From(quoteString(q.Table))
+func (q Query) getTotalCount(ctx context.Context, db *gorm.DB) (total int, err error) {
+	sql := sq.Select("count(*) AS cnt").From(models.QuoteIdentifier(q.Table))
 	for _, w := range q.Where {
 		sql = sql.Where(w)
 	}
@@ -99,28 +103,37 @@ func (q Query) getTotalCount(db *gorm.DB) (total int, err error) {
 		return
 	}
 
-	type R struct {
-		Cnt int
-	}
-
-	r := R{}
-	err = db.Raw(raw, args...).Scan(&r).Error
-	total = r.Cnt
+	err = rawScan(ctx, db, raw, args, &total)
 	return
 }
 
-func quoteString(s string) string {
-	return fmt.Sprintf(`"%s"`, s)
-}
+// NewQuery builds the query of a table figure. Its columns are parsed as
+// expressions and orderBy must be a column, optionally followed by ASC or
+// DESC, so neither the figure nor the request can inject SQL. Both must only
+// refer to the given columns of the table.
+func NewQuery(figure *FigureSpec, args ParseArgs, page, limit int, orderBy string,
+	columns []string) (q Query, err error) {
 
-func NewQuery(figure map[string]interface{}, args ParseArgs, page, limit int, orderBy string) (q Query) {
-	q.Table = figure["table"].(string)
-	if c, ok := figure["columns"].([]interface{}); ok {
-		for _, i := range c {
-			if s, ok := i.(string); ok {
-				q.Columns = append(q.Columns, s)
+	known := make(map[string]bool, len(columns))
+	for _, c := range columns {
+		known[c] = true
+	}
+	var errs ValidationErrors
+	q.Table = figure.Table
+	for i, c := range figure.Columns {
+		e, err := parseSQLExpr(c)
+		if err != nil {
+			return q, err
+		}
+		for _, col := range e.Columns() {
+			if !known[col] {
+				errs.add(joinPath(rootPath, "columns"+indexPath(i)), "column %s does not exist in table %s", col, q.Table)
 			}
 		}
+		q.Columns = append(q.Columns, e.SQL())
+	}
+	if err := errs.orNil(); err != nil {
+		return q, err
 	}
 	if len(q.Columns) == 0 {
 		q.Columns = append(q.Columns, "*")
@@ -129,6 +142,36 @@ func NewQuery(figure map[string]interface{}, args ParseArgs, page, limit int, or
 	q.Where = append(q.Where, sq.Eq{"period": args.Period})
 	q.Limit = limit
 	q.Page = page
-	q.OrderBy = append(q.OrderBy, orderBy)
+	if len(orderBy) > 0 {
+		o, col, err := orderByColumn(orderBy)
+		if err != nil {
+			return q, err
+		}
+		if !known[col] {
+			return q, fmt.Errorf("can not order by %s, it does not exist in table %s", col, q.Table)
+		}
+		q.OrderBy = append(q.OrderBy, o)
+	}
 	return
 }
+
+// orderByColumn renders "column [ASC|DESC]" as an ORDER BY term and returns
+// the column it orders by
+func orderByColumn(s string) (string, string, error) {
+	s = strings.TrimSpace(s)
+	direction := ""
+	for _, d := range []string{"ASC", "DESC"} {
+		if n := len(s) - len(d) - 1; n > 0 && strings.EqualFold(s[n:], " "+d) {
+			s, direction = strings.TrimSpace(s[:n]), " "+d
+			break
+		}
+	}
+	e, err := parseSQLExpr(s)
+	if err != nil {
+		return "", "", err
+	}
+	if e.kind != "column" {
+		return "", "", fmt.Errorf("can not order by %q", s)
+	}
+	return e.SQL() + direction, e.Columns()[0], nil
+}
@@ -1,26 +1,27 @@
 package figure_parser
 
 import (
-	"fmt"
-	"math"
+	"context"
+	"errors"
 	"time"
 
 	sq "github.com/Masterminds/squirrel"
 	"github.com/bluecover/lm/business/timing"
-	"github.com/bluecover/lm/util"
+	"github.com/bluecover/lm/models"
 	"github.com/jinzhu/gorm"
 	gota "github.com/kniren/gota/dataframe"
 	"github.com/kniren/gota/series"
 	"github.com/sirupsen/logrus"
-	"github.com/spf13/cast"
 )
 
 // Period text const
 const (
-	PeriodDate    = "date"
-	PeriodMonth   = "month"
-	PeriodQuarter = "quarter"
-	PeriodYear    = "year"
+	PeriodDate     = "date"
+	PeriodWeek     = "week"
+	PeriodMonth    = "month"
+	PeriodQuarter  = "quarter"
+	PeriodHalfYear = "half_year"
+	PeriodYear     = "year"
 
 	TimeFormat       = "2006-01-02 15:04:05"
 	ResultTimeFormat = "2006/01/02"
@@ -28,57 +29,77 @@ const (
 
 // QueryParser defines a common data query interface
 type QueryParser interface {
-	Parse(query map[string]interface{}, args ParseArgs, db *gorm.DB) (map[string]interface{}, error)
+	Parse(ctx context.Context, query QuerySpec, args ParseArgs, db *gorm.DB) (map[string]interface{}, error)
 }
 
-func newParser(qtype string) (QueryParser, error) {
-	switch qtype {
-	case "element":
-		return elementParser{}, nil
-	case "select_column":
-		return selectColumnParser{}, nil
-	case "aggregate":
-		return aggregateParser{}, nil
-	case "period_series":
-		return periodSeriesParser{}, nil
-	case "xox":
-		return xoxParser{}, nil
-	case "distinct":
-		return distinctParser{}, nil
-	default:
-		return nil, fmt.Errorf("unknow parser type: %s", qtype)
-	}
-}
-
-func adaptSetFilters(filters []map[string]interface{}) func(sq.SelectBuilder) sq.SelectBuilder {
+func adaptSetFilters(filters []Filter) func(sq.SelectBuilder) sq.SelectBuilder {
 	return func(sb sq.SelectBuilder) sq.SelectBuilder {
 		return SetFilters(sb, filters)
 	}
 }
 
 // ParseQuery passes args required to the parser and parse
-func ParseQuery(query map[string]interface{}, args ParseArgs, db *gorm.DB) (map[string]interface{}, error) {
-	parser, err := newParser(query["type"].(string))
+func ParseQuery(ctx context.Context, query QuerySpec, args ParseArgs, db *gorm.DB) (map[string]interface{}, error) {
+	ctx, qt := traceQuery(ctx, query)
+	result, err := parseQuery(ctx, query, args, db)
+	qt.finish(err)
+	return result, err
+}
+
+func parseQuery(ctx context.Context, query QuerySpec, args ParseArgs, db *gorm.DB) (map[string]interface{}, error) {
+	if err := query.Validate(); err != nil {
+		return nil, err
+	}
+	parser, err := newParser(query.Type)
 	if err != nil {
 		return nil, err
 	}
+	tables := query.SourceTables()
+	if len(tables) > 0 {
+		// the query's own filters apply on top of those of the request,
+		// which do not restrict the values listed by distinct
+		filters := append([]Filter{}, query.Filters...)
+		if query.Type != "distinct" {
+			filters = append(filters, args.Filters...)
+		}
+		var compiled QuerySpec
+		for _, table := range tables {
+			columns, err := columnsOfTable(table, db)
+			if err != nil {
+				return nil, err
+			}
+			compiled = query
+			compiled.Table = table
+			if err := compileSQL(&compiled, columns); err != nil {
+				return nil, err
+			}
+			if err := checkFilterKeys(filters, table, columns); err != nil {
+				return nil, err
+			}
+		}
+		compiled.Table = query.Table
+		query = compiled
+		args.Filters = filters
+		if args.Calendar, err = calendarOfTables(query, tables, db); err != nil {
+			return nil, err
+		}
+	}
 
-	if p, ok := query["period"]; ok {
-		args.Period = p.(string)
+	if len(query.Period) > 0 {
+		args.Period = query.Period
 	}
 
 	var beginningTime, endTime time.Time
 
-	minTimeOfTable, maxTimeOfTable, err := timing.GetDateRangeOfTable(
-		query["table"].(string), args.Period, db, adaptSetFilters(args.Filters))
+	minTimeOfTable, maxTimeOfTable, err := dateRangeOfTables(ctx, tables, args.Period, args.Filters, db)
 	if err == nil {
-		beginningTime, endTime = timing.AlignPeriodRange(time.Time{}, maxTimeOfTable, args.Period)
+		beginningTime, endTime = args.Calendar.AlignPeriodRange(time.Time{}, maxTimeOfTable, args.Period)
 	} else {
 		logrus.Error("GetDateRangeOfTable error", err)
 	}
 
 	if minTimeOfTable.After(beginningTime) {
-		beginningTime = timing.BeginningOfPeriod(minTimeOfTable, args.Period)
+		beginningTime = args.Calendar.BeginningOfPeriod(minTimeOfTable, args.Period)
 	}
 
 	if args.Start.IsZero() || args.Start.Before(beginningTime) {
@@ -87,14 +108,51 @@ func ParseQuery(query map[string]interface{}, args ParseArgs, db *gorm.DB) (map[
 	if args.End.IsZero() || args.End.After(endTime) {
 		args.End = endTime
 	}
+	if args.Calendar.IsFiscal() && !args.Start.IsZero() && !args.End.IsZero() {
+		// requests are aligned to calendar years, fiscal periods start elsewhere
+		args.Start, args.End = args.Calendar.AlignPeriodRange(args.Start, args.End, args.Period)
+	}
 
-	return parser.Parse(query, args, db)
+	queryTraceFrom(ctx).setArgs(args)
+	result, err := cachedParse(ctx, parser, query, args, db)
+	if err != nil {
+		return nil, timeoutError(ctx, err)
+	}
+	if err := applyTransforms(result, query.Transforms, query.Type == "period_series"); err != nil {
+		return nil, err
+	}
+	if err := applyAnomaly(result, query.Anomaly, args.Period); err != nil {
+		return nil, err
+	}
+	return result, nil
 }
 
-func createPeriodRange(start time.Time, end time.Time, period string) []string {
+// dateRangeOfTables returns the earliest and the latest date of the tables
+func dateRangeOfTables(ctx context.Context, tables []string, period string, filters []Filter,
+	db *gorm.DB) (min time.Time, max time.Time, err error) {
+
+	if len(tables) == 0 {
+		return min, max, errors.New("query reads no table")
+	}
+	for i, table := range tables {
+		from, to, err := DateRangeOfTable(ctx, table, period, filters, db)
+		if err != nil {
+			return min, max, err
+		}
+		if i == 0 || from.Before(min) {
+			min = from
+		}
+		if i == 0 || to.After(max) {
+			max = to
+		}
+	}
+	return min, max, nil
+}
+
+func createPeriodRange(cal timing.Calendar, start time.Time, end time.Time, period string) []string {
 	prange := make([]string, 0)
-	for d := start; d.Before(end) || d == end; d = timing.Forward(d, period) {
-		prange = append(prange, timing.FormatTime(d, period))
+	for d := start; d.Before(end) || d == end; d = cal.Forward(d, period) {
+		prange = append(prange, cal.FormatTime(d, period))
 	}
 	return prange
 }
@@ -113,16 +171,17 @@ func applyArgs(b sq.SelectBuilder, args ParseArgs) sq.SelectBuilder {
 
 type distinctParser struct{}
 
-func (distinctParser) Parse(query map[string]interface{}, args ParseArgs,
+func (distinctParser) Parse(ctx context.Context, query QuerySpec, args ParseArgs,
 	db *gorm.DB) (map[string]interface{}, error) {
 
-	table := fmt.Sprintf(`"%s"`, query["table"].(string))
-	column := query["column"].(string)
+	table := models.QuoteIdentifier(query.Table)
+	column := query.Column
 
 	builder := sq.Select("distinct " + column + " as column").From(table)
+	builder = SetFilters(builder, query.Filters)
 	statement, sargs, err := builder.ToSql()
 
-	rows, err := db.Raw(statement, sargs...).Rows()
+	rows, err := queryRows(ctx, db, statement, sargs...)
 	if err != nil {
 		return nil, err
 	}
@@ -137,27 +196,30 @@ func (distinctParser) Parse(query map[string]interface{}, args ParseArgs,
 		}
 		results = append(results, value)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
 	return map[string]interface{}{"data": results}, nil
 }
 
 type elementParser struct{}
 
 // Parse implement QueryParser.Parse
-func (elementParser) Parse(query map[string]interface{}, args ParseArgs,
+func (elementParser) Parse(ctx context.Context, query QuerySpec, args ParseArgs,
 	db *gorm.DB) (map[string]interface{}, error) {
 
-	if one, ok := query["one"].(bool); ok && one {
-		args.Start = timing.BeginningOfPeriod(args.End, args.Period)
+	if query.One {
+		args.Start = args.Calendar.BeginningOfPeriod(args.End, args.Period)
 	}
 
-	table := fmt.Sprintf(`"%s"`, query["table"].(string))
-	function := query["function"].(string)
+	table := models.QuoteIdentifier(query.Table)
+	function := query.Function
 
 	builder := sq.Select(function).From(table)
 	builder = applyArgs(builder, args)
 	statement, sargs, err := builder.ToSql()
 
-	rows, err := db.Raw(statement, sargs...).Rows()
+	rows, err := queryRows(ctx, db, statement, sargs...)
 	if err != nil {
 		return nil, err
 	}
@@ -167,6 +229,9 @@ func (elementParser) Parse(query map[string]interface{}, args ParseArgs,
 	for rows.Next() {
 		rows.Scan(&v)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
 	if len(v) == 0 {
 		return map[string]interface{}{"data": nil}, nil
 	} else {
@@ -177,17 +242,17 @@ func (elementParser) Parse(query map[string]interface{}, args ParseArgs,
 type selectColumnParser struct{}
 
 // Parse implement QueryParser.Parse
-func (selectColumnParser) Parse(query map[string]interface{}, args ParseArgs,
+func (selectColumnParser) Parse(ctx context.Context, query QuerySpec, args ParseArgs,
 	db *gorm.DB) (map[string]interface{}, error) {
 
-	table := fmt.Sprintf(`"%s"`, query["table"].(string))
-	column := query["column"].(string)
+	table := models.QuoteIdentifier(query.Table)
+	column := query.Column
 
 	builder := sq.Select("date", column+" as column").From(table).OrderBy("date ASC")
 	builder = applyArgs(builder, args)
 	statement, sargs, err := builder.ToSql()
 
-	rows, err := db.Raw(statement, sargs...).Rows()
+	rows, err := queryRows(ctx, db, statement, sargs...)
 	if err != nil {
 		return nil, err
 	}
@@ -205,17 +270,23 @@ func (selectColumnParser) Parse(query map[string]interface{}, args ParseArgs,
 		if err != nil {
 			continue
 		}
-		records = append(records, R{Date: timing.FormatTime(date, args.Period), Column: column})
+		records = append(records, R{Date: args.Calendar.FormatTime(date, args.Period), Column: column})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
 	}
 
 	df := gota.LoadStructs(records)
-	periodRange := createPeriodRange(args.Start, args.End, args.Period)
+	periodRange := createPeriodRange(args.Calendar, args.Start, args.End, args.Period)
 
 	if df.Err != nil {
 		resultData := make([]string, len(periodRange))
+		filled := make([]int, len(periodRange))
 		for i := range periodRange {
 			resultData[i] = "0"
+			filled[i] = i
 		}
+		traceGaps(ctx, "", "0", periodRange, filled)
 		return map[string]interface{}{
 			"date_range": periodRange,
 			"data":       resultData,
@@ -224,12 +295,11 @@ func (selectColumnParser) Parse(query map[string]interface{}, args ParseArgs,
 
 	dfDateOnly := gota.New(series.New(periodRange, series.String, "Date"))
 	dateJoinedColumn := dfDateOnly.LeftJoin(df, "Date").Col("Column").Records()
-	replaceNaN(dateJoinedColumn, "-")
+	traceGaps(ctx, "", "-", periodRange, replaceNaN(dateJoinedColumn, "-"))
 
 	var resultData interface{} = dateJoinedColumn
 
-	_, ok := query["raise_dimension"]
-	if ok {
+	if query.RaiseDimension {
 		dim2data := make([][]string, 0)
 		dim2data = append(dim2data, dateJoinedColumn)
 		resultData = dim2data
@@ -244,18 +314,18 @@ func (selectColumnParser) Parse(query map[string]interface{}, args ParseArgs,
 type aggregateParser struct{}
 
 // Parse implement QueryParser.Parse
-func (aggregateParser) Parse(query map[string]interface{}, args ParseArgs,
+func (aggregateParser) Parse(ctx context.Context, query QuerySpec, args ParseArgs,
 	db *gorm.DB) (map[string]interface{}, error) {
 
-	table := fmt.Sprintf(`"%s"`, query["table"].(string))
-	group := query["group_key"].(string)
-	function := query["function"].(string)
+	table := models.QuoteIdentifier(query.Table)
+	group := query.GroupKey
+	function := query.Function
 
 	builder := sq.Select("date", group, function).From(table).GroupBy("date", group).OrderBy("date ASC")
 	builder = applyArgs(builder, args)
 	statement, sargs, err := builder.ToSql()
 
-	rows, err := db.Raw(statement, sargs...).Rows()
+	rows, err := queryRows(ctx, db, statement, sargs...)
 	if err != nil {
 		return nil, err
 	}
@@ -278,11 +348,14 @@ func (aggregateParser) Parse(query map[string]interface{}, args ParseArgs,
 			continue
 		}
 		groupValueSet[key] = true
-		records = append(records, R{Date: timing.FormatTime(date, args.Period), Key: key, Value: value})
+		records = append(records, R{Date: args.Calendar.FormatTime(date, args.Period), Key: key, Value: value})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
 	}
 
 	df := gota.LoadStructs(records)
-	periodRange := createPeriodRange(args.Start, args.End, args.Period)
+	periodRange := createPeriodRange(args.Calendar, args.Start, args.End, args.Period)
 	dfDateOnly := gota.New(series.New(periodRange, series.String, "Date"))
 
 	groupValueList := make([]string, 0)
@@ -290,10 +363,11 @@ func (aggregateParser) Parse(query map[string]interface{}, args ParseArgs,
 	for value := range groupValueSet {
 		column := df.Filter(gota.F{Colname: "Key", Comparator: series.Eq, Comparando: value})
 		dateJoinedColumn := dfDateOnly.LeftJoin(column, "Date").Col("Value").Records()
-		replaceNaN(dateJoinedColumn, "-")
+		traceGaps(ctx, value, "-", periodRange, replaceNaN(dateJoinedColumn, "-"))
 		resultData = append(resultData, dateJoinedColumn)
 		groupValueList = append(groupValueList, value)
 	}
+	groupValueList, resultData = foldTopN(groupValueList, resultData, query.TopN, query.OtherLabel)
 
 	return map[string]interface{}{
 		"date_range":   periodRange,
@@ -305,17 +379,17 @@ func (aggregateParser) Parse(query map[string]interface{}, args ParseArgs,
 type periodSeriesParser struct{}
 
 // Parse implement QueryParser.Parse
-func (periodSeriesParser) Parse(query map[string]interface{}, args ParseArgs,
+func (periodSeriesParser) Parse(ctx context.Context, query QuerySpec, args ParseArgs,
 	db *gorm.DB) (map[string]interface{}, error) {
 
-	table := fmt.Sprintf(`"%s"`, query["table"].(string))
-	column := query["column"].(string)
+	table := models.QuoteIdentifier(query.Table)
+	column := query.Column
 
 	builder := sq.Select("date", column+" as column").From(table).OrderBy("date ASC")
 	builder = applyArgs(builder, args)
 	statement, sargs, err := builder.ToSql()
 
-	rows, err := db.Raw(statement, sargs...).Rows()
+	rows, err := queryRows(ctx, db, statement, sargs...)
 	if err != nil {
 		return nil, err
 	}
@@ -335,9 +409,12 @@ func (periodSeriesParser) Parse(query map[string]interface{}, args ParseArgs,
 		}
 		records = append(records, R{Date: date.Format(ResultTimeFormat), Column: column})
 	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
 
 	df := gota.LoadStructs(records)
-	periodRange := createPeriodRange(args.Start, args.End, args.Period)
+	periodRange := createPeriodRange(args.Calendar, args.Start, args.End, args.Period)
 	dfDateOnly := gota.New(series.New(periodRange, series.String, "Date"))
 	dfDateJoined := dfDateOnly.LeftJoin(df, "Date")
 
@@ -356,99 +433,14 @@ func (periodSeriesParser) Parse(query map[string]interface{}, args ParseArgs,
 	}, nil
 }
 
-type xoxParser struct{}
-
-func xoxName(period string) string {
-	switch period {
-	case PeriodDate:
-		return "Day-on-Day"
-	case PeriodMonth:
-		return "Month-on-Month"
-	case PeriodQuarter:
-		return "Quarter-on-Quarter"
-	case PeriodYear:
-		return "Year-on-Year"
-	default:
-		return ""
-	}
-}
-
-// Parse implement QueryParser.Parse
-func (p xoxParser) Parse(query map[string]interface{}, args ParseArgs,
-	db *gorm.DB) (map[string]interface{}, error) {
-	periodLevel := 0
-	periodLevelf, ok := query["periodLevel"].(float64)
-	if ok {
-		periodLevel = int(periodLevelf)
-	}
-
-	xPeriod := args.Period
-	if periodLevel == 1 {
-		xPeriod = timing.NextPeriodLevel(xPeriod)
-	}
-
-	periodInQuery, ok := query["period"]
-	if ok {
-		xPeriod = periodInQuery.(string)
-	}
-
-	currentDate := timing.BeginningOfPeriod(args.End, xPeriod)
-	args1 := ParseArgs{
-		Start:  currentDate,
-		End:    currentDate,
-		Period: xPeriod,
-	}
-
-	r1, err := elementParser{}.Parse(query, args1, db)
-	if err != nil {
-		return nil, err
-	}
-	if r1["data"] == nil {
-		return p.naResult(xPeriod), nil
-	}
-	current := cast.ToFloat64(r1["data"])
-
-	prevDate := timing.Backward(currentDate, xPeriod)
-	args2 := ParseArgs{
-		Start:  prevDate,
-		End:    prevDate,
-		Period: xPeriod,
-	}
-	r2, err := elementParser{}.Parse(query, args2, db)
-	if err != nil {
-		return nil, err
-	}
-	if r2["data"] == nil {
-		return p.naResult(xPeriod), nil
-	}
-	prev := cast.ToFloat64(r2["data"])
-
-	var change float64
-	if prev == 0.0 || math.IsNaN(prev) {
-		change = 0.0
-	} else {
-		change = (current - prev) / prev * 100
-	}
-
-	return map[string]interface{}{
-		"inc_or_dec": util.CMPFloat(current, prev),
-		"change":     fmt.Sprintf("%.2f%%", change),
-		"name":       xoxName(xPeriod),
-	}, nil
-}
-
-func (xoxParser) naResult(period string) map[string]interface{} {
-	return map[string]interface{}{
-		"inc_or_dec": 1,
-		"change":     "N/A",
-		"name":       xoxName(period),
-	}
-}
-
-func replaceNaN(s []string, r string) {
+// replaceNaN replaces the "NaN" of s by r and returns their indexes
+func replaceNaN(s []string, r string) []int {
+	replaced := make([]int, 0)
 	for i, v := range s {
 		if v == "NaN" {
 			s[i] = r
+			replaced = append(replaced, i)
 		}
 	}
+	return replaced
 }
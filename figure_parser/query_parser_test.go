@@ -0,0 +1,74 @@
+package figure_parser
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bluecover/lm/business/timing"
+)
+
+func TestCreatePeriodRange(t *testing.T) {
+	testCases := []struct {
+		cal        timing.Calendar
+		start, end time.Time
+		period     string
+		out        []string
+	}{
+		{
+			timing.Calendar{},
+			time.Date(2018, 12, 26, 0, 0, 0, 0, time.UTC),
+			time.Date(2019, 1, 9, 0, 0, 0, 0, time.UTC),
+			PeriodWeek,
+			[]string{"2018/W52", "2019/W01", "2019/W02"},
+		},
+		{
+			timing.Calendar{},
+			time.Date(2020, 12, 30, 0, 0, 0, 0, time.UTC),
+			time.Date(2021, 1, 4, 0, 0, 0, 0, time.UTC),
+			PeriodWeek,
+			[]string{"2020/W53", "2021/W01"},
+		},
+		{
+			timing.Calendar{},
+			time.Date(2017, 8, 1, 0, 0, 0, 0, time.UTC),
+			time.Date(2018, 7, 1, 0, 0, 0, 0, time.UTC),
+			PeriodHalfYear,
+			[]string{"2017/H2", "2018/H1", "2018/H2"},
+		},
+		{
+			timing.NewCalendar(4),
+			time.Date(2017, 5, 10, 0, 0, 0, 0, time.UTC),
+			time.Date(2018, 2, 1, 0, 0, 0, 0, time.UTC),
+			PeriodQuarter,
+			[]string{"FY2018 Q1", "FY2018 Q2", "FY2018 Q3", "FY2018 Q4"},
+		},
+		{
+			timing.NewCalendar(7),
+			time.Date(2016, 8, 1, 0, 0, 0, 0, time.UTC),
+			time.Date(2018, 7, 1, 0, 0, 0, 0, time.UTC),
+			PeriodYear,
+			[]string{"FY2017", "FY2018", "FY2019"},
+		},
+		{
+			timing.NewCalendar(2),
+			time.Date(2018, 1, 15, 0, 0, 0, 0, time.UTC),
+			time.Date(2018, 8, 1, 0, 0, 0, 0, time.UTC),
+			PeriodHalfYear,
+			[]string{"FY2018 H2", "FY2019 H1", "FY2019 H2"},
+		},
+		{
+			timing.NewCalendar(4),
+			time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC),
+			time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC),
+			PeriodMonth,
+			[]string{"2018/01", "2018/02", "2018/03"},
+		},
+	}
+	for i, tc := range testCases {
+		start, end := tc.cal.AlignPeriodRange(tc.start, tc.end, tc.period)
+		if out := createPeriodRange(tc.cal, start, end, tc.period); !reflect.DeepEqual(out, tc.out) {
+			t.Error(i, ":", "want", tc.out, "got", out)
+		}
+	}
+}
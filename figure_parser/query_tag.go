@@ -0,0 +1,191 @@
+package figure_parser
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// tagFallbackSep separates a query tag from the value used when its path
+// does not resolve, e.g. "#query.A.data[0] ?? 0"
+const tagFallbackSep = "??"
+
+// tagStep is one step of the path of a query tag: a key, an index or a slice.
+// Negative indexes and slice bounds count from the end.
+type tagStep struct {
+	text     string
+	key      string
+	isKey    bool
+	index    int
+	isSlice  bool
+	from, to *int
+}
+
+// tagPath is a parsed query tag. Its steps walk the query results, e.g.
+// "#query.A.data[0]", "#query.data[-1]", "#query.A.data[1][2:]" or
+// "#query.A.stats.max ?? -". A fallback after "??" is read as JSON, or as
+// a string if it is not JSON.
+type tagPath struct {
+	steps       []tagStep
+	fallback    interface{}
+	hasFallback bool
+}
+
+// parseQueryTag parses a tag of the form "#query.key[index][from:to] ?? fallback"
+func parseQueryTag(tag string) (tagPath, error) {
+	var p tagPath
+	s := tag
+	if i := strings.Index(s, tagFallbackSep); i >= 0 {
+		p.hasFallback = true
+		raw := strings.TrimSpace(s[i+len(tagFallbackSep):])
+		if err := json.Unmarshal([]byte(raw), &p.fallback); err != nil {
+			p.fallback = raw
+		}
+		s = strings.TrimSpace(s[:i])
+	}
+	if !strings.HasPrefix(s, queryKey) {
+		return p, fmt.Errorf("must start with %s", queryKey)
+	}
+
+	for rest := s[len(queryKey):]; len(rest) > 0; {
+		switch rest[0] {
+		case '.':
+			end := strings.IndexAny(rest[1:], ".[")
+			if end < 0 {
+				end = len(rest) - 1
+			}
+			key := rest[1 : end+1]
+			if len(key) == 0 || strings.ContainsAny(key, "] \t") {
+				return p, fmt.Errorf("malformed key at %q", rest)
+			}
+			p.steps = append(p.steps, tagStep{text: rest[:end+1], key: key, isKey: true})
+			rest = rest[end+1:]
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return p, fmt.Errorf("unclosed [ at %q", rest)
+			}
+			step, err := parseTagIndex(rest[1:end])
+			if err != nil {
+				return p, err
+			}
+			step.text = rest[:end+1]
+			p.steps = append(p.steps, step)
+			rest = rest[end+1:]
+		default:
+			return p, fmt.Errorf("unexpected %q", rest)
+		}
+	}
+	if len(p.steps) == 0 || !p.steps[0].isKey {
+		return p, fmt.Errorf("must start with %s.<name>", queryKey)
+	}
+	return p, nil
+}
+
+func parseTagIndex(s string) (tagStep, error) {
+	bound := func(b string) (*int, error) {
+		if b = strings.TrimSpace(b); len(b) == 0 {
+			return nil, nil
+		}
+		i, err := strconv.Atoi(b)
+		if err != nil {
+			return nil, fmt.Errorf("invalid index %q", b)
+		}
+		return &i, nil
+	}
+
+	if i := strings.IndexByte(s, ':'); i >= 0 {
+		from, err := bound(s[:i])
+		if err != nil {
+			return tagStep{}, err
+		}
+		to, err := bound(s[i+1:])
+		if err != nil {
+			return tagStep{}, err
+		}
+		return tagStep{isSlice: true, from: from, to: to}, nil
+	}
+	index, err := bound(s)
+	if err != nil {
+		return tagStep{}, err
+	}
+	if index == nil {
+		return tagStep{}, fmt.Errorf("empty index")
+	}
+	return tagStep{index: *index}, nil
+}
+
+// name returns the first key of the path, the query of a named set or the
+// result field of a single query
+func (p tagPath) name() string {
+	return p.steps[0].key
+}
+
+// resolve walks the path through the query results
+func (p tagPath) resolve(results map[string]interface{}) (interface{}, error) {
+	var v interface{} = results
+	at := queryKey
+	for _, step := range p.steps {
+		rv := reflect.ValueOf(v)
+		switch {
+		case step.isKey:
+			if rv.Kind() != reflect.Map || rv.Type().Key().Kind() != reflect.String {
+				return nil, fmt.Errorf("%s is not an object", at)
+			}
+			e := rv.MapIndex(reflect.ValueOf(step.key).Convert(rv.Type().Key()))
+			if !e.IsValid() {
+				return nil, fmt.Errorf("%s has no key %q", at, step.key)
+			}
+			v = e.Interface()
+
+		case step.isSlice:
+			if rv.Kind() != reflect.Slice {
+				return nil, fmt.Errorf("%s is not an array", at)
+			}
+			n := rv.Len()
+			from, to := 0, n
+			if step.from != nil {
+				from = clampIndex(*step.from, n)
+			}
+			if step.to != nil {
+				to = clampIndex(*step.to, n)
+			}
+			if to < from {
+				to = from
+			}
+			v = rv.Slice(from, to).Interface()
+
+		default:
+			if rv.Kind() != reflect.Slice {
+				return nil, fmt.Errorf("%s is not an array", at)
+			}
+			i := step.index
+			if i < 0 {
+				i += rv.Len()
+			}
+			if i < 0 || i >= rv.Len() {
+				return nil, fmt.Errorf("%s has no index %d", at, step.index)
+			}
+			v = rv.Index(i).Interface()
+		}
+		at += step.text
+	}
+	return v, nil
+}
+
+// clampIndex returns a slice bound within [0, n], counting negative ones
+// from the end
+func clampIndex(i int, n int) int {
+	if i < 0 {
+		i += n
+	}
+	if i < 0 {
+		return 0
+	}
+	if i > n {
+		return n
+	}
+	return i
+}
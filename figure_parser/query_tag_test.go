@@ -0,0 +1,130 @@
+package figure_parser
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestResolveQueryTag(t *testing.T) {
+	results := map[string]interface{}{
+		"A": map[string]interface{}{
+			"data":       [][]string{{"1", "2", "3"}, {"4", "5", "6"}},
+			"date_range": []string{"2018/01", "2018/02", "2018/03"},
+			"stats":      map[string]string{"max": "6"},
+			"total":      nil,
+		},
+		"B": "12",
+	}
+	testCases := []struct {
+		tag string
+		out interface{}
+	}{
+		{"#query.A.data[0]", []string{"1", "2", "3"}},
+		{"#query.A.data[1][-1]", "6"},
+		{"#query.A.data[0][1:]", []string{"2", "3"}},
+		{"#query.A.date_range[:-1]", []string{"2018/01", "2018/02"}},
+		{"#query.A.date_range[5:]", []string{}},
+		{"#query.A.stats.max", "6"},
+		{"#query.A.total", nil},
+		{"#query.B", "12"},
+		{"#query.A.data[9] ?? -", "-"},
+		{"#query.A.missing ?? 0", 0.0},
+		{"#query.A.missing ?? []", []interface{}{}},
+		{`#query.B.x ?? "n/a"`, "n/a"},
+	}
+
+	for i, tc := range testCases {
+		p, err := parseQueryTag(tc.tag)
+		if err != nil {
+			t.Error(i, ":", err)
+			continue
+		}
+		out, err := p.resolve(results)
+		if err != nil {
+			if !p.hasFallback {
+				t.Error(i, ":", err)
+				continue
+			}
+			out = p.fallback
+		}
+		if !reflect.DeepEqual(tc.out, out) {
+			t.Error(i, ":", "want", tc.out, "got", out)
+		}
+	}
+}
+
+func TestResolveQueryTagErrors(t *testing.T) {
+	results := map[string]interface{}{
+		"A": map[string]interface{}{"data": []string{"1"}, "total": nil},
+		"B": "12",
+	}
+	testCases := []struct {
+		tag string
+		err string
+	}{
+		{"#query.C", `#query has no key "C"`},
+		{"#query.A.data[1]", "#query.A.data has no index 1"},
+		{"#query.B.data", "#query.B is not an object"},
+		{"#query.A[0]", "#query.A is not an array"},
+		{"#query.A.total.x", "#query.A.total is not an object"},
+	}
+
+	for i, tc := range testCases {
+		p, err := parseQueryTag(tc.tag)
+		if err != nil {
+			t.Error(i, ":", err)
+			continue
+		}
+		if _, err := p.resolve(results); err == nil || err.Error() != tc.err {
+			t.Error(i, ":", "want", tc.err, "got", err)
+		}
+	}
+}
+
+func TestParseQueryTagMalformed(t *testing.T) {
+	testCases := []string{
+		"#query",
+		"#fff",
+		"#query.",
+		"#query.A..data",
+		"#query[0]",
+		"#query.A.data[x]",
+		"#query.A.data[0",
+		"#query.A.data[]",
+	}
+
+	for i, tag := range testCases {
+		if _, err := parseQueryTag(tag); err == nil {
+			t.Error(i, ":", "want error for", tag)
+		}
+	}
+}
+
+func TestReplaceQueryTags(t *testing.T) {
+	root := map[string]interface{}{
+		"xAxis":  "#query.A.date_range",
+		"series": []interface{}{"#query.A.data[0]", "#query.A.data[5]", "#query.B ?? 0"},
+		"label":  "#query.A.name",
+	}
+	results := map[string]interface{}{
+		"A": map[string]interface{}{"date_range": []string{"2018/01"}, "data": []string{"1234"}},
+	}
+	tags := make([]QueryTag, 0)
+	findQueryTagsInMap(root, rootPath, &tags)
+	err := replaceQueryTags(tags, results, func(string) NumberFormat { return NumberFormat{} })
+
+	want := ValidationErrors{
+		{"$.label", `query tag "#query.A.name" does not resolve: #query.A has no key "name"`},
+		{"$.series[1]", `query tag "#query.A.data[5]" does not resolve: #query.A.data has no index 5`},
+	}
+	if !reflect.DeepEqual(want, err) {
+		t.Error("want", want, "got", err)
+	}
+	series := []interface{}{"1,234", "#query.A.data[5]", 0.0}
+	if !reflect.DeepEqual(series, root["series"]) {
+		t.Error("want", series, "got", root["series"])
+	}
+	if !reflect.DeepEqual([]string{"2018/01"}, root["xAxis"]) {
+		t.Error("want", []string{"2018/01"}, "got", root["xAxis"])
+	}
+}
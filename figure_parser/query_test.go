@@ -0,0 +1,54 @@
+package figure_parser
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNewQuery(t *testing.T) {
+	columns := []string{"date", "period", "city", "adr", "occ"}
+	testCases := []struct {
+		figure  string
+		orderBy string
+		columns []string
+		err     error
+	}{
+		{
+			`{"id": "t", "type": "table", "table": "HTHT.hotel", "columns": ["date", "City", "adr * occ"]}`,
+			"date desc",
+			[]string{`"date"`, `"city"`, `("adr" * "occ")`},
+			nil,
+		},
+		{
+			`{"id": "t", "type": "table", "table": "HTHT.hotel", "columns": ["date", "revpar / occ"]}`,
+			"date",
+			nil,
+			ValidationErrors{{"$.columns[1]", "column revpar does not exist in table HTHT.hotel"}},
+		},
+	}
+
+	for i, tc := range testCases {
+		figure, _ := DecodeFigure([]byte(tc.figure))
+		q, err := NewQuery(figure, ParseArgs{}, 1, 10, tc.orderBy, columns)
+		if !reflect.DeepEqual(tc.err, err) {
+			t.Error(i, ":", "want", tc.err, "got", err)
+		}
+		if err == nil && !reflect.DeepEqual(tc.columns, q.Columns) {
+			t.Error(i, ":", "want", tc.columns, "got", q.Columns)
+		}
+	}
+
+	figure, _ := DecodeFigure([]byte(`{"id": "t", "type": "table", "table": "HTHT.hotel"}`))
+	if _, err := NewQuery(figure, ParseArgs{}, 1, 10, "revpar", columns); err == nil {
+		t.Error("want error ordering by an unknown column")
+	}
+}
+
+func TestFigureReferencedColumns(t *testing.T) {
+	figure, _ := DecodeFigure([]byte(`{"id": "t", "type": "table", "table": "HTHT.hotel",
+		"columns": ["date", "round(adr * occ, 2)"]}`))
+	want := []string{"date", "adr", "occ"}
+	if out := figure.ReferencedColumns(); !reflect.DeepEqual(want, out) {
+		t.Error("want", want, "got", out)
+	}
+}
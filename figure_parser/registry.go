@@ -0,0 +1,244 @@
+package figure_parser
+
+import (
+	"fmt"
+	"path"
+	"reflect"
+	"runtime"
+	"sync"
+)
+
+// handledByKey holds, in a parsed figure, the parser of each query and the
+// transformer of the figure
+const handledByKey = "handledBy"
+
+// FigureTransformer reshapes the query results of a figure of some type
+// before they are filled into it. queryResults is the result of the query of
+// a single query figure, or the results by name of named queries.
+type FigureTransformer interface {
+	Transform(fig *FigureSpec, queryResults map[string]interface{}) error
+}
+
+// QueryType declares what queries of a type are checked for before their
+// parser gets them. The zero value only checks the fields common to all
+// queries.
+type QueryType struct {
+	// Required lists the fields the query needs as non empty strings
+	Required []string
+	// SQLFields lists fields beyond the common ones ("function", "column",
+	// ...) holding expressions. They are checked like the common ones and
+	// rendered into Raw, where the parser reads them.
+	SQLFields []SQLField
+	// Transforms allows "transforms", for parsers producing date aligned data
+	Transforms bool
+	// Anomaly allows "anomaly", for parsers producing series
+	Anomaly bool
+	// Fields lists the fields the query accepts beyond "type", "period",
+	// "filters", "transforms", "anomaly" and SQLFields. Others are rejected.
+	// nil accepts any field, for parsers reading their own from Raw.
+	Fields []string
+}
+
+// SQLField names a field of a query holding an expression
+type SQLField struct {
+	Name string
+	// Aggregate allows the expression to call aggregate functions
+	Aggregate bool
+}
+
+type registeredQuery struct {
+	parser QueryParser
+	QueryType
+}
+
+var (
+	registryMu   sync.RWMutex
+	queryTypes   = make(map[string]registeredQuery)
+	transformers = make(map[string]FigureTransformer)
+)
+
+func init() {
+	RegisterQueryType("element", elementParser{}, QueryType{
+		Required: []string{"table", "function"},
+		Fields:   []string{"table", "function", "one"},
+	})
+	RegisterQueryType("select_column", selectColumnParser{}, QueryType{
+		Required:   []string{"table", "column"},
+		Transforms: true,
+		Anomaly:    true,
+		Fields:     []string{"table", "column", "raise_dimension"},
+	})
+	RegisterQueryType("aggregate", aggregateParser{}, QueryType{
+		Required:   []string{"table", "group_key", "function"},
+		Transforms: true,
+		Anomaly:    true,
+		Fields:     []string{"table", "group_key", "function", "top_n", "other_label"},
+	})
+	// each row of a period_series lists the values of a period, so its
+	// transforms apply to the columns across periods
+	RegisterQueryType("period_series", periodSeriesParser{}, QueryType{
+		Required:   []string{"table", "column"},
+		Transforms: true,
+		Fields:     []string{"table", "column"},
+	})
+	RegisterQueryType("xox", xoxParser{}, QueryType{
+		Required: []string{"table", "function"},
+		Fields:   []string{"table", "function", "periodLevel", "lag", "series", "raise_dimension"},
+	})
+	RegisterQueryType("distinct", distinctParser{}, QueryType{
+		Required: []string{"table", "column"},
+		Fields:   []string{"table", "column"},
+	})
+	RegisterQueryType("derived", derivedParser{}, QueryType{
+		Required: []string{"expression"},
+		Fields:   []string{"expression", "raise_dimension"},
+	})
+	RegisterQueryType("histogram", histogramParser{}, QueryType{
+		Required:   []string{"table", "column"},
+		Transforms: true,
+		Fields:     []string{"table", "column", "buckets"},
+	})
+	RegisterQueryType("percentiles", percentilesParser{}, QueryType{
+		Required:   []string{"table", "column"},
+		Transforms: true,
+		Fields:     []string{"table", "column", "percentiles", "box_plot", "weight"},
+	})
+	RegisterQueryType("pivot", pivotParser{}, QueryType{
+		Required: []string{"table", "row_key", "column_key", "function"},
+		Fields:   []string{"table", "row_key", "column_key", "function", "percent"},
+	})
+	RegisterQueryType("forecast", forecastParser{}, QueryType{
+		Required: []string{"table", "column"},
+		Fields: []string{"table", "column", "model", "horizon", "season", "confidence",
+			"smoothing"},
+	})
+	RegisterQueryType("scatter", scatterParser{}, QueryType{
+		Required: []string{"table", "x", "y"},
+		Fields:   []string{"table", "x", "y", "group_key"},
+	})
+	RegisterQueryType("compare", compareParser{}, QueryType{
+		Required:   []string{"function"},
+		Transforms: true,
+		Fields:     []string{"function", "table", "tables", "datasets", "labels", "fill"},
+	})
+
+	RegisterFigureTransformer("PieChart", pieChartTransformer{})
+	RegisterFigureTransformer("LadderChart.Abs", ladderChartTransformer{})
+	RegisterFigureTransformer("HeatmapChart", heatmapTransformer{})
+	RegisterFigureTransformer("ScatterChart", scatterTransformer{})
+}
+
+// RegisterQueryParser makes a query type available to figures, usually from
+// the init function of the package implementing it. The SQL fields of the
+// query ("function", "column", ...) are checked and rendered before the
+// parser gets it. It panics if the type is registered twice.
+func RegisterQueryParser(qtype string, parser QueryParser) {
+	RegisterQueryType(qtype, parser, QueryType{})
+}
+
+// RegisterQueryType is RegisterQueryParser for parsers declaring what their
+// queries need, e.g. required fields or further SQL fields.
+func RegisterQueryType(qtype string, parser QueryParser, t QueryType) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if parser == nil {
+		panic("figure_parser: RegisterQueryParser parser is nil")
+	}
+	if _, dup := queryTypes[qtype]; dup {
+		panic("figure_parser: RegisterQueryParser called twice for query type " + qtype)
+	}
+	queryTypes[qtype] = registeredQuery{parser, t}
+}
+
+// RegisterFigureTransformer makes figures of a type reshape their query
+// results with transformer. It panics if the type is registered twice.
+func RegisterFigureTransformer(figType string, transformer FigureTransformer) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if transformer == nil {
+		panic("figure_parser: RegisterFigureTransformer transformer is nil")
+	}
+	if _, dup := transformers[figType]; dup {
+		panic("figure_parser: RegisterFigureTransformer called twice for figure type " + figType)
+	}
+	transformers[figType] = transformer
+}
+
+func newParser(qtype string) (QueryParser, error) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	q, ok := queryTypes[qtype]
+	if !ok {
+		return nil, fmt.Errorf("unknow parser type: %s", qtype)
+	}
+	return q.parser, nil
+}
+
+// queryTypeOf returns what queries of a registered type are checked for
+func queryTypeOf(qtype string) QueryType {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	return queryTypes[qtype].QueryType
+}
+
+func figureTransformer(figType string) (FigureTransformer, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	t, ok := transformers[figType]
+	return t, ok
+}
+
+// handlerName names the implementation of a parser or transformer by its
+// package and type, e.g. "figure_parser.aggregateParser"
+func handlerName(handler interface{}) string {
+	return fmt.Sprintf("%T", handler)
+}
+
+// derivedHandler names what evaluates derived queries: runQueries computes
+// them from their siblings with evalDerived, their parser never runs
+var derivedHandler = path.Base(runtime.FuncForPC(reflect.ValueOf(evalDerived).Pointer()).Name())
+
+// handledBy reports the parser of each query of a set by its tag prefix,
+// "#query" or "#query.A", and the transformer of the figure, if any
+func handledBy(queries *QuerySet, transformer FigureTransformer) map[string]interface{} {
+	parsed := make(map[string]string)
+	queries.Each(queryKey, func(path string, q QuerySpec) {
+		if q.Type == "derived" {
+			parsed[path] = derivedHandler
+		} else if parser, err := newParser(q.Type); err == nil {
+			parsed[path] = handlerName(parser)
+		}
+	})
+	handled := map[string]interface{}{"queries": parsed}
+	if transformer != nil {
+		handled["transformer"] = handlerName(transformer)
+	}
+	return handled
+}
+
+type pieChartTransformer struct{}
+
+func (pieChartTransformer) Transform(fig *FigureSpec, queryResults map[string]interface{}) error {
+	return parsePieChart(queryResults, fig.TopN, fig.OtherLabel)
+}
+
+type ladderChartTransformer struct{}
+
+func (ladderChartTransformer) Transform(fig *FigureSpec, queryResults map[string]interface{}) error {
+	parseLadderChart(queryResults)
+	return nil
+}
+
+type heatmapTransformer struct{}
+
+func (heatmapTransformer) Transform(fig *FigureSpec, queryResults map[string]interface{}) error {
+	parseHeatmap(queryResults)
+	return nil
+}
+
+type scatterTransformer struct{}
+
+func (scatterTransformer) Transform(fig *FigureSpec, queryResults map[string]interface{}) error {
+	parseScatter(queryResults)
+	return nil
+}
@@ -0,0 +1,117 @@
+package figure_parser
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+)
+
+type waterfallParser struct{}
+
+func (waterfallParser) Parse(ctx context.Context, query QuerySpec, args ParseArgs,
+	db *gorm.DB) (map[string]interface{}, error) {
+	return map[string]interface{}{"data": []string{}}, nil
+}
+
+// registerTestQueryType registers a query type for the length of a test
+func registerTestQueryType(t *testing.T, qtype string, parser QueryParser, qt QueryType) {
+	RegisterQueryType(qtype, parser, qt)
+	t.Cleanup(func() {
+		registryMu.Lock()
+		delete(queryTypes, qtype)
+		registryMu.Unlock()
+	})
+}
+
+func TestRegisterQueryParser(t *testing.T) {
+	registerTestQueryType(t, "test_waterfall", waterfallParser{}, QueryType{})
+
+	parser, err := newParser("test_waterfall")
+	if err != nil || parser != (waterfallParser{}) {
+		t.Error("want", waterfallParser{}, "got", parser, err)
+	}
+	query, _ := DecodeQuery([]byte(`{"type": "test_waterfall", "table": "t", "function": "sum(a)"}`))
+	if err := query.Validate(); err != nil {
+		t.Error(err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("want panic registering a query type twice")
+		}
+	}()
+	RegisterQueryParser("aggregate", waterfallParser{})
+}
+
+func TestRegisterQueryType(t *testing.T) {
+	registerTestQueryType(t, "test_bridge", waterfallParser{}, QueryType{
+		Required:   []string{"table", "start"},
+		SQLFields:  []SQLField{{"start", true}, {"step", false}},
+		Transforms: true,
+	})
+
+	query, _ := DecodeQuery([]byte(`{"type": "test_bridge", "table": "t", "step": "sum(b)",
+		"transforms": [{"type": "cumsum"}], "anomaly": {}}`))
+	err := query.Validate()
+	want := ValidationErrors{
+		{"$.start", "is required by test_bridge query"},
+		{"$.anomaly", "is not supported by test_bridge query"},
+		{"$.step", "must not call aggregate functions"},
+	}
+	if !reflect.DeepEqual(want, err) {
+		t.Error("want", want, "got", err)
+	}
+
+	query, _ = DecodeQuery([]byte(`{"type": "test_bridge", "table": "t", "start": "sum(Revenue)", "step": "cost"}`))
+	if err := query.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	compiled := query
+	err = compileSQL(&compiled, []string{"date", "period", "revenue"})
+	want = ValidationErrors{{"$.step", "column cost does not exist in table t"}}
+	if !reflect.DeepEqual(want, err) {
+		t.Error("want", want, "got", err)
+	}
+	if compiled.Raw["start"] != `sum("revenue")` {
+		t.Error("want", `sum("revenue")`, "got", compiled.Raw["start"])
+	}
+	if query.Raw["start"] != "sum(Revenue)" {
+		t.Error("want", "sum(Revenue)", "got", query.Raw["start"])
+	}
+
+	// types declaring their fields reject the others
+	registerTestQueryType(t, "test_strict", waterfallParser{}, QueryType{
+		SQLFields: []SQLField{{"start", true}},
+		Fields:    []string{"table"},
+	})
+	query, _ = DecodeQuery([]byte(`{"type": "test_strict", "table": "t", "start": "sum(v)", "step": "v"}`))
+	want = ValidationErrors{{"$.step", "is not supported by test_strict query"}}
+	if err := query.Validate(); !reflect.DeepEqual(want, err) {
+		t.Error("want", want, "got", err)
+	}
+}
+
+func TestHandledBy(t *testing.T) {
+	queries := &QuerySet{Named: map[string]QuerySpec{
+		"A": {Type: "aggregate"},
+		"B": {Type: "derived"},
+	}}
+	transformer, _ := figureTransformer("PieChart")
+	want := map[string]interface{}{
+		"queries": map[string]string{
+			"#query.A": "figure_parser.aggregateParser",
+			"#query.B": "figure_parser.evalDerived",
+		},
+		"transformer": "figure_parser.pieChartTransformer",
+	}
+	if out := handledBy(queries, transformer); !reflect.DeepEqual(want, out) {
+		t.Error("want", want, "got", out)
+	}
+
+	want = map[string]interface{}{"queries": map[string]string{"#query": "figure_parser.pivotParser"}}
+	if out := handledBy(&QuerySet{Single: &QuerySpec{Type: "pivot"}}, nil); !reflect.DeepEqual(want, out) {
+		t.Error("want", want, "got", out)
+	}
+}
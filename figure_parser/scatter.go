@@ -0,0 +1,174 @@
+package figure_parser
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/bluecover/lm/models"
+	"github.com/gonum/stat"
+	"github.com/jinzhu/gorm"
+)
+
+// maxScatterPoints limits the rows read by a scatter query of plain columns
+const maxScatterPoints = 5000
+
+// scatterParser pairs two metrics, e.g.
+// {"type": "scatter", "table": "HTHT.hotel_management_state",
+// "x": "avg(occ)", "y": "avg(adr)", "group_key": "hotel_type"}
+// Aggregated "x" and "y" give one point per "group_key" value over the date
+// range, or one per period without it. Plain columns give one point per row,
+// labelled by "group_key" or the period.
+// "labels", "x" and "y" hold the points; "correlation" is their Pearson
+// coefficient and "slope", "intercept" and "r_squared" the least squares
+// line of y over x.
+type scatterParser struct{}
+
+func (q QuerySpec) validateScatter(path string, errs *ValidationErrors) {
+	x, err := parseSQLExpr(q.X)
+	if err != nil {
+		return
+	}
+	y, err := parseSQLExpr(q.Y)
+	if err != nil {
+		return
+	}
+	if x.HasAggregate() != y.HasAggregate() {
+		errs.add(joinPath(path, "y"), "must aggregate like x")
+	}
+}
+
+// Parse implement QueryParser.Parse
+func (p scatterParser) Parse(ctx context.Context, query QuerySpec, args ParseArgs,
+	db *gorm.DB) (map[string]interface{}, error) {
+
+	table := models.QuoteIdentifier(query.Table)
+	label := "date"
+	if len(query.GroupKey) > 0 {
+		label = fmt.Sprintf("(%s)::text", query.GroupKey)
+	}
+	builder := sq.Select(
+		label,
+		fmt.Sprintf("(%s)::float8", query.X),
+		fmt.Sprintf("(%s)::float8", query.Y),
+	).From(table)
+	if hasAggregate(query.X) {
+		builder = builder.GroupBy("1")
+	} else {
+		builder = builder.Limit(maxScatterPoints)
+	}
+	builder = applyArgs(builder.OrderBy("1"), args)
+	statement, sargs, err := builder.ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := queryRows(ctx, db, statement, sargs...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var labels []string
+	var xs, ys []float64
+	for rows.Next() {
+		var x, y sql.NullFloat64
+		var l string
+		if len(query.GroupKey) > 0 {
+			var s sql.NullString
+			if err := rows.Scan(&s, &x, &y); err != nil {
+				return nil, err
+			}
+			l = nullLabel(s)
+		} else {
+			var date time.Time
+			if err := rows.Scan(&date, &x, &y); err != nil {
+				return nil, err
+			}
+			l = args.Calendar.FormatTime(date, args.Period)
+		}
+		if !x.Valid || !y.Valid {
+			continue
+		}
+		labels = append(labels, l)
+		xs = append(xs, x.Float64)
+		ys = append(ys, y.Float64)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return p.result(labels, xs, ys), nil
+}
+
+// formatStat rounds a statistic to four decimals
+func formatStat(f float64) string {
+	return formatDerived(math.Round(f*1e4) / 1e4)
+}
+
+func (scatterParser) result(labels []string, xs, ys []float64) map[string]interface{} {
+	x := make([]string, len(xs))
+	y := make([]string, len(ys))
+	for i := range xs {
+		x[i], y[i] = formatDerived(xs[i]), formatDerived(ys[i])
+	}
+	if labels == nil {
+		labels = make([]string, 0)
+	}
+	result := map[string]interface{}{
+		"labels":      labels,
+		"x":           x,
+		"y":           y,
+		"correlation": "-",
+		"slope":       "-",
+		"intercept":   "-",
+		"r_squared":   "-",
+	}
+
+	// a line needs two points apart on x
+	if len(xs) < 2 || stat.Variance(xs, nil) == 0 {
+		return result
+	}
+	alpha, beta := stat.LinearRegression(xs, ys, nil, false)
+	result["slope"] = formatStat(beta)
+	result["intercept"] = formatStat(alpha)
+	if stat.Variance(ys, nil) > 0 {
+		result["correlation"] = formatStat(stat.Correlation(xs, ys, nil))
+		result["r_squared"] = formatStat(stat.RSquared(xs, ys, nil, alpha, beta))
+	}
+	return result
+}
+
+// parseScatter adds the points of a scatter result as [x, y, label] with the
+// ends of its regression line over the x range, the form scatter charts take.
+func parseScatter(queryResult map[string]interface{}) {
+	labels, _ := queryResult["labels"].([]string)
+	x, _ := queryResult["x"].([]string)
+	y, _ := queryResult["y"].([]string)
+	if len(x) != len(labels) || len(y) != len(labels) {
+		return
+	}
+
+	points := make([][]interface{}, len(labels))
+	min, max := math.Inf(1), math.Inf(-1)
+	for i, l := range labels {
+		points[i] = []interface{}{x[i], y[i], l}
+		if v, err := strconv.ParseFloat(x[i], 64); err == nil {
+			min, max = math.Min(min, v), math.Max(max, v)
+		}
+	}
+	queryResult["points"] = points
+
+	slope, err1 := strconv.ParseFloat(fmt.Sprint(queryResult["slope"]), 64)
+	intercept, err2 := strconv.ParseFloat(fmt.Sprint(queryResult["intercept"]), 64)
+	if err1 != nil || err2 != nil || min > max {
+		return
+	}
+	queryResult["line"] = [][]string{
+		{formatDerived(min), formatStat(intercept + slope*min)},
+		{formatDerived(max), formatStat(intercept + slope*max)},
+	}
+}
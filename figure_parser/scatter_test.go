@@ -0,0 +1,84 @@
+package figure_parser
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestScatterResult(t *testing.T) {
+	testCases := []struct {
+		labels []string
+		xs, ys []float64
+		out    map[string]interface{}
+	}{
+		{
+			[]string{"a", "b", "c"}, []float64{1, 2, 3}, []float64{2, 4, 6},
+			map[string]interface{}{
+				"labels": []string{"a", "b", "c"}, "x": []string{"1", "2", "3"}, "y": []string{"2", "4", "6"},
+				"correlation": "1", "slope": "2", "intercept": "0", "r_squared": "1",
+			},
+		},
+		{
+			[]string{"a", "b", "c", "d"}, []float64{1, 2, 3, 4}, []float64{4, 1, 3, 2},
+			map[string]interface{}{
+				"labels": []string{"a", "b", "c", "d"}, "x": []string{"1", "2", "3", "4"}, "y": []string{"4", "1", "3", "2"},
+				"correlation": "-0.4", "slope": "-0.4", "intercept": "3.5", "r_squared": "0.16",
+			},
+		},
+		{
+			[]string{"a", "b"}, []float64{1, 1}, []float64{2, 3},
+			map[string]interface{}{
+				"labels": []string{"a", "b"}, "x": []string{"1", "1"}, "y": []string{"2", "3"},
+				"correlation": "-", "slope": "-", "intercept": "-", "r_squared": "-",
+			},
+		},
+		{
+			nil, nil, nil,
+			map[string]interface{}{
+				"labels": []string{}, "x": []string{}, "y": []string{},
+				"correlation": "-", "slope": "-", "intercept": "-", "r_squared": "-",
+			},
+		},
+	}
+
+	for i, tc := range testCases {
+		out := scatterParser{}.result(tc.labels, tc.xs, tc.ys)
+		if !reflect.DeepEqual(tc.out, out) {
+			t.Error(i, ":", "want", tc.out, "got", out)
+		}
+	}
+}
+
+func TestParseScatter(t *testing.T) {
+	result := scatterParser{}.result([]string{"a", "b", "c"}, []float64{3, 1, 2}, []float64{7, 3, 5})
+	parseScatter(result)
+
+	points := [][]interface{}{{"3", "7", "a"}, {"1", "3", "b"}, {"2", "5", "c"}}
+	if !reflect.DeepEqual(points, result["points"]) {
+		t.Error("want", points, "got", result["points"])
+	}
+	line := [][]string{{"1", "3"}, {"3", "7"}}
+	if !reflect.DeepEqual(line, result["line"]) {
+		t.Error("want", line, "got", result["line"])
+	}
+
+	result = scatterParser{}.result(nil, nil, nil)
+	parseScatter(result)
+	if _, ok := result["line"]; ok {
+		t.Error("want no line got", result["line"])
+	}
+}
+
+func TestValidateScatter(t *testing.T) {
+	query, _ := DecodeQuery([]byte(`{"type": "scatter", "table": "t", "x": "avg(occ)", "y": "adr"}`))
+	want := ValidationErrors{{"$.y", "must aggregate like x"}}
+	if err := query.Validate(); !reflect.DeepEqual(want, err) {
+		t.Error("want", want, "got", err)
+	}
+
+	query, _ = DecodeQuery([]byte(`{"type": "scatter", "table": "t", "x": "avg(occ)"}`))
+	want = ValidationErrors{{"$.y", "is required by scatter query"}}
+	if err := query.Validate(); !reflect.DeepEqual(want, err) {
+		t.Error("want", want, "got", err)
+	}
+}
@@ -0,0 +1,804 @@
+package figure_parser
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/bluecover/lm/business/timing"
+)
+
+const rootPath = "$"
+
+// ValidationError describes one problem found in a figure or page definition
+type ValidationError struct {
+	Path    string
+	Message string
+}
+
+func (e ValidationError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Path, e.Message)
+}
+
+// ValidationErrors collects all problems of a definition
+type ValidationErrors []ValidationError
+
+func (e ValidationErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, v := range e {
+		msgs[i] = v.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (e *ValidationErrors) add(path string, format string, a ...interface{}) {
+	*e = append(*e, ValidationError{Path: path, Message: fmt.Sprintf(format, a...)})
+}
+
+// merge appends errs recorded relative to a node located at path.
+func (e *ValidationErrors) merge(path string, errs ValidationErrors) {
+	for _, v := range errs {
+		*e = append(*e, ValidationError{Path: joinPath(path, v.Path), Message: v.Message})
+	}
+}
+
+func (e ValidationErrors) orNil() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+func joinPath(prefix string, key string) string {
+	switch {
+	case len(key) == 0:
+		return prefix
+	case len(prefix) == 0:
+		return key
+	case key[0] == '[':
+		return prefix + key
+	default:
+		return prefix + "." + key
+	}
+}
+
+func indexPath(i int) string {
+	return fmt.Sprintf("[%d]", i)
+}
+
+// Flag is a boolean option which also accepts numbers, e.g. "raise_dimension": 1
+type Flag bool
+
+// UnmarshalJSON implements json.Unmarshaler
+func (f *Flag) UnmarshalJSON(b []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	switch t := v.(type) {
+	case nil:
+		*f = false
+	case bool:
+		*f = Flag(t)
+	case float64:
+		*f = t != 0
+	default:
+		return fmt.Errorf("invalid flag %s", b)
+	}
+	return nil
+}
+
+// fieldDecoder decodes known fields of a JSON object one by one and records
+// type mismatches instead of stopping at the first one.
+type fieldDecoder struct {
+	fields map[string]json.RawMessage
+	raw    map[string]interface{}
+	errs   ValidationErrors
+}
+
+func newFieldDecoder(b []byte) *fieldDecoder {
+	d := &fieldDecoder{}
+	if err := json.Unmarshal(b, &d.fields); err != nil || d.fields == nil {
+		d.errs.add("", "must be an object")
+		return d
+	}
+	json.Unmarshal(b, &d.raw)
+	return d
+}
+
+func (d *fieldDecoder) has(key string) bool {
+	_, ok := d.fields[key]
+	return ok
+}
+
+func (d *fieldDecoder) decode(key string, v interface{}) {
+	b, ok := d.fields[key]
+	if !ok {
+		return
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		d.errs.add(key, "must be %s", expectedKind(v))
+	}
+}
+
+func expectedKind(v interface{}) string {
+	t := reflect.TypeOf(v)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Int, reflect.Int64, reflect.Float64:
+		return "a number"
+	case reflect.Slice:
+		return "an array"
+	default:
+		return "an object"
+	}
+}
+
+// QuerySpec is the typed form of one query definition in "#query". It holds
+// the fields of every query type; the QueryType registered for Type declares
+// which of them a query accepts.
+type QuerySpec struct {
+	Type   string
+	Table  string
+	Period string
+
+	// element, xox and aggregate
+	Function string
+	// select_column, period_series and distinct
+	Column string
+	// aggregate
+	GroupKey string
+	// aggregate: keep the top n groups and fold the rest into OtherLabel
+	TopN       int
+	OtherLabel string
+	// element: only query the latest period
+	One Flag
+	// select_column: wrap data into a two dimensional array
+	RaiseDimension Flag
+	// xox: compare on the next period level
+	PeriodLevel int
+	// xox: number of periods between compared periods, 1 by default
+	Lag int
+	// xox: return the change of every period in the date range
+	Series Flag
+	// derived: arithmetic over sibling query results
+	Expression string
+	// histogram: how values of column are bucketed
+	Buckets *BucketSpec
+	// percentiles: percentiles (0-100) of column to return
+	Percentiles []float64
+	// percentiles: also return min, q1, median, q3 and max
+	BoxPlot Flag
+	// percentiles: column weighting each value
+	Weight string
+	// pivot: the two dimensions to group by
+	RowKey    string
+	ColumnKey string
+	// pivot: give cells as percent of their "row" or "column" total
+	Percent string
+	// forecast: "linear" or "holt_winters", the number of periods projected,
+	// the periods of a season, the confidence of the band and the smoothing
+	// factors of holt_winters
+	Model      string
+	Horizon    int
+	Season     *int
+	Confidence float64
+	Smoothing  []float64
+	// scatter: the paired metrics
+	X string
+	Y string
+	// compare: the tables, or the datasets holding table, compared; the
+	// labels of their series and how gaps are filled
+	Tables   []string
+	Datasets []string
+	Labels   []string
+	Fill     string
+	// select_column and aggregate: flag unusual points of the series
+	Anomaly *AnomalySpec
+	// Filters restrict the rows read by the query, in addition to the
+	// filters of the request
+	Filters []Filter
+
+	// Transforms reshape the date aligned result data in order, the columns
+	// of period_series rows across periods
+	Transforms []TransformSpec
+
+	// Raw keeps the original definition
+	Raw map[string]interface{}
+
+	errs ValidationErrors
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (q *QuerySpec) UnmarshalJSON(b []byte) error {
+	d := newFieldDecoder(b)
+	d.decode("type", &q.Type)
+	d.decode("table", &q.Table)
+	d.decode("period", &q.Period)
+	d.decode("function", &q.Function)
+	d.decode("column", &q.Column)
+	d.decode("group_key", &q.GroupKey)
+	d.decode("top_n", &q.TopN)
+	d.decode("other_label", &q.OtherLabel)
+	d.decode("one", &q.One)
+	d.decode("raise_dimension", &q.RaiseDimension)
+	d.decode("periodLevel", &q.PeriodLevel)
+	d.decode("lag", &q.Lag)
+	d.decode("series", &q.Series)
+	d.decode("expression", &q.Expression)
+	if d.has("buckets") {
+		q.Buckets = new(BucketSpec)
+		d.decode("buckets", q.Buckets)
+	}
+	d.decode("percentiles", &q.Percentiles)
+	d.decode("box_plot", &q.BoxPlot)
+	d.decode("weight", &q.Weight)
+	d.decode("row_key", &q.RowKey)
+	d.decode("column_key", &q.ColumnKey)
+	d.decode("percent", &q.Percent)
+	d.decode("model", &q.Model)
+	d.decode("horizon", &q.Horizon)
+	d.decode("season", &q.Season)
+	d.decode("confidence", &q.Confidence)
+	d.decode("smoothing", &q.Smoothing)
+	d.decode("x", &q.X)
+	d.decode("y", &q.Y)
+	d.decode("tables", &q.Tables)
+	d.decode("datasets", &q.Datasets)
+	d.decode("labels", &q.Labels)
+	d.decode("fill", &q.Fill)
+	if d.has("anomaly") {
+		q.Anomaly = new(AnomalySpec)
+		d.decode("anomaly", q.Anomaly)
+	}
+	d.decode("filters", &q.Filters)
+	d.decode("transforms", &q.Transforms)
+	q.Raw = d.raw
+	q.errs = d.errs
+	return nil
+}
+
+// DecodeQuery decodes a single query definition
+func DecodeQuery(b []byte) (QuerySpec, error) {
+	var q QuerySpec
+	err := json.Unmarshal(b, &q)
+	return q, err
+}
+
+// Validate returns all problems of the query as ValidationErrors
+func (q QuerySpec) Validate() error {
+	var errs ValidationErrors
+	q.validate(rootPath, &errs)
+	return errs.orNil()
+}
+
+func (q QuerySpec) validate(path string, errs *ValidationErrors) {
+	errs.merge(path, q.errs)
+
+	if len(q.Type) == 0 {
+		errs.add(joinPath(path, "type"), "is required")
+		return
+	}
+	if _, err := newParser(q.Type); err != nil {
+		errs.add(joinPath(path, "type"), "unknown query type %q", q.Type)
+		return
+	}
+	if len(q.Period) > 0 && !timing.IsValidPeriod(q.Period) {
+		errs.add(joinPath(path, "period"), "unknown period %q", q.Period)
+	}
+	qt := queryTypeOf(q.Type)
+	for _, name := range qt.Required {
+		if s, _ := q.Raw[name].(string); len(s) == 0 {
+			errs.add(joinPath(path, name), "is required by %s query", q.Type)
+		}
+	}
+	q.validateFields(path, qt, errs)
+	if q.PeriodLevel != 0 && q.PeriodLevel != 1 {
+		errs.add(joinPath(path, "periodLevel"), "must be 0 or 1")
+	}
+	if q.TopN < 0 {
+		errs.add(joinPath(path, "top_n"), "must not be negative")
+	}
+	if q.Lag < 0 {
+		errs.add(joinPath(path, "lag"), "must not be negative")
+	}
+	if q.Buckets != nil {
+		q.Buckets.validate(joinPath(path, "buckets"), errs)
+	} else if q.Type == "histogram" {
+		errs.add(joinPath(path, "buckets"), "is required by histogram query")
+	}
+	if q.Type == "percentiles" && len(q.Percentiles) == 0 && !q.BoxPlot {
+		errs.add(joinPath(path, "percentiles"), "are required by percentiles query without box_plot")
+	}
+	for i, p := range q.Percentiles {
+		if p < 0 || p > 100 {
+			errs.add(joinPath(path, "percentiles"+indexPath(i)), "must be between 0 and 100")
+		}
+	}
+	if len(q.Percent) > 0 && q.Percent != PercentOfRow && q.Percent != PercentOfColumn {
+		errs.add(joinPath(path, "percent"), "must be %q or %q", PercentOfRow, PercentOfColumn)
+	}
+	if q.Type == "forecast" {
+		q.validateForecast(path, errs)
+	}
+	if q.Type == "scatter" {
+		q.validateScatter(path, errs)
+	}
+	if q.Type == "compare" {
+		q.validateCompare(path, errs)
+	}
+	if q.Anomaly != nil {
+		if qt.Anomaly {
+			q.Anomaly.validate(joinPath(path, "anomaly"), errs)
+		} else {
+			errs.add(joinPath(path, "anomaly"), "is not supported by %s query", q.Type)
+		}
+	}
+	q.validateSQL(path, errs)
+	if len(q.Filters) > 0 && q.Type == "derived" {
+		errs.add(joinPath(path, "filters"), "are not supported by %s query", q.Type)
+	}
+	for i, f := range q.Filters {
+		f.validate(joinPath(path, "filters"+indexPath(i)), errs)
+	}
+	if len(q.Transforms) > 0 && !qt.Transforms {
+		errs.add(joinPath(path, "transforms"), "are not supported by %s query", q.Type)
+	}
+	for i, t := range q.Transforms {
+		t.validate(joinPath(path, "transforms"+indexPath(i)), errs)
+	}
+}
+
+// validateFields rejects the fields of the query its type does not declare
+func (q QuerySpec) validateFields(path string, qt QueryType, errs *ValidationErrors) {
+	if qt.Fields == nil {
+		return
+	}
+	known := map[string]bool{"type": true, "period": true, "filters": true, "transforms": true, "anomaly": true}
+	for _, name := range qt.Fields {
+		known[name] = true
+	}
+	for _, f := range qt.SQLFields {
+		known[f.Name] = true
+	}
+	names := make([]string, 0, len(q.Raw))
+	for name := range q.Raw {
+		if !known[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		errs.add(joinPath(path, name), "is not supported by %s query", q.Type)
+	}
+}
+
+// QuerySet is the "#query" of a figure or page. It is either a single query,
+// referenced by tags like "#query.data", or a set of named queries referenced
+// by tags like "#query.A.data".
+type QuerySet struct {
+	Single *QuerySpec
+	Named  map[string]QuerySpec
+
+	errs ValidationErrors
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (qs *QuerySet) UnmarshalJSON(b []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil || fields == nil {
+		qs.errs.add("", "must be an object")
+		return nil
+	}
+
+	if t, ok := fields["type"]; ok && len(t) > 0 && t[0] == '"' {
+		qs.Single = new(QuerySpec)
+		return json.Unmarshal(b, qs.Single)
+	}
+
+	qs.Named = make(map[string]QuerySpec)
+	for name, v := range fields {
+		if len(v) == 0 || v[0] != '{' {
+			qs.errs.add(name, "must be a query object")
+			continue
+		}
+		var q QuerySpec
+		json.Unmarshal(v, &q)
+		qs.Named[name] = q
+	}
+	return nil
+}
+
+// Names returns the sorted query names of a named set
+func (qs QuerySet) Names() []string {
+	names := make([]string, 0, len(qs.Named))
+	for name := range qs.Named {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Each calls fn for every query in the set with its JSON path
+func (qs QuerySet) Each(path string, fn func(path string, q QuerySpec)) {
+	if qs.Single != nil {
+		fn(path, *qs.Single)
+		return
+	}
+	for _, name := range qs.Names() {
+		fn(joinPath(path, name), qs.Named[name])
+	}
+}
+
+func (qs QuerySet) validate(path string, errs *ValidationErrors) {
+	errs.merge(path, qs.errs)
+	if qs.Single == nil && len(qs.Named) == 0 && len(qs.errs) == 0 {
+		errs.add(path, "has no query")
+	}
+	qs.Each(path, func(p string, q QuerySpec) {
+		q.validate(p, errs)
+	})
+
+	if qs.Single != nil {
+		if qs.Single.Type == "derived" {
+			errs.add(joinPath(path, "type"), "derived query must be in a set of named queries")
+		}
+		return
+	}
+	parsed := true
+	for _, name := range qs.Names() {
+		q := qs.Named[name]
+		if q.Type != "derived" || len(q.Expression) == 0 {
+			continue
+		}
+		p := joinPath(joinPath(path, name), "expression")
+		n, err := parseArithmetic(q.Expression)
+		if err != nil {
+			errs.add(p, "%s", err)
+			parsed = false
+			continue
+		}
+		for _, ref := range n.refs() {
+			if _, ok := qs.Named[ref]; !ok {
+				errs.add(p, "refers to unknown query %q", ref)
+			}
+		}
+	}
+	if parsed {
+		if _, err := derivedOrder(qs.Named); err != nil {
+			errs.add(path, "%s", err)
+		}
+	}
+}
+
+// validateTags checks the query tags found in raw refer to existing queries.
+func (qs QuerySet) validateTags(path string, raw interface{}, errs *ValidationErrors) {
+	switch v := raw.(type) {
+	case map[string]interface{}:
+		for k, item := range v {
+			if k != queryKey {
+				qs.validateTags(joinPath(path, k), item, errs)
+			}
+		}
+	case []interface{}:
+		for i, item := range v {
+			qs.validateTags(joinPath(path, indexPath(i)), item, errs)
+		}
+	case string:
+		if !matchQueryFlag(v) {
+			return
+		}
+		p, err := parseQueryTag(v)
+		if err != nil {
+			errs.add(path, "malformed query tag %q: %s", v, err)
+			return
+		}
+		if qs.Single == nil {
+			if _, ok := qs.Named[p.name()]; !ok {
+				errs.add(path, "query tag %q refers to unknown query %q", v, p.name())
+			}
+		}
+	}
+}
+
+// FigureSpec is the typed form of a figure definition
+type FigureSpec struct {
+	ID       string
+	Type     string
+	Title    string
+	Template Flag
+
+	// table figures
+	Table   string
+	Columns []string
+
+	// PieChart: keep the top n slices and fold the rest into OtherLabel
+	TopN       int
+	OtherLabel string
+
+	// Formats of numbers by query name, result field or table column
+	Formats map[string]NumberFormat
+
+	// Queries is nil if the figure has no "#query"
+	Queries *QuerySet
+
+	// Raw keeps the whole original definition which is also the response shape
+	Raw map[string]interface{}
+
+	src       []byte
+	templates []figureTemplate
+	errs      ValidationErrors
+}
+
+// DecodeFigure decodes a figure definition. Malformed fields do not fail
+// decoding and are reported by Validate.
+func DecodeFigure(b []byte) (*FigureSpec, error) {
+	if !json.Valid(b) {
+		return nil, fmt.Errorf("figure is not valid JSON")
+	}
+	d := newFieldDecoder(b)
+	f := &FigureSpec{src: b}
+	d.decode("id", &f.ID)
+	d.decode("type", &f.Type)
+	d.decode("title", &f.Title)
+	d.decode(templateKey, &f.Template)
+	d.decode("table", &f.Table)
+	d.decode("columns", &f.Columns)
+	d.decode("top_n", &f.TopN)
+	d.decode("other_label", &f.OtherLabel)
+	d.decode("formats", &f.Formats)
+	if d.has(queryKey) {
+		f.Queries = new(QuerySet)
+		d.decode(queryKey, f.Queries)
+	}
+	f.Raw = d.raw
+	f.errs = d.errs
+	if f.Template {
+		parseTemplates(f.ID, "", f.Raw, &f.templates, &f.errs)
+	}
+	return f, nil
+}
+
+// IsTable reports whether the figure is rendered by ParseTable
+func (f *FigureSpec) IsTable() bool {
+	return f.Type == "table"
+}
+
+// Validate returns all problems of the figure as ValidationErrors
+func (f *FigureSpec) Validate() error {
+	var errs ValidationErrors
+	errs.merge(rootPath, f.errs)
+
+	if len(f.ID) == 0 {
+		errs.add(joinPath(rootPath, "id"), "is required")
+	}
+	if len(f.Type) == 0 {
+		errs.add(joinPath(rootPath, "type"), "is required")
+	}
+	if f.TopN < 0 {
+		errs.add(joinPath(rootPath, "top_n"), "must not be negative")
+	}
+	for name, format := range f.Formats {
+		format.validate(joinPath(joinPath(rootPath, "formats"), name), &errs)
+	}
+
+	if f.IsTable() {
+		if f.Queries != nil {
+			f.Queries.validate(joinPath(rootPath, queryKey), &errs)
+			if f.Queries.Single == nil || f.Queries.Single.Type != "pivot" {
+				errs.add(joinPath(rootPath, queryKey), "of a table figure must be a single pivot query")
+			}
+		} else if len(f.Table) == 0 {
+			errs.add(joinPath(rootPath, "table"), "is required by table figure")
+		}
+		for i, c := range f.Columns {
+			if _, err := parseSQLExpr(c); err != nil {
+				errs.add(joinPath(rootPath, "columns"+indexPath(i)), "%s", err)
+			}
+		}
+	} else if f.Queries != nil {
+		f.Queries.validate(joinPath(rootPath, queryKey), &errs)
+		if !f.Template {
+			f.Queries.validateTags(rootPath, f.Raw, &errs)
+		}
+	}
+	return errs.orNil()
+}
+
+// FigureRef is a figure, or a group of figures, placed on a page
+type FigureRef struct {
+	Type    string
+	ID      string
+	Title   string
+	Figures []FigureRef
+
+	errs ValidationErrors
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (r *FigureRef) UnmarshalJSON(b []byte) error {
+	d := newFieldDecoder(b)
+	d.decode("type", &r.Type)
+	d.decode("id", &r.ID)
+	d.decode("title", &r.Title)
+	d.decode("figures", &r.Figures)
+	r.errs = d.errs
+	return nil
+}
+
+// IsGroup reports whether the reference holds other figures
+func (r FigureRef) IsGroup() bool {
+	return len(r.Figures) > 0
+}
+
+func (r FigureRef) validate(path string, errs *ValidationErrors) {
+	errs.merge(path, r.errs)
+	if len(r.Type) == 0 {
+		errs.add(joinPath(path, "type"), "is required")
+	}
+	if !r.IsGroup() && len(r.ID) == 0 {
+		errs.add(joinPath(path, "id"), "is required")
+	}
+	for i, sub := range r.Figures {
+		sub.validate(joinPath(path, "figures"+indexPath(i)), errs)
+	}
+}
+
+// PageSpec is the typed form of a figure page definition
+type PageSpec struct {
+	ID       string
+	Title    string
+	Table    string
+	DateView int
+	DataView []FigureRef
+
+	// Queries is nil if the page has no "#query"
+	Queries *QuerySet
+
+	// Raw keeps the whole original definition which is also the response shape
+	Raw map[string]interface{}
+
+	src  []byte
+	errs ValidationErrors
+}
+
+// DecodePage decodes a figure page definition. Malformed fields do not fail
+// decoding and are reported by Validate.
+func DecodePage(b []byte) (*PageSpec, error) {
+	if !json.Valid(b) {
+		return nil, fmt.Errorf("figure page is not valid JSON")
+	}
+	d := newFieldDecoder(b)
+	p := &PageSpec{src: b}
+	d.decode("id", &p.ID)
+	d.decode("title", &p.Title)
+	d.decode("table", &p.Table)
+	d.decode("dateView", &p.DateView)
+	d.decode("dataView", &p.DataView)
+	if d.has(queryKey) {
+		p.Queries = new(QuerySet)
+		d.decode(queryKey, p.Queries)
+	}
+	p.Raw = d.raw
+	p.errs = d.errs
+	return p, nil
+}
+
+// Validate returns all problems of the page as ValidationErrors
+func (p *PageSpec) Validate() error {
+	var errs ValidationErrors
+	errs.merge(rootPath, p.errs)
+
+	if len(p.ID) == 0 {
+		errs.add(joinPath(rootPath, "id"), "is required")
+	}
+	if len(p.Title) == 0 {
+		errs.add(joinPath(rootPath, "title"), "is required")
+	}
+	if p.DateView < 0 {
+		errs.add(joinPath(rootPath, "dateView"), "must not be negative")
+	}
+	for i, view := range p.DataView {
+		view.validate(joinPath(rootPath, "dataView"+indexPath(i)), &errs)
+	}
+	if p.Queries != nil {
+		p.Queries.validate(joinPath(rootPath, queryKey), &errs)
+		p.Queries.validateTags(rootPath, p.Raw, &errs)
+	}
+	return errs.orNil()
+}
+
+// FigureIDs returns the ids of all figures placed on the page
+func (p *PageSpec) FigureIDs() []string {
+	ids := make([]string, 0)
+	var walk func(refs []FigureRef)
+	walk = func(refs []FigureRef) {
+		for _, r := range refs {
+			if r.IsGroup() {
+				walk(r.Figures)
+			} else if len(r.ID) > 0 {
+				ids = append(ids, r.ID)
+			}
+		}
+	}
+	walk(p.DataView)
+	return ids
+}
+
+// FigureSetEntry is a menu entry of a dataset, either a page or a group of pages
+type FigureSetEntry struct {
+	ID          string `json:"id"`
+	Title       string `json:"title"`
+	FigurePages []struct {
+		ID    string `json:"id"`
+		Title string `json:"title"`
+	} `json:"figurePages"`
+}
+
+// DatasetSpec is the typed form of dataset.json
+type DatasetSpec struct {
+	Name      string           `json:"name"`
+	FigureSet []FigureSetEntry `json:"FigureSet"`
+}
+
+// DecodeDataset decodes a dataset.json
+func DecodeDataset(b []byte) (*DatasetSpec, error) {
+	ds := new(DatasetSpec)
+	if err := json.Unmarshal(b, ds); err != nil {
+		return nil, err
+	}
+	return ds, nil
+}
+
+// PageIDs returns the ids of all pages in the figure set
+func (ds *DatasetSpec) PageIDs() []string {
+	ids := make([]string, 0)
+	for _, e := range ds.FigureSet {
+		if len(e.ID) > 0 {
+			ids = append(ids, e.ID)
+		}
+		for _, p := range e.FigurePages {
+			ids = append(ids, p.ID)
+		}
+	}
+	return ids
+}
+
+// ReferencedColumns returns the table columns read by the query
+func (q QuerySpec) ReferencedColumns() []string {
+	cols := make([]string, 0)
+	if q.Type == "derived" {
+		return cols
+	}
+	if q.Type != "distinct" {
+		cols = append(cols, "date", "period")
+	}
+	for _, f := range q.sqlFields() {
+		if e, err := parseSQLExpr(*f.value); err == nil {
+			cols = append(cols, e.Columns()...)
+		}
+	}
+	for _, f := range q.Filters {
+		cols = append(cols, f.Key)
+	}
+	return cols
+}
+
+// ReferencedColumns returns the columns of its table read by a table figure
+func (f *FigureSpec) ReferencedColumns() []string {
+	cols := make([]string, 0)
+	for _, c := range f.Columns {
+		if e, err := parseSQLExpr(c); err == nil {
+			cols = append(cols, e.Columns()...)
+		}
+	}
+	return cols
+}
@@ -0,0 +1,184 @@
+package figure_parser
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDecodeFigure(t *testing.T) {
+	fig, err := DecodeFigure([]byte(`{
+		"id": "HTHT.OperationalIndicators.AverageDailyRate",
+		"type": "LineChart",
+		"xAxis": "#query.date_range",
+		"yAxis": "#query.data",
+		"#query": {
+			"type": "select_column",
+			"column": "adr",
+			"table": "HTHT.hotel_management_state",
+			"raise_dimension": 1
+		}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fig.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if fig.Queries == nil || fig.Queries.Single == nil {
+		t.Fatal("want single query")
+	}
+	q := fig.Queries.Single
+	if q.Type != "select_column" || q.Column != "adr" || !bool(q.RaiseDimension) {
+		t.Error("wrong query", q)
+	}
+}
+
+func TestValidateFigure(t *testing.T) {
+	testCases := []struct {
+		in   string
+		errs []string
+	}{
+		{
+			`{"id": "A", "type": "kvCard", "cards": ["#query.A.data"],
+			  "#query": {"A": {"type": "element", "table": "t", "function": "sum(v)"}}}`,
+			nil,
+		},
+		{
+			`{"type": 1, "#query": {"type": "select_colum", "table": "t"}}`,
+			[]string{
+				"$.type: must be a string",
+				"$.id: is required",
+				"$.type: is required",
+				`$.#query.type: unknown query type "select_colum"`,
+			},
+		},
+		{
+			`{"id": "A", "type": "kvCard", "cards": [{"content": "#query.C.data"}],
+			  "#query": {
+				"A": {"type": "xox", "table": "t", "function": "sum(v)", "period": "quater"},
+				"B": {"type": "aggregate", "table": 5, "function": "sum(v)"}
+			  }}`,
+			[]string{
+				`$.#query.A.period: unknown period "quater"`,
+				"$.#query.B.table: must be a string",
+				"$.#query.B.table: is required by aggregate query",
+				"$.#query.B.group_key: is required by aggregate query",
+				`$.cards[0].content: query tag "#query.C.data" refers to unknown query "C"`,
+			},
+		},
+		{
+			`{"id": "A", "type": "kvCard", "cards": ["#query.A.data"],
+			  "#query": {
+				"A": {"type": "element", "table": "t", "function": "sum(v)", "percent": "row", "horizon": 3},
+				"B": {"type": "derived", "expression": "A * 2", "table": "t"}
+			  }}`,
+			[]string{
+				"$.#query.A.horizon: is not supported by element query",
+				"$.#query.A.percent: is not supported by element query",
+				"$.#query.B.table: is not supported by derived query",
+			},
+		},
+		{
+			`{"id": "T", "type": "table"}`,
+			[]string{"$.table: is required by table figure"},
+		},
+	}
+
+	for i, tc := range testCases {
+		fig, err := DecodeFigure([]byte(tc.in))
+		if err != nil {
+			t.Fatal(i, err)
+		}
+		var got []string
+		if errs, ok := fig.Validate().(ValidationErrors); ok {
+			for _, e := range errs {
+				got = append(got, e.Error())
+			}
+		}
+		if !reflect.DeepEqual(tc.errs, got) {
+			t.Error(i, ":", "want", tc.errs, "got", got)
+		}
+	}
+}
+
+func TestValidatePage(t *testing.T) {
+	page, err := DecodePage([]byte(`{
+		"id": "P",
+		"title": "Page",
+		"dateView": 15,
+		"dataView": [
+			{"type": "chartView", "figures": [
+				{"type": "figureBox", "figures": [{"type": "LineChart"}, {"id": "B", "type": "kvCard"}]}
+			]},
+			{"type": "tableView", "figures": "P.Table"}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "$.dataView[0].figures[0].figures[0].id: is required; " +
+		"$.dataView[1].figures: must be an array; " +
+		"$.dataView[1].id: is required"
+	err = page.Validate()
+	if err == nil || err.Error() != want {
+		t.Error("want", want, "got", err)
+	}
+}
+
+func TestRepositoryFiguresValid(t *testing.T) {
+	files, _ := filepath.Glob("../figures/*/figures/*.json")
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fig, err := DecodeFigure(b)
+		if err != nil {
+			t.Error(file, err)
+			continue
+		}
+		if err := fig.Validate(); err != nil {
+			t.Error(file, err)
+		}
+	}
+
+	pages, _ := filepath.Glob("../figures/*/pages/*.json")
+	for _, file := range pages {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		page, err := DecodePage(b)
+		if err != nil {
+			t.Error(file, err)
+			continue
+		}
+		if err := page.Validate(); err != nil {
+			t.Error(file, err)
+		}
+	}
+}
+
+func TestReferencedColumns(t *testing.T) {
+	testCases := []struct {
+		query QuerySpec
+		out   []string
+	}{
+		{QuerySpec{Type: "select_column", Column: "count+increase_count+decrease_count"},
+			[]string{"date", "period", "count", "increase_count", "decrease_count"}},
+		{QuerySpec{Type: "aggregate", GroupKey: "item", Function: "sum(value)"},
+			[]string{"date", "period", "item", "value"}},
+		{QuerySpec{Type: "distinct", Column: "city"}, []string{"city"}},
+		{QuerySpec{Type: "element", Function: "sum(CASE WHEN Kind = 'a b' THEN 1 ELSE 0 END) / count(DISTINCT id)"},
+			[]string{"date", "period", "kind", "id"}},
+	}
+
+	for i, tc := range testCases {
+		out := tc.query.ReferencedColumns()
+		if !reflect.DeepEqual(tc.out, out) {
+			t.Error(i, ":", "want", tc.out, "got", out)
+		}
+	}
+}
@@ -0,0 +1,589 @@
+package figure_parser
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/bluecover/lm/models"
+)
+
+// maxSQLExprLength and maxSQLExprDepth bound the size of query expressions
+const (
+	maxSQLExprLength = 1000
+	maxSQLExprDepth  = 32
+)
+
+// sqlAggregates are the aggregate functions usable in query expressions
+var sqlAggregates = map[string]bool{
+	"sum": true, "avg": true, "count": true, "min": true, "max": true,
+}
+
+// sqlScalars are the other functions usable in query expressions
+var sqlScalars = map[string]bool{
+	"abs": true, "round": true, "coalesce": true, "nullif": true,
+}
+
+var sqlKeywords = map[string]bool{
+	"case": true, "when": true, "then": true, "else": true, "end": true,
+	"and": true, "or": true, "not": true, "is": true, "null": true,
+	"distinct": true, "true": true, "false": true,
+}
+
+// sqlExpr is a parsed "function", "column" or key expression of a query.
+// It only holds column references, literals, arithmetic, comparisons,
+// whitelisted functions and CASE, and renders back to SQL with every column
+// quoted, so a figure definition can not run arbitrary SQL. A name is a
+// column unless it is followed by "(", so a column may be called "count".
+//
+//	sum(total_borrow_amount) / sum(borrower_num)
+//	count+increase_count+decrease_count
+//	sum(CASE WHEN status = 'open' THEN 1 ELSE 0 END)
+type sqlExpr struct {
+	// kind is one of "column", "number", "string", "null", "bool", "star",
+	// "unary", "binary", "call", "case" and "is"
+	kind string
+	// column name, literal text, operator or function name
+	text string
+	// operands, call arguments, or WHEN/THEN pairs followed by ELSE for case
+	args []*sqlExpr
+	// call: count(DISTINCT x); is: IS NOT NULL; case: has ELSE
+	flag bool
+}
+
+type sqlExprParser struct {
+	src    string
+	tokens []string
+	pos    int
+	depth  int
+}
+
+// parseSQLExpr parses a query expression
+func parseSQLExpr(src string) (*sqlExpr, error) {
+	if len(src) > maxSQLExprLength {
+		return nil, fmt.Errorf("expression is longer than %d characters", maxSQLExprLength)
+	}
+	tokens, err := tokenizeSQLExpr(src)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("empty expression")
+	}
+	p := &sqlExprParser{src: src, tokens: tokens}
+	e, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q in expression %q", p.tokens[p.pos], src)
+	}
+	return e, nil
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func tokenizeSQLExpr(src string) ([]string, error) {
+	tokens := make([]string, 0)
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case strings.HasPrefix(src[i:], "<=") || strings.HasPrefix(src[i:], ">=") ||
+			strings.HasPrefix(src[i:], "<>") || strings.HasPrefix(src[i:], "!="):
+			tokens = append(tokens, src[i:i+2])
+			i += 2
+		case strings.IndexByte("+-*/%(),=<>", c) >= 0:
+			tokens = append(tokens, string(c))
+			i++
+		case c == '\'' || c == '"':
+			// 'string' and "quoted identifier", a doubled quote escapes itself
+			j := i + 1
+			for ; j < len(src); j++ {
+				if src[j] == c {
+					if j+1 < len(src) && src[j+1] == c {
+						j++
+						continue
+					}
+					break
+				}
+			}
+			if j >= len(src) {
+				return nil, fmt.Errorf("unterminated quote in expression %q", src)
+			}
+			tokens = append(tokens, src[i:j+1])
+			i = j + 1
+		case c == '.' || isDigit(c):
+			j := i
+			for j < len(src) && (src[j] == '.' || isDigit(src[j])) {
+				j++
+			}
+			tokens = append(tokens, src[i:j])
+			i = j
+		case isIdentStart(c):
+			j := i
+			for j < len(src) && (isIdentStart(src[j]) || isDigit(src[j])) {
+				j++
+			}
+			tokens = append(tokens, src[i:j])
+			i = j
+		default:
+			return nil, fmt.Errorf("invalid character %q in expression %q", c, src)
+		}
+	}
+	return tokens, nil
+}
+
+func (p *sqlExprParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+// keyword reports whether the next token is the keyword kw
+func (p *sqlExprParser) keyword(kw string) bool {
+	return strings.EqualFold(p.peek(), kw)
+}
+
+func (p *sqlExprParser) expect(t string) error {
+	if !strings.EqualFold(p.peek(), t) {
+		if p.pos >= len(p.tokens) {
+			return fmt.Errorf("missing %s at end of expression %q", t, p.src)
+		}
+		return fmt.Errorf("expected %s but got %q in expression %q", t, p.peek(), p.src)
+	}
+	p.pos++
+	return nil
+}
+
+func (p *sqlExprParser) parseOr() (*sqlExpr, error) {
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > maxSQLExprDepth {
+		return nil, fmt.Errorf("expression %q is nested too deeply", p.src)
+	}
+
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("or") {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &sqlExpr{kind: "binary", text: "OR", args: []*sqlExpr{left, right}}
+	}
+	return left, nil
+}
+
+func (p *sqlExprParser) parseAnd() (*sqlExpr, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("and") {
+		p.pos++
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &sqlExpr{kind: "binary", text: "AND", args: []*sqlExpr{left, right}}
+	}
+	return left, nil
+}
+
+func (p *sqlExprParser) parseNot() (*sqlExpr, error) {
+	if p.keyword("not") {
+		p.pos++
+		e, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &sqlExpr{kind: "unary", text: "NOT ", args: []*sqlExpr{e}}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *sqlExprParser) parseComparison() (*sqlExpr, error) {
+	left, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	switch t := p.peek(); t {
+	case "=", "<>", "!=", "<", "<=", ">", ">=":
+		p.pos++
+		right, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		if t == "!=" {
+			t = "<>"
+		}
+		return &sqlExpr{kind: "binary", text: t, args: []*sqlExpr{left, right}}, nil
+	}
+	if p.keyword("is") {
+		p.pos++
+		not := p.keyword("not")
+		if not {
+			p.pos++
+		}
+		if err := p.expect("null"); err != nil {
+			return nil, err
+		}
+		return &sqlExpr{kind: "is", args: []*sqlExpr{left}, flag: not}, nil
+	}
+	return left, nil
+}
+
+func (p *sqlExprParser) parseSum() (*sqlExpr, error) {
+	left, err := p.parseProduct()
+	if err != nil {
+		return nil, err
+	}
+	for t := p.peek(); t == "+" || t == "-"; t = p.peek() {
+		p.pos++
+		right, err := p.parseProduct()
+		if err != nil {
+			return nil, err
+		}
+		left = &sqlExpr{kind: "binary", text: t, args: []*sqlExpr{left, right}}
+	}
+	return left, nil
+}
+
+func (p *sqlExprParser) parseProduct() (*sqlExpr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for t := p.peek(); t == "*" || t == "/" || t == "%"; t = p.peek() {
+		p.pos++
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &sqlExpr{kind: "binary", text: t, args: []*sqlExpr{left, right}}
+	}
+	return left, nil
+}
+
+func (p *sqlExprParser) parseUnary() (*sqlExpr, error) {
+	if t := p.peek(); t == "-" || t == "+" {
+		p.pos++
+		e, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &sqlExpr{kind: "unary", text: t, args: []*sqlExpr{e}}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *sqlExprParser) parsePrimary() (*sqlExpr, error) {
+	t := p.peek()
+	p.pos++
+	lower := strings.ToLower(t)
+	switch {
+	case t == "":
+		return nil, fmt.Errorf("unexpected end of expression %q", p.src)
+	case t == "(":
+		e, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return e, p.expect(")")
+	case t[0] == '\'':
+		return &sqlExpr{kind: "string", text: strings.Replace(t[1:len(t)-1], "''", "'", -1)}, nil
+	case t[0] == '"':
+		return &sqlExpr{kind: "column", text: strings.Replace(t[1:len(t)-1], `""`, `"`, -1)}, nil
+	case t[0] == '.' || isDigit(t[0]):
+		if _, err := strconv.ParseFloat(t, 64); err != nil {
+			return nil, fmt.Errorf("invalid number %q in expression %q", t, p.src)
+		}
+		return &sqlExpr{kind: "number", text: t}, nil
+	case !isIdentStart(t[0]):
+		return nil, fmt.Errorf("unexpected %q in expression %q", t, p.src)
+	case lower == "null":
+		return &sqlExpr{kind: "null"}, nil
+	case lower == "true" || lower == "false":
+		return &sqlExpr{kind: "bool", text: strings.ToUpper(lower)}, nil
+	case lower == "case":
+		return p.parseCase()
+	case p.peek() == "(":
+		p.pos++
+		return p.parseCall(lower)
+	case sqlKeywords[lower]:
+		return nil, fmt.Errorf("unexpected %q in expression %q", t, p.src)
+	default:
+		// unquoted names are folded to lower case as the database does
+		return &sqlExpr{kind: "column", text: lower}, nil
+	}
+}
+
+// parseCall parses the arguments of a function call after its "("
+func (p *sqlExprParser) parseCall(name string) (*sqlExpr, error) {
+	if !sqlAggregates[name] && !sqlScalars[name] {
+		return nil, fmt.Errorf("function %s is not allowed in expression %q", name, p.src)
+	}
+	call := &sqlExpr{kind: "call", text: name}
+	if name == "count" && p.peek() == "*" {
+		p.pos++
+		call.args = []*sqlExpr{{kind: "star"}}
+		return call, p.expect(")")
+	}
+	if sqlAggregates[name] && p.keyword("distinct") {
+		p.pos++
+		call.flag = true
+	}
+	for {
+		arg, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		call.args = append(call.args, arg)
+		if p.peek() != "," {
+			break
+		}
+		p.pos++
+	}
+	if sqlAggregates[name] && len(call.args) != 1 {
+		return nil, fmt.Errorf("%s takes one argument in expression %q", name, p.src)
+	}
+	return call, p.expect(")")
+}
+
+// parseCase parses a searched CASE after its CASE keyword
+func (p *sqlExprParser) parseCase() (*sqlExpr, error) {
+	c := &sqlExpr{kind: "case"}
+	for p.keyword("when") {
+		p.pos++
+		cond, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect("then"); err != nil {
+			return nil, err
+		}
+		value, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		c.args = append(c.args, cond, value)
+	}
+	if len(c.args) == 0 {
+		return nil, fmt.Errorf("CASE needs a WHEN in expression %q", p.src)
+	}
+	if p.keyword("else") {
+		p.pos++
+		value, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		c.args = append(c.args, value)
+		c.flag = true
+	}
+	return c, p.expect("end")
+}
+
+// SQL renders the expression
+func (e *sqlExpr) SQL() string {
+	var b bytes.Buffer
+	e.render(&b)
+	return b.String()
+}
+
+func (e *sqlExpr) render(b *bytes.Buffer) {
+	switch e.kind {
+	case "column":
+		b.WriteString(models.QuoteIdentifier(e.text))
+	case "number", "bool":
+		b.WriteString(e.text)
+	case "string":
+		b.WriteString("'" + strings.Replace(e.text, "'", "''", -1) + "'")
+	case "null":
+		b.WriteString("NULL")
+	case "star":
+		b.WriteString("*")
+	case "unary":
+		b.WriteString("(" + e.text)
+		e.args[0].render(b)
+		b.WriteString(")")
+	case "binary":
+		b.WriteString("(")
+		e.args[0].render(b)
+		b.WriteString(" " + e.text + " ")
+		e.args[1].render(b)
+		b.WriteString(")")
+	case "is":
+		b.WriteString("(")
+		e.args[0].render(b)
+		if e.flag {
+			b.WriteString(" IS NOT NULL)")
+		} else {
+			b.WriteString(" IS NULL)")
+		}
+	case "call":
+		b.WriteString(e.text + "(")
+		if e.flag {
+			b.WriteString("DISTINCT ")
+		}
+		for i, arg := range e.args {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			arg.render(b)
+		}
+		b.WriteString(")")
+	case "case":
+		b.WriteString("CASE")
+		n := len(e.args)
+		if e.flag {
+			n--
+		}
+		for i := 0; i < n; i += 2 {
+			b.WriteString(" WHEN ")
+			e.args[i].render(b)
+			b.WriteString(" THEN ")
+			e.args[i+1].render(b)
+		}
+		if e.flag {
+			b.WriteString(" ELSE ")
+			e.args[n].render(b)
+		}
+		b.WriteString(" END")
+	}
+}
+
+func (e *sqlExpr) walk(fn func(e *sqlExpr)) {
+	fn(e)
+	for _, arg := range e.args {
+		arg.walk(fn)
+	}
+}
+
+// Columns returns the columns the expression refers to in order of appearance
+func (e *sqlExpr) Columns() []string {
+	cols := make([]string, 0)
+	e.walk(func(e *sqlExpr) {
+		if e.kind == "column" {
+			cols = append(cols, e.text)
+		}
+	})
+	return cols
+}
+
+// HasAggregate reports whether the expression calls an aggregate function
+func (e *sqlExpr) HasAggregate() bool {
+	found := false
+	e.walk(func(e *sqlExpr) {
+		if e.kind == "call" && sqlAggregates[e.text] {
+			found = true
+		}
+	})
+	return found
+}
+
+// sqlField is a field of a query holding an expression
+type sqlField struct {
+	name  string
+	value *string
+	// whether the expression may aggregate, otherwise it is read per row
+	aggregate bool
+	// the field is declared by the query type and kept in Raw only
+	raw bool
+}
+
+func (q *QuerySpec) sqlFields() []sqlField {
+	if q.Type == "derived" {
+		return nil
+	}
+	fields := []sqlField{
+		{"column", &q.Column, false, false},
+		{"group_key", &q.GroupKey, false, false},
+		{"function", &q.Function, true, false},
+		{"weight", &q.Weight, false, false},
+		{"row_key", &q.RowKey, false, false},
+		{"column_key", &q.ColumnKey, false, false},
+		{"x", &q.X, true, false},
+		{"y", &q.Y, true, false},
+	}
+	for _, f := range queryTypeOf(q.Type).SQLFields {
+		value, _ := q.Raw[f.Name].(string)
+		fields = append(fields, sqlField{f.Name, &value, f.Aggregate, true})
+	}
+	return fields
+}
+
+func (q QuerySpec) validateSQL(path string, errs *ValidationErrors) {
+	for _, f := range q.sqlFields() {
+		if len(*f.value) == 0 {
+			continue
+		}
+		e, err := parseSQLExpr(*f.value)
+		if err != nil {
+			errs.add(joinPath(path, f.name), "%s", err)
+		} else if !f.aggregate && e.HasAggregate() {
+			errs.add(joinPath(path, f.name), "must not call aggregate functions")
+		}
+	}
+}
+
+// compileSQL checks the columns the expressions of a validated query refer
+// to exist in its table, and replaces the expressions with their SQL.
+func compileSQL(query *QuerySpec, columns []string) error {
+	known := make(map[string]bool, len(columns))
+	for _, c := range columns {
+		known[c] = true
+	}
+	var errs ValidationErrors
+	var raw map[string]interface{}
+	for _, f := range query.sqlFields() {
+		if len(*f.value) == 0 {
+			continue
+		}
+		e, err := parseSQLExpr(*f.value)
+		if err != nil {
+			errs.add(joinPath(rootPath, f.name), "%s", err)
+			continue
+		}
+		for _, c := range e.Columns() {
+			if !known[c] {
+				known[c] = true
+				errs.add(joinPath(rootPath, f.name), "column %s does not exist in table %s", c, query.Table)
+			}
+		}
+		if !f.raw {
+			*f.value = e.SQL()
+			continue
+		}
+		// Raw is shared with the query compiled from
+		if raw == nil {
+			raw = make(map[string]interface{}, len(query.Raw))
+			for k, v := range query.Raw {
+				raw[k] = v
+			}
+		}
+		raw[f.name] = e.SQL()
+	}
+	if raw != nil {
+		query.Raw = raw
+	}
+	return errs.orNil()
+}
+
+// hasAggregate reports whether the expression calls an aggregate function
+func hasAggregate(expr string) bool {
+	e, err := parseSQLExpr(expr)
+	return err == nil && e.HasAggregate()
+}
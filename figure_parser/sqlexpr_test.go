@@ -0,0 +1,116 @@
+package figure_parser
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSQLExpr(t *testing.T) {
+	testCases := []struct {
+		expr string
+		sql  string
+	}{
+		{"adr", `"adr"`},
+		{"count", `"count"`},
+		{"ADR", `"adr"`},
+		{`"Room Type"`, `"Room Type"`},
+		{"avg(total_borrow_amount/borrower_num)", `avg(("total_borrow_amount" / "borrower_num"))`},
+		{"count+increase_count+decrease_count", `(("count" + "increase_count") + "decrease_count")`},
+		{"count(*)", "count(*)"},
+		{"COUNT(DISTINCT id)", `count(DISTINCT "id")`},
+		{"-sum(a) * 2.5", `((-sum("a")) * 2.5)`},
+		{"sum(CASE WHEN kind = 'it''s' AND NOT a IS NULL THEN 1 ELSE 0 END)",
+			`sum(CASE WHEN (("kind" = 'it''s') AND (NOT ("a" IS NULL))) THEN 1 ELSE 0 END)`},
+		{"round(coalesce(a, 0), 2)", `round(coalesce("a", 0), 2)`},
+		{"a != b", `("a" <> "b")`},
+	}
+
+	for i, tc := range testCases {
+		e, err := parseSQLExpr(tc.expr)
+		if err != nil {
+			t.Error(i, ":", err)
+			continue
+		}
+		if sql := e.SQL(); sql != tc.sql {
+			t.Error(i, ":", "want", tc.sql, "got", sql)
+		}
+		// rendered SQL parses back to itself
+		if again, err := parseSQLExpr(e.SQL()); err != nil || again.SQL() != tc.sql {
+			t.Error(i, ":", "round trip of", tc.sql, "failed", err)
+		}
+	}
+}
+
+func TestParseSQLExprRejects(t *testing.T) {
+	testCases := []string{
+		"",
+		"sum(value) AS total",
+		"a; DROP TABLE users",
+		"pg_sleep(10)",
+		"(SELECT password FROM users)",
+		"a /* comment */",
+		"a::text",
+		`"a`,
+		"'a",
+		"sum(a, b)",
+		"CASE ELSE 1 END",
+		"sum(a",
+		"a b",
+	}
+
+	for i, expr := range testCases {
+		if e, err := parseSQLExpr(expr); err == nil {
+			t.Error(i, ":", "want error for", expr, "got", e.SQL())
+		}
+	}
+}
+
+func TestCompileSQL(t *testing.T) {
+	query := QuerySpec{Type: "aggregate", Table: "HTHT.hotel", GroupKey: "City", Function: "avg(adr)"}
+	if err := compileSQL(&query, []string{"date", "period", "city", "adr"}); err != nil {
+		t.Fatal(err)
+	}
+	if query.GroupKey != `"city"` || query.Function != `avg("adr")` {
+		t.Error("want", `"city"`, `avg("adr")`, "got", query.GroupKey, query.Function)
+	}
+
+	query = QuerySpec{Type: "element", Table: "HTHT.hotel", Function: "sum(revpar) / sum(revpar)"}
+	err := compileSQL(&query, []string{"date", "period", "adr"})
+	want := ValidationErrors{{"$.function", "column revpar does not exist in table HTHT.hotel"}}
+	if !reflect.DeepEqual(want, err) {
+		t.Error("want", want, "got", err)
+	}
+}
+
+func TestValidateSQL(t *testing.T) {
+	query, _ := DecodeQuery([]byte(`{"type": "aggregate", "table": "t", "group_key": "sum(a)",
+		"function": "sum(b) AS total"}`))
+	err := query.Validate()
+	want := ValidationErrors{
+		{"$.group_key", "must not call aggregate functions"},
+		{"$.function", `unexpected "AS" in expression "sum(b) AS total"`},
+	}
+	if !reflect.DeepEqual(want, err) {
+		t.Error("want", want, "got", err)
+	}
+}
+
+func TestOrderByColumn(t *testing.T) {
+	testCases := []struct {
+		in  string
+		out string
+		err bool
+	}{
+		{"date", `"date"`, false},
+		{"date desc", `"date" DESC`, false},
+		{"date; DROP TABLE users", "", true},
+		{"sum(a)", "", true},
+	}
+
+	for i, tc := range testCases {
+		out, _, err := orderByColumn(tc.in)
+		if out != tc.out || (err != nil) != tc.err {
+			t.Error(i, ":", "want", tc.out, tc.err, "got", out, err)
+		}
+	}
+}
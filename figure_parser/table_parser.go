@@ -1,19 +1,55 @@
 package figure_parser
 
 import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
 	"github.com/jinzhu/gorm"
 )
 
-func ParseTable(fig map[string]interface{}, args ParseArgs, page, limit int, sortby string, db *gorm.DB) (map[string]interface{}, error) {
-	queryResult, err := NewQuery(fig, args, page, limit, sortby).Run(db)
+// ParseTable fills a page of rows of a table figure into it
+func ParseTable(ctx context.Context, figure *FigureSpec, args ParseArgs, page, limit int, sortby string,
+	db *gorm.DB) (map[string]interface{}, error) {
+
+	if err := figure.Validate(); err != nil {
+		return nil, err
+	}
+	ctx, cancel := withFigureBudget(ctx)
+	defer cancel()
+	if figure.Queries != nil && figure.Queries.Single != nil {
+		fig, err := parsePivotTable(ctx, figure, args, page, limit, sortby, db)
+		return fig, timeoutError(ctx, err)
+	}
+	columns, err := columnsOfTable(figure.Table, db)
 	if err != nil {
 		return nil, err
 	}
+	query, err := NewQuery(figure, args, page, limit, sortby, columns)
+	if err != nil {
+		return nil, err
+	}
+	ctx, qt := traceQuery(ctx, QuerySpec{Type: "table", Table: query.Table})
+	qt.setArgs(args)
+	queryResult, err := query.Run(ctx, db)
+	qt.finish(err)
+	if err != nil {
+		return nil, timeoutError(ctx, err)
+	}
 
+	formats := make([]NumberFormat, len(queryResult.Columns))
+	for i, col := range queryResult.Columns {
+		formats[i] = args.numberFormat(figure.Formats, col)
+	}
 	columnData := make([][]string, len(queryResult.Columns))
 	for _, row := range queryResult.Data {
 		for i, value := range row {
-			columnData[i] = append(columnData[i], Format(value))
+			if _, ok := value.(time.Time); ok {
+				columnData[i] = append(columnData[i], Format(value))
+			} else {
+				columnData[i] = append(columnData[i], fmt.Sprint(formats[i].Format(value)))
+			}
 		}
 	}
 
@@ -27,6 +63,7 @@ func ParseTable(fig map[string]interface{}, args ParseArgs, page, limit int, sor
 		}
 	}
 
+	fig := figure.Raw
 	figData, ok := fig["data"].(map[string]interface{})
 	if !ok {
 		figData = map[string]interface{}{}
@@ -37,3 +74,79 @@ func ParseTable(fig map[string]interface{}, args ParseArgs, page, limit int, sor
 	fig["data"] = figData
 	return fig, nil
 }
+
+// parsePivotTable renders the pivot query of a table figure
+func parsePivotTable(ctx context.Context, figure *FigureSpec, args ParseArgs, page, limit int, sortby string, db *gorm.DB) (map[string]interface{}, error) {
+	query := *figure.Queries.Single
+	result, err := ParseQuery(withTraceName(ctx, queryKey), query, args, db)
+	if err != nil {
+		return nil, err
+	}
+	columns, total := pivotTableColumns(result, query.RowKey, page, limit, sortby)
+
+	fig := figure.Raw
+	delete(fig, queryKey)
+	figData, ok := fig["data"].(map[string]interface{})
+	if !ok {
+		figData = map[string]interface{}{}
+	}
+	figData["total"] = total
+	figData["currentPage"] = page
+	figData["columns"] = columns
+	figData["column_totals"] = result["column_totals"]
+	figData["grand_total"] = result["total"]
+	fig["data"] = figData
+	fig[handledByKey] = handledBy(figure.Queries, nil)
+	return fig, nil
+}
+
+// ExportTable reads all rows of a table figure for a download. Pivot tables
+// are laid out as ParseTable renders them, with their values as numbers.
+func ExportTable(ctx context.Context, figure *FigureSpec, args ParseArgs, sortby string,
+	db *gorm.DB) (QueryResult, error) {
+
+	if err := figure.Validate(); err != nil {
+		return QueryResult{}, err
+	}
+	ctx, cancel := withFigureBudget(ctx)
+	defer cancel()
+	if figure.Queries != nil && figure.Queries.Single != nil {
+		query := *figure.Queries.Single
+		result, err := ParseQuery(ctx, query, args, db)
+		if err != nil {
+			return QueryResult{}, timeoutError(ctx, err)
+		}
+		columns, total := pivotTableColumns(result, query.RowKey, 0, 0, sortby)
+		return pivotQueryResult(columns, total), nil
+	}
+	columns, err := columnsOfTable(figure.Table, db)
+	if err != nil {
+		return QueryResult{}, err
+	}
+	query, err := NewQuery(figure, args, 0, 0, sortby, columns)
+	if err != nil {
+		return QueryResult{}, err
+	}
+	queryResult, err := query.Run(ctx, db)
+	return queryResult, timeoutError(ctx, err)
+}
+
+// pivotQueryResult turns the columns of a pivot table into rows
+func pivotQueryResult(columns []map[string]interface{}, total int) QueryResult {
+	qr := QueryResult{Total: total, Columns: make([]string, len(columns)), Data: make(Table, total)}
+	for i := range qr.Data {
+		qr.Data[i] = make(TableRow, len(columns))
+	}
+	for k, column := range columns {
+		qr.Columns[k], _ = column["title"].(string)
+		data, _ := column["data"].([]string)
+		for i, s := range data {
+			qr.Data[i][k] = s
+			// the first column holds the row values
+			if v, err := strconv.ParseFloat(s, 64); err == nil && k > 0 {
+				qr.Data[i][k] = v
+			}
+		}
+	}
+	return qr
+}
@@ -0,0 +1,276 @@
+package figure_parser
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// figureTemplate is a string of a "template": true figure holding a
+// template, and where its output goes. Every string is a template of its
+// own and its output stays a string, so values filled in need no JSON
+// escaping and can not change the structure of the figure.
+//
+//	"content": "{{.A.data | printNumber}}"
+//	"content": "{{change .B.change}} vs {{periodLabel start}}"
+//	"content": "{{number \"A\" .A.data}}"
+//	"type": "{{trend .B.change \"up\" \"down\" \"flat\"}}"
+type figureTemplate struct {
+	QueryTag
+	tmpl *template.Template
+}
+
+// templateFuncs are the helpers of figure templates. The ParseArgs helpers
+// are bound when a template is executed.
+var templateFuncs = template.FuncMap{
+	"printNumber": PrintNumber,
+	"percent":     templatePercent,
+	"change":      templateChange,
+	"signed":      templateSigned,
+	"currency":    templateCurrency,
+	"date":        templateDate,
+	"default":     templateDefault,
+	"isUp":        templateIsUp,
+	"isDown":      templateIsDown,
+	"trend":       templateTrend,
+
+	"period":      func() string { return "" },
+	"start":       func() time.Time { return time.Time{} },
+	"end":         func() time.Time { return time.Time{} },
+	"periodLabel": func(interface{}) string { return "" },
+	"number":      func(string, interface{}) string { return "" },
+	"dateRange":   func() string { return "" },
+}
+
+// argFuncs gives the templates of a figure the selected period, dates and
+// locale, and its number formats
+func argFuncs(args ParseArgs, formats map[string]NumberFormat) template.FuncMap {
+	label := func(v interface{}) string {
+		t, ok := toTime(v)
+		if !ok {
+			return fmt.Sprint(v)
+		}
+		return args.Calendar.FormatTimeIn(t, args.Period, args.Locale)
+	}
+	return template.FuncMap{
+		"printNumber": func(v ...interface{}) string {
+			if len(v) == 0 {
+				return ""
+			}
+			return fmt.Sprint(args.numberFormat(nil, "").Format(v[0]))
+		},
+		"number": func(name string, v interface{}) string {
+			return fmt.Sprint(args.numberFormat(formats, name).Format(v))
+		},
+		"period":      func() string { return args.Period },
+		"start":       func() time.Time { return args.Start },
+		"end":         func() time.Time { return args.End },
+		"periodLabel": label,
+		"dateRange":   func() string { return label(args.Start) + " - " + label(args.End) },
+	}
+}
+
+// parseTemplates parses the template strings found in v, recording their
+// errors at their path
+func parseTemplates(name string, path string, v interface{}, templates *[]figureTemplate, errs *ValidationErrors) {
+	add := func(tag QueryTag) {
+		if !strings.Contains(tag.Value, "{{") {
+			return
+		}
+		t, err := template.New(name + tag.Path).Funcs(templateFuncs).Parse(tag.Value)
+		if err != nil {
+			errs.add(tag.Path, "%s", err)
+			return
+		}
+		*templates = append(*templates, figureTemplate{tag, t})
+	}
+
+	switch c := v.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(c))
+		for k := range c {
+			keys = append(keys, k)
+		}
+		// sorted, so that errors are reported in a stable order
+		sort.Strings(keys)
+		for _, k := range keys {
+			item := c[k]
+			if k == queryKey {
+				continue
+			}
+			if s, ok := item.(string); ok {
+				add(QueryTag{Container: c, Key: k, Value: s, Path: joinPath(path, k)})
+			} else {
+				parseTemplates(name, joinPath(path, k), item, templates, errs)
+			}
+		}
+	case []interface{}:
+		for i, item := range c {
+			if s, ok := item.(string); ok {
+				add(QueryTag{Container: c, Index: i, Value: s, Path: joinPath(path, indexPath(i))})
+			} else {
+				parseTemplates(name, joinPath(path, indexPath(i)), item, templates, errs)
+			}
+		}
+	}
+}
+
+// executeTemplates fills the output of the templates of a figure into it
+func executeTemplates(templates []figureTemplate, queryResults map[string]interface{}, args ParseArgs,
+	formats map[string]NumberFormat) error {
+
+	funcs := argFuncs(args, formats)
+	for _, ft := range templates {
+		t, err := ft.tmpl.Clone()
+		if err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		if err := t.Funcs(funcs).Execute(&buf, queryResults); err != nil {
+			return err
+		}
+		switch c := ft.Container.(type) {
+		case map[string]interface{}:
+			c[ft.Key] = buf.String()
+		case []interface{}:
+			c[ft.Index] = buf.String()
+		}
+	}
+	return nil
+}
+
+// toFloat reads a number from a query result value such as 12, "1,234.5"
+// or "12.50%"
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case string:
+		s := strings.TrimSuffix(strings.Replace(strings.TrimSpace(n), ",", "", -1), "%")
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return 0, false
+		}
+		return f, true
+	}
+	return 0, false
+}
+
+func toTime(v interface{}) (time.Time, bool) {
+	switch t := v.(type) {
+	case time.Time:
+		return t, !t.IsZero()
+	case string:
+		for _, layout := range []string{ResultTimeFormat, outputTimeFormat, TimeFormat, time.RFC3339} {
+			if d, err := time.Parse(layout, t); err == nil {
+				return d, true
+			}
+		}
+	}
+	return time.Time{}, false
+}
+
+// templatePercent formats a ratio as percent, 0.125 as "12.50%"
+func templatePercent(v interface{}) string {
+	f, ok := toFloat(v)
+	if !ok {
+		return "-"
+	}
+	return strconv.FormatFloat(f*100, 'f', 2, 64) + "%"
+}
+
+// templateChange formats a change given in percent with its sign, "12.5"
+// or "12.50%" as "+12.50%"
+func templateChange(v interface{}) string {
+	f, ok := toFloat(v)
+	if !ok {
+		return "-"
+	}
+	s := strconv.FormatFloat(f, 'f', 2, 64) + "%"
+	if f > 0 {
+		s = "+" + s
+	}
+	return s
+}
+
+// templateSigned formats a number with its sign, 1234.5 as "+1,234.50"
+func templateSigned(v interface{}) string {
+	f, ok := toFloat(v)
+	if !ok {
+		return "-"
+	}
+	s := PrintNumber(f)
+	if f > 0 {
+		s = "+" + s
+	}
+	return s
+}
+
+// templateCurrency formats a number as an amount of money, "¥1,234.50"
+func templateCurrency(symbol string, v interface{}) string {
+	f, ok := toFloat(v)
+	if !ok {
+		return "-"
+	}
+	if f < 0 {
+		return "-" + symbol + PrintNumber(-f)
+	}
+	return symbol + PrintNumber(f)
+}
+
+// templateDate formats a time or a date string with a Go layout
+func templateDate(layout string, v interface{}) string {
+	t, ok := toTime(v)
+	if !ok {
+		return fmt.Sprint(v)
+	}
+	return t.Format(layout)
+}
+
+// templateDefault returns v, or def if v is missing, empty or "-"
+func templateDefault(def interface{}, v ...interface{}) interface{} {
+	if len(v) == 0 || v[0] == nil {
+		return def
+	}
+	if s, ok := v[0].(string); ok && (len(s) == 0 || s == "-" || s == "N/A") {
+		return def
+	}
+	return v[0]
+}
+
+// templateIsUp reports whether v is a positive number
+func templateIsUp(v interface{}) bool {
+	f, ok := toFloat(v)
+	return ok && f > 0
+}
+
+// templateIsDown reports whether v is a negative number
+func templateIsDown(v interface{}) bool {
+	f, ok := toFloat(v)
+	return ok && f < 0
+}
+
+// templateTrend returns up, down or flat by the sign of v, e.g. for the
+// style of a change
+func templateTrend(v interface{}, up, down, flat string) string {
+	f, ok := toFloat(v)
+	switch {
+	case !ok || f == 0:
+		return flat
+	case f > 0:
+		return up
+	default:
+		return down
+	}
+}
@@ -0,0 +1,89 @@
+package figure_parser
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestExecuteTemplates(t *testing.T) {
+	fig, err := DecodeFigure([]byte(`{"id": "F", "type": "kvCard", "template": true,
+		"cards": [
+			{"content": "{{.A.data | printNumber}}", "type": 0},
+			{"content": "{{change .B.change}} {{trend .B.change \"up\" \"down\" \"flat\"}}"},
+			{"content": "{{default \"-\" .C.data}}", "note": "{{.C.name}} \"quoted\""}
+		],
+		"range": ["{{dateRange}}", "{{period}}", "{{.A.data | currency \"¥\"}}"],
+		"#query": {"A": {"type": "derived", "expression": "1"}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fig.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	results := map[string]interface{}{
+		"A": map[string]interface{}{"data": "1234.5"},
+		"B": map[string]interface{}{"change": "-12.50%"},
+		"C": map[string]interface{}{"data": nil, "name": `a "b" </script>`},
+	}
+	args := ParseArgs{
+		Period: PeriodMonth,
+		Start:  time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC),
+		End:    time.Date(2018, 3, 31, 0, 0, 0, 0, time.UTC),
+	}
+	if err := executeTemplates(fig.templates, results, args, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]interface{}{
+		"cards": []interface{}{
+			map[string]interface{}{"content": "1,234.50", "type": 0.0},
+			map[string]interface{}{"content": "-12.50% down"},
+			map[string]interface{}{"content": "-", "note": `a "b" </script> "quoted"`},
+		},
+		"range": []interface{}{"2018/01 - 2018/03", "month", "¥1,234.50"},
+	}
+	for k, v := range want {
+		if !reflect.DeepEqual(v, fig.Raw[k]) {
+			t.Error(k, ":", "want", v, "got", fig.Raw[k])
+		}
+	}
+	if _, err := json.Marshal(fig.Raw); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestParseTemplatesError(t *testing.T) {
+	fig, _ := DecodeFigure([]byte(`{"id": "F", "type": "kvCard", "template": true,
+		"cards": [{"content": "{{.A.data | printNumber"}, {"content": "{{nope .A}}"}],
+		"#query": {"A": {"type": "derived", "expression": "1"}}}`))
+	errs, ok := fig.Validate().(ValidationErrors)
+	if !ok || len(errs) != 2 || errs[0].Path != "$.cards[0].content" || errs[1].Path != "$.cards[1].content" {
+		t.Error("want errors at $.cards[0].content and $.cards[1].content", "got", errs)
+	}
+}
+
+func TestTemplateHelpers(t *testing.T) {
+	testCases := []struct {
+		out  string
+		want string
+	}{
+		{templatePercent(0.125), "12.50%"},
+		{templatePercent("x"), "-"},
+		{templateChange("12.5"), "+12.50%"},
+		{templateChange(0.0), "0.00%"},
+		{templateSigned(-1234.5), "-1,234.50"},
+		{templateSigned("1,000"), "+1,000.00"},
+		{templateCurrency("$", -5), "-$5.00"},
+		{templateDate("2006-01", "2018/02/01"), "2018-02"},
+		{templateTrend("N/A", "up", "down", "flat"), "flat"},
+	}
+
+	for i, tc := range testCases {
+		if tc.out != tc.want {
+			t.Error(i, ":", "want", tc.want, "got", tc.out)
+		}
+	}
+}
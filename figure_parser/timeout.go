@@ -0,0 +1,47 @@
+package figure_parser
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrTimeout is returned when a figure or request runs out of its time budget
+var ErrTimeout = errors.New("query timed out")
+
+var (
+	figureTimeout  time.Duration
+	requestTimeout time.Duration
+)
+
+// SetTimeouts sets the time budgets of parsing one figure and of all figures
+// of a request, 0 for no limit
+func SetTimeouts(figure, request time.Duration) {
+	figureTimeout = figure
+	requestTimeout = request
+}
+
+func withBudget(ctx context.Context, budget time.Duration) (context.Context, context.CancelFunc) {
+	if budget <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, budget)
+}
+
+// WithRequestBudget limits ctx to the time budget of a request
+func WithRequestBudget(ctx context.Context) (context.Context, context.CancelFunc) {
+	return withBudget(ctx, requestTimeout)
+}
+
+func withFigureBudget(ctx context.Context) (context.Context, context.CancelFunc) {
+	return withBudget(ctx, figureTimeout)
+}
+
+// timeoutError reports the error of a statement cancelled by the deadline
+// of ctx as ErrTimeout, as the driver returns its own cancel error
+func timeoutError(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return ErrTimeout
+	}
+	return err
+}
@@ -0,0 +1,28 @@
+package figure_parser
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTimeoutError(t *testing.T) {
+	driverErr := errors.New("pq: canceling statement due to user request")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	<-ctx.Done()
+	if err := timeoutError(ctx, driverErr); err != ErrTimeout {
+		t.Error("want", ErrTimeout, "got", err)
+	}
+	if err := timeoutError(ctx, nil); err != nil {
+		t.Error("want", nil, "got", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if err := timeoutError(ctx, driverErr); err != driverErr {
+		t.Error("want", driverErr, "got", err)
+	}
+}
@@ -0,0 +1,315 @@
+package figure_parser
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// Transform types usable in the "transforms" list of a query
+const (
+	TransformCumsum         = "cumsum"
+	TransformRollingAvg     = "rolling_avg"
+	TransformRebase         = "rebase"
+	TransformScale          = "scale"
+	TransformRound          = "round"
+	TransformPercentOfTotal = "percent_of_total"
+	TransformShare          = "share"
+)
+
+var scaleUnits = map[string]float64{
+	"thousand": 1e3,
+	"million":  1e6,
+	"billion":  1e9,
+}
+
+// TransformSpec is one step of the "transforms" list of a query, e.g.
+// {"type": "rolling_avg", "window": 7} or {"type": "scale", "unit": "million"}.
+type TransformSpec struct {
+	Type string
+	// rolling_avg: number of periods in the window
+	Window int
+	// scale: divide by Unit, or multiply by Factor
+	Unit   string
+	Factor float64
+	// round: decimal digits
+	Digits int
+	// rebase: value of the first period, 100 by default
+	Base float64
+
+	errs ValidationErrors
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (t *TransformSpec) UnmarshalJSON(b []byte) error {
+	d := newFieldDecoder(b)
+	d.decode("type", &t.Type)
+	d.decode("window", &t.Window)
+	d.decode("unit", &t.Unit)
+	d.decode("factor", &t.Factor)
+	d.decode("digits", &t.Digits)
+	d.decode("base", &t.Base)
+	t.errs = d.errs
+	return nil
+}
+
+func (t TransformSpec) validate(path string, errs *ValidationErrors) {
+	errs.merge(path, t.errs)
+	switch t.Type {
+	case TransformCumsum, TransformPercentOfTotal, TransformShare, TransformRebase:
+	case TransformRollingAvg:
+		if t.Window < 1 {
+			errs.add(joinPath(path, "window"), "must be at least 1")
+		}
+	case TransformScale:
+		if _, ok := scaleUnits[t.Unit]; !ok && t.Factor == 0 {
+			errs.add(path, "scale needs a unit (thousand, million, billion) or a non-zero factor")
+		}
+	case TransformRound:
+		if t.Digits < 0 || t.Digits > 10 {
+			errs.add(joinPath(path, "digits"), "must be between 0 and 10")
+		}
+	case "":
+		errs.add(joinPath(path, "type"), "is required")
+	default:
+		errs.add(joinPath(path, "type"), "unknown transform %q", t.Type)
+	}
+}
+
+// seriesSet is the numeric form of the "data" of a query result.
+// Missing values are NaN.
+type seriesSet struct {
+	series [][]float64
+	digits int // -1 for shortest representation
+	flat   bool
+	// rowLengths are the lengths of the rows of data given by period, whose
+	// columns are the series
+	rowLengths []int
+}
+
+// toSeriesSet reads the series of data. With byPeriod each row of data holds
+// the values of a period and the k-th values of all rows form a series.
+func toSeriesSet(data interface{}, byPeriod bool) (*seriesSet, error) {
+	s := &seriesSet{digits: -1}
+	switch d := data.(type) {
+	case []string:
+		s.flat = true
+		s.series = [][]float64{parseSeries(d)}
+	case [][]string:
+		for _, row := range d {
+			s.series = append(s.series, parseSeries(row))
+		}
+	default:
+		return nil, fmt.Errorf("transforms need series data, got %T", data)
+	}
+	if byPeriod && !s.flat {
+		s.rowLengths = make([]int, len(s.series))
+		for i, row := range s.series {
+			s.rowLengths[i] = len(row)
+		}
+		s.series = transpose(s.series)
+	}
+	return s, nil
+}
+
+// transpose turns rows into columns, filling the cells short rows lack with NaN
+func transpose(rows [][]float64) [][]float64 {
+	width := 0
+	for _, row := range rows {
+		if len(row) > width {
+			width = len(row)
+		}
+	}
+	columns := make([][]float64, width)
+	for k := range columns {
+		columns[k] = make([]float64, len(rows))
+		for i, row := range rows {
+			columns[k][i] = math.NaN()
+			if k < len(row) {
+				columns[k][i] = row[k]
+			}
+		}
+	}
+	return columns
+}
+
+func parseSeries(row []string) []float64 {
+	values := make([]float64, len(row))
+	for i, v := range row {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			f = math.NaN()
+		}
+		values[i] = f
+	}
+	return values
+}
+
+func (s *seriesSet) strings() interface{} {
+	series := s.series
+	if s.rowLengths != nil {
+		series = transpose(series)
+		for i := range series {
+			if i < len(s.rowLengths) {
+				series[i] = series[i][:s.rowLengths[i]]
+			}
+		}
+		// rows of no values have no column
+		for len(series) < len(s.rowLengths) {
+			series = append(series, []float64{})
+		}
+	}
+	rows := make([][]string, len(series))
+	for i, values := range series {
+		rows[i] = make([]string, len(values))
+		for j, f := range values {
+			if math.IsNaN(f) || math.IsInf(f, 0) {
+				rows[i][j] = "-"
+			} else {
+				rows[i][j] = strconv.FormatFloat(f, 'f', s.digits, 64)
+			}
+		}
+	}
+	if s.flat {
+		return rows[0]
+	}
+	return rows
+}
+
+func (s *seriesSet) each(fn func(values []float64)) {
+	for _, values := range s.series {
+		fn(values)
+	}
+}
+
+func (s *seriesSet) apply(t TransformSpec) {
+	switch t.Type {
+	case TransformCumsum:
+		s.each(func(values []float64) {
+			sum := 0.0
+			for i, f := range values {
+				if !math.IsNaN(f) {
+					sum += f
+					values[i] = sum
+				}
+			}
+		})
+
+	case TransformRollingAvg:
+		s.each(func(values []float64) {
+			src := append([]float64(nil), values...)
+			for i := range values {
+				sum, n := 0.0, 0
+				for j := i - t.Window + 1; j <= i; j++ {
+					if j >= 0 && !math.IsNaN(src[j]) {
+						sum += src[j]
+						n++
+					}
+				}
+				if n == 0 {
+					values[i] = math.NaN()
+				} else {
+					values[i] = sum / float64(n)
+				}
+			}
+		})
+
+	case TransformRebase:
+		base := t.Base
+		if base == 0 {
+			base = 100
+		}
+		s.each(func(values []float64) {
+			start := math.NaN()
+			for _, f := range values {
+				if !math.IsNaN(f) {
+					start = f
+					break
+				}
+			}
+			for i, f := range values {
+				if start == 0 || math.IsNaN(start) {
+					values[i] = math.NaN()
+				} else {
+					values[i] = f / start * base
+				}
+			}
+		})
+
+	case TransformScale:
+		factor := t.Factor
+		if unit, ok := scaleUnits[t.Unit]; ok {
+			factor = 1 / unit
+		}
+		s.each(func(values []float64) {
+			for i := range values {
+				values[i] *= factor
+			}
+		})
+
+	case TransformRound:
+		pow := math.Pow(10, float64(t.Digits))
+		s.each(func(values []float64) {
+			for i, f := range values {
+				values[i] = math.Round(f*pow) / pow
+			}
+		})
+		s.digits = t.Digits
+
+	case TransformPercentOfTotal:
+		s.each(func(values []float64) {
+			total := 0.0
+			for _, f := range values {
+				if !math.IsNaN(f) {
+					total += f
+				}
+			}
+			for i := range values {
+				values[i] = percentOf(values[i], total)
+			}
+		})
+
+	case TransformShare:
+		if len(s.series) == 0 {
+			return
+		}
+		for i := range s.series[0] {
+			total := 0.0
+			for _, values := range s.series {
+				if i < len(values) && !math.IsNaN(values[i]) {
+					total += values[i]
+				}
+			}
+			for _, values := range s.series {
+				if i < len(values) {
+					values[i] = percentOf(values[i], total)
+				}
+			}
+		}
+	}
+}
+
+func percentOf(f float64, total float64) float64 {
+	if total == 0 {
+		return math.NaN()
+	}
+	return f / total * 100
+}
+
+// applyTransforms runs the transforms of a query in order on its result data.
+// byPeriod tells the rows of data are the values of a period, like those of
+// period_series, so the transforms apply to their columns.
+func applyTransforms(result map[string]interface{}, transforms []TransformSpec, byPeriod bool) error {
+	if len(transforms) == 0 {
+		return nil
+	}
+	s, err := toSeriesSet(result["data"], byPeriod)
+	if err != nil {
+		return err
+	}
+	for _, t := range transforms {
+		s.apply(t)
+	}
+	result["data"] = s.strings()
+	return nil
+}
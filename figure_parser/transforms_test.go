@@ -0,0 +1,72 @@
+package figure_parser
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestApplyTransforms(t *testing.T) {
+	testCases := []struct {
+		transforms string
+		in         interface{}
+		out        interface{}
+		byPeriod   bool
+	}{
+		{`[{"type": "cumsum"}]`,
+			[]string{"1", "-", "2", "3"}, []string{"1", "-", "3", "6"}, false},
+		{`[{"type": "rolling_avg", "window": 2}]`,
+			[]string{"1", "3", "-", "6"}, []string{"1", "2", "3", "6"}, false},
+		{`[{"type": "rebase"}]`,
+			[]string{"-", "50", "75"}, []string{"-", "100", "150"}, false},
+		{`[{"type": "scale", "unit": "thousand"}, {"type": "round", "digits": 1}]`,
+			[]string{"1234", "56"}, []string{"1.2", "0.1"}, false},
+		{`[{"type": "scale", "factor": 100}]`,
+			[][]string{{"0.5"}}, [][]string{{"50"}}, false},
+		{`[{"type": "percent_of_total"}, {"type": "round", "digits": 0}]`,
+			[]string{"1", "3", "-"}, []string{"25", "75", "-"}, false},
+		{`[{"type": "share"}]`,
+			[][]string{{"1", "0"}, {"3", "0"}}, [][]string{{"25", "-"}, {"75", "-"}}, false},
+		// rows of period values, transformed across periods by column
+		{`[{"type": "cumsum"}]`,
+			[][]string{{"1", "2", "3"}, {}, {"4", "-"}, {"5"}},
+			[][]string{{"1", "2", "3"}, {}, {"5", "-"}, {"10"}}, true},
+		{`[{"type": "rebase"}]`,
+			[][]string{{"50", "10"}, {"75", "20"}}, [][]string{{"100", "100"}, {"150", "200"}}, true},
+	}
+
+	for i, tc := range testCases {
+		var transforms []TransformSpec
+		if err := json.Unmarshal([]byte(tc.transforms), &transforms); err != nil {
+			t.Fatal(i, err)
+		}
+		result := map[string]interface{}{"data": tc.in}
+		if err := applyTransforms(result, transforms, tc.byPeriod); err != nil {
+			t.Error(i, err)
+			continue
+		}
+		if !reflect.DeepEqual(tc.out, result["data"]) {
+			t.Error(i, ":", "want", tc.out, "got", result["data"])
+		}
+	}
+}
+
+func TestValidateTransforms(t *testing.T) {
+	q, _ := DecodeQuery([]byte(`{"type": "element", "table": "t", "function": "sum(v)",
+		"transforms": [{"type": "rolling_avg"}, {"type": "scale", "unit": "lakh"}, {"type": "log"}]}`))
+	want := "$.transforms: are not supported by element query; " +
+		"$.transforms[0].window: must be at least 1; " +
+		"$.transforms[1]: scale needs a unit (thousand, million, billion) or a non-zero factor; " +
+		`$.transforms[2].type: unknown transform "log"`
+	if err := q.Validate(); err == nil || err.Error() != want {
+		t.Error("want", want, "got", err)
+	}
+}
+
+func TestValidateTransformsPeriodSeries(t *testing.T) {
+	q, _ := DecodeQuery([]byte(`{"type": "period_series", "table": "t", "column": "v",
+		"transforms": [{"type": "cumsum"}]}`))
+	if err := q.Validate(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,239 @@
+package figure_parser
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/bluecover/lm/business/timing"
+	"github.com/bluecover/lm/models"
+	"github.com/bluecover/lm/util"
+	"github.com/jinzhu/gorm"
+)
+
+// xoxLookback is how many periods xox searches back for the latest data
+const xoxLookback = 3
+
+const periodKeyFormat = "2006-01-02"
+
+// xoxParser compares the value of "function" in a period with the value
+// "lag" periods before it, e.g. "period": "month", "lag": 12 for the same
+// month last year. With "series" it returns the change of every period in
+// the date range instead of only the latest one.
+type xoxParser struct{}
+
+func periodNoun(period string) string {
+	switch period {
+	case PeriodDate:
+		return "Day"
+	case PeriodWeek:
+		return "Week"
+	case PeriodMonth:
+		return "Month"
+	case PeriodQuarter:
+		return "Quarter"
+	case PeriodHalfYear:
+		return "Half-Year"
+	case PeriodYear:
+		return "Year"
+	default:
+		return ""
+	}
+}
+
+// periodsPerYear returns how many periods make a year, 0 if not a whole number.
+func periodsPerYear(period string) int {
+	switch period {
+	case PeriodMonth:
+		return 12
+	case PeriodQuarter:
+		return 4
+	case PeriodHalfYear:
+		return 2
+	case PeriodYear:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func xoxName(period string, lag int) string {
+	noun := periodNoun(period)
+	switch {
+	case len(noun) == 0:
+		return ""
+	case lag <= 1:
+		return noun + "-on-" + noun
+	case lag == periodsPerYear(period):
+		return "Year-on-Year"
+	case period == PeriodDate && lag == 7:
+		return "Week-on-Week"
+	default:
+		return fmt.Sprintf("%s-on-%d-%ss-Ago", noun, lag, noun)
+	}
+}
+
+func xoxLag(query QuerySpec) int {
+	if query.Lag <= 0 {
+		return 1
+	}
+	return query.Lag
+}
+
+func xoxPeriod(query QuerySpec, args ParseArgs) string {
+	xPeriod := args.Period
+	if query.PeriodLevel == 1 {
+		xPeriod = timing.NextPeriodLevel(xPeriod)
+	}
+	if len(query.Period) > 0 {
+		xPeriod = query.Period
+	}
+	return xPeriod
+}
+
+func periodKey(cal timing.Calendar, t time.Time, period string) string {
+	return cal.BeginningOfPeriod(t, period).Format(periodKeyFormat)
+}
+
+// periodValues returns the value of the query function of every period
+// between start and end keyed by periodKey.
+func (xoxParser) periodValues(ctx context.Context, query QuerySpec, cal timing.Calendar, period string,
+	start, end time.Time, filters []Filter, db *gorm.DB) (map[string]float64, error) {
+
+	table := models.QuoteIdentifier(query.Table)
+	builder := sq.Select("date", query.Function).From(table).Where(sq.And{
+		sq.Eq{"period": period},
+		sq.GtOrEq{"date": start},
+		sq.LtOrEq{"date": end}},
+	)
+	builder = SetFilters(builder, filters)
+	if hasAggregate(query.Function) {
+		builder = builder.GroupBy("date")
+	}
+	statement, sargs, err := builder.OrderBy("date ASC").ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := queryRows(ctx, db, statement, sargs...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	values := make(map[string]float64)
+	for rows.Next() {
+		var date time.Time
+		var value sql.NullFloat64
+		if err := rows.Scan(&date, &value); err != nil {
+			return nil, err
+		}
+		if value.Valid {
+			values[periodKey(cal, date, period)] = value.Float64
+		}
+	}
+	return values, rows.Err()
+}
+
+// Parse implement QueryParser.Parse
+func (p xoxParser) Parse(ctx context.Context, query QuerySpec, args ParseArgs,
+	db *gorm.DB) (map[string]interface{}, error) {
+
+	xPeriod := xoxPeriod(query, args)
+	lag := xoxLag(query)
+	cal := args.Calendar
+	end := cal.BeginningOfPeriod(args.End, xPeriod)
+
+	start := cal.BackwardN(end, xPeriod, lag+xoxLookback)
+	if query.Series {
+		start = cal.BackwardN(args.Start, xPeriod, lag)
+	}
+	values, err := p.periodValues(ctx, query, cal, xPeriod, start, cal.EndOfPeriod(end, xPeriod), args.Filters, db)
+	if err != nil {
+		return nil, err
+	}
+
+	if query.Series {
+		return p.series(query, values, cal, cal.BeginningOfPeriod(args.Start, xPeriod), end, xPeriod, lag), nil
+	}
+
+	current := end
+	for i := 0; i < xoxLookback; i++ {
+		if _, ok := values[periodKey(cal, current, xPeriod)]; ok {
+			break
+		}
+		current = cal.Backward(current, xPeriod)
+	}
+	currentValue, ok := values[periodKey(cal, current, xPeriod)]
+	if !ok {
+		return p.naResult(xPeriod, lag), nil
+	}
+
+	result := p.naResult(xPeriod, lag)
+	result["date"] = cal.FormatTime(current, xPeriod)
+	result["current"] = formatDerived(currentValue)
+
+	prevDate := cal.BackwardN(current, xPeriod, lag)
+	prevValue, ok := values[periodKey(cal, prevDate, xPeriod)]
+	if !ok {
+		return result, nil
+	}
+	p.compare(result, currentValue, prevValue)
+	return result, nil
+}
+
+// compare fills the previous value and the change into a single result. Like
+// in the series, there is no change against a previous value of 0.
+func (xoxParser) compare(result map[string]interface{}, current, prev float64) {
+	result["previous"] = formatDerived(prev)
+	result["inc_or_dec"] = util.CMPFloat(current, prev)
+	if prev == 0.0 {
+		result["change"] = "-"
+		return
+	}
+	result["change"] = fmt.Sprintf("%.2f%%", xoxChange(current, prev))
+}
+
+func xoxChange(current, prev float64) float64 {
+	if prev == 0.0 {
+		return 0.0
+	}
+	return (current - prev) / prev * 100
+}
+
+// series returns the change of every period from start to end
+func (xoxParser) series(query QuerySpec, values map[string]float64, cal timing.Calendar, start, end time.Time,
+	period string, lag int) map[string]interface{} {
+
+	periodRange := createPeriodRange(cal, start, end, period)
+	data := make([]string, 0, len(periodRange))
+	for d := start; d.Before(end) || d.Equal(end); d = cal.Forward(d, period) {
+		current, ok1 := values[periodKey(cal, d, period)]
+		prev, ok2 := values[periodKey(cal, cal.BackwardN(d, period, lag), period)]
+		if !ok1 || !ok2 || prev == 0.0 {
+			data = append(data, "-")
+			continue
+		}
+		data = append(data, fmt.Sprintf("%.2f", xoxChange(current, prev)))
+	}
+
+	var resultData interface{} = data
+	if query.RaiseDimension {
+		resultData = [][]string{data}
+	}
+	return map[string]interface{}{
+		"date_range": periodRange,
+		"data":       resultData,
+		"name":       xoxName(period, lag),
+	}
+}
+
+func (xoxParser) naResult(period string, lag int) map[string]interface{} {
+	return map[string]interface{}{
+		"inc_or_dec": 1,
+		"change":     "N/A",
+		"name":       xoxName(period, lag),
+	}
+}
@@ -0,0 +1,99 @@
+package figure_parser
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bluecover/lm/business/timing"
+)
+
+func TestXoxName(t *testing.T) {
+	testCases := []struct {
+		period string
+		lag    int
+		out    string
+	}{
+		{PeriodMonth, 1, "Month-on-Month"},
+		{PeriodMonth, 12, "Year-on-Year"},
+		{PeriodQuarter, 4, "Year-on-Year"},
+		{PeriodDate, 7, "Week-on-Week"},
+		{PeriodMonth, 3, "Month-on-3-Months-Ago"},
+		{PeriodWeek, 1, "Week-on-Week"},
+		// 52 weeks back misses the same ISO week after a year of 53 weeks
+		{PeriodWeek, 52, "Week-on-52-Weeks-Ago"},
+		{PeriodHalfYear, 1, "Half-Year-on-Half-Year"},
+		{PeriodHalfYear, 2, "Year-on-Year"},
+	}
+	for i, tc := range testCases {
+		if out := xoxName(tc.period, tc.lag); out != tc.out {
+			t.Error(i, ":", "want", tc.out, "got", out)
+		}
+	}
+}
+
+func TestXoxSeries(t *testing.T) {
+	values := map[string]float64{
+		"2017-01-01": 100,
+		"2017-03-01": 0,
+		"2018-01-01": 150,
+		"2018-02-01": 80,
+		"2018-03-01": 20,
+	}
+	start := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2018, 4, 1, 0, 0, 0, 0, time.UTC)
+
+	out := xoxParser{}.series(QuerySpec{}, values, timing.Calendar{}, start, end, PeriodMonth, 12)
+	want := map[string]interface{}{
+		"date_range": []string{"2018/01", "2018/02", "2018/03", "2018/04"},
+		"data":       []string{"50.00", "-", "-", "-"},
+		"name":       "Year-on-Year",
+	}
+	if !reflect.DeepEqual(want, out) {
+		t.Error("want", want, "got", out)
+	}
+
+	out = xoxParser{}.series(QuerySpec{RaiseDimension: true}, values, timing.Calendar{}, start, end, PeriodMonth, 1)
+	if data := out["data"]; !reflect.DeepEqual([][]string{{"-", "-46.67", "-75.00", "-"}}, data) {
+		t.Error("got", data)
+	}
+}
+
+func TestXoxCompare(t *testing.T) {
+	testCases := []struct {
+		current, prev float64
+		change        string
+	}{
+		{150, 100, "50.00%"},
+		{80, 100, "-20.00%"},
+		{80, 0, "-"},
+	}
+	for i, tc := range testCases {
+		result := map[string]interface{}{}
+		xoxParser{}.compare(result, tc.current, tc.prev)
+		if result["change"] != tc.change {
+			t.Error(i, ":", "want", tc.change, "got", result["change"])
+		}
+	}
+}
+
+func TestXoxSeriesFiscal(t *testing.T) {
+	// fiscal years starting in April, rows dated at the start of each year
+	values := map[string]float64{
+		"2016-04-01": 100,
+		"2017-04-01": 120,
+	}
+	cal := timing.NewCalendar(4)
+	start := cal.BeginningOfPeriod(time.Date(2017, 6, 1, 0, 0, 0, 0, time.UTC), PeriodYear)
+	end := cal.BeginningOfPeriod(time.Date(2018, 5, 1, 0, 0, 0, 0, time.UTC), PeriodYear)
+
+	out := xoxParser{}.series(QuerySpec{}, values, cal, start, end, PeriodYear, 1)
+	want := map[string]interface{}{
+		"date_range": []string{"FY2018", "FY2019"},
+		"data":       []string{"20.00", "-"},
+		"name":       "Year-on-Year",
+	}
+	if !reflect.DeepEqual(want, out) {
+		t.Error("want", want, "got", out)
+	}
+}
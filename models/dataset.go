@@ -18,6 +18,11 @@ type Dataset struct {
 	CoreIndexQuery           string    `gorm:"column:core_index_query;type:jsonb"`
 	CoreIndexUpdateFrequency string    `gorm:"column:core_index_update_frequency"`
 	IndexChange              float64   `gorm:"column:index_change;type:decimal(8,2)"`
+	// FiscalYearStart is the first month, 1 to 12, of the years the dataset
+	// reports on, 0 for calendar years. Queries select rows by date ranges
+	// of fiscal periods, so the quarter, half year and year rows of a fiscal
+	// dataset must be dated at the start of their fiscal period.
+	FiscalYearStart int `gorm:"column:fiscal_year_start"`
 }
 
 // GetAllDatasets return all datasets in DB
@@ -26,3 +31,25 @@ func GetAllDatasets(db *gorm.DB) []Dataset {
 	db.Find(&ret)
 	return ret
 }
+
+// GetDatasetIndexUpdatedAt returns when the index of the named dataset was last
+// updated, zero time if there is no such dataset
+func GetDatasetIndexUpdatedAt(db *gorm.DB, name string) time.Time {
+	ret := new(Dataset)
+	err := db.Select("index_updated_at").Where("name = ?", name).First(ret).Error
+	if err != nil {
+		return time.Time{}
+	}
+	return ret.IndexUpdatedAt
+}
+
+// GetDatasetFiscalYearStart returns the first month of the fiscal year of the
+// named dataset, 0 if it reports on calendar years or there is no such dataset
+func GetDatasetFiscalYearStart(db *gorm.DB, name string) int {
+	ret := new(Dataset)
+	err := db.Select("fiscal_year_start").Where("name = ?", name).First(ret).Error
+	if err != nil {
+		return 0
+	}
+	return ret.FiscalYearStart
+}
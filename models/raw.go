@@ -0,0 +1,60 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/jinzhu/gorm"
+)
+
+type contextQueryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// rawStatement rewrites the "?" placeholders of a statement for the dialect of db
+func rawStatement(db *gorm.DB, statement string) (string, error) {
+	if db.Dialect().GetName() == "postgres" {
+		return sq.Dollar.ReplacePlaceholders(statement)
+	}
+	return statement, nil
+}
+
+// RawRows works like db.Raw(statement, args...).Rows(), but the statement is
+// cancelled when ctx is done
+func RawRows(ctx context.Context, db *gorm.DB, statement string, args ...interface{}) (*sql.Rows, error) {
+	q, ok := db.CommonDB().(contextQueryer)
+	if !ok {
+		return db.Raw(statement, args...).Rows()
+	}
+	statement, err := rawStatement(db, statement)
+	if err != nil {
+		return nil, err
+	}
+	return q.QueryContext(ctx, statement, args...)
+}
+
+// RawScan runs a statement returning one row and scans the row into dest
+func RawScan(ctx context.Context, db *gorm.DB, statement string, args []interface{}, dest ...interface{}) error {
+	rows, err := RawRows(ctx, db, statement, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		return sql.ErrNoRows
+	}
+	if err := rows.Scan(dest...); err != nil {
+		return err
+	}
+	return rows.Close()
+}
+
+// QuoteIdentifier quotes a table or column name for SQL
+func QuoteIdentifier(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
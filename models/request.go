@@ -31,6 +31,6 @@ func (r *RequestDBOp) Save(userId uint, content, sourceType, extra string) {
 	err := r.DB.Create(&req).Error
 	if err != nil {
 		s, _ := json.Marshal(req)
-		fmt.Println("Failed to save Request[%s]!", string(s))
+		fmt.Printf("Failed to save Request[%s]!\n", string(s))
 	}
 }
@@ -41,6 +41,6 @@ func (r *SearchHistoryDBOp) SaveSearchHistory(user_id uint, datasetID string, fi
 	err := r.DB.Create(&searchHistory).Error
 	if err != nil {
 		s, _ := json.Marshal(searchHistory)
-		fmt.Println("Failed to save search history[%s]!", string(s))
+		fmt.Printf("Failed to save search history[%s]!\n", string(s))
 	}
 }
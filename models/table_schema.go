@@ -0,0 +1,30 @@
+package models
+
+import (
+	"github.com/jinzhu/gorm"
+)
+
+// GetTableColumns returns the column names of each given table found in DB.
+// Tables that do not exist are absent from the result.
+func GetTableColumns(db *gorm.DB, tables []string) (map[string][]string, error) {
+	ret := make(map[string][]string)
+	if len(tables) == 0 {
+		return ret, nil
+	}
+
+	rows, err := db.Raw("SELECT table_name, column_name FROM information_schema.columns "+
+		"WHERE table_name IN (?) ORDER BY table_name, ordinal_position", tables).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var table, column string
+		if err := rows.Scan(&table, &column); err != nil {
+			return nil, err
+		}
+		ret[table] = append(ret[table], column)
+	}
+	return ret, rows.Err()
+}
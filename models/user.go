@@ -9,6 +9,10 @@ type User struct {
 	ID       uint   `gorm:"primary_key;auto_increment"`
 	Email    string `gorm:"column:email;not null"`
 	Password string `gorm:"column:password;not null"`
+	// Locale is the BCP 47 locale the user reads figures in, empty for the default
+	Locale string `gorm:"column:locale"`
+	// Staff users may ask for the debug trace of figures
+	Staff bool `gorm:"column:staff"`
 }
 
 // TableName defines table name
@@ -35,3 +39,8 @@ func GetUserByID(db *gorm.DB, id uint) *User {
 	}
 	return ret
 }
+
+// SetUserLocale saves the locale of a user
+func SetUserLocale(db *gorm.DB, id uint, locale string) error {
+	return db.Model(&User{}).Where("id = ?", id).Update("locale", locale).Error
+}
@@ -0,0 +1,47 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Backends of Config.Backend
+const (
+	BackendNone   = ""
+	BackendMemory = "memory"
+	BackendRedis  = "redis"
+)
+
+// ErrNotFound is returned by Store.Get for a missing or expired key
+var ErrNotFound = errors.New("cache: key not found")
+
+// Store keeps values for the TTL it was created with
+type Store interface {
+	Get(key string) ([]byte, error)
+	Set(key string, value []byte) error
+}
+
+// Config selects and sizes the cache backend
+type Config struct {
+	Backend string
+	TTL     time.Duration
+	// memory: size limit in MB, 0 for no limit
+	MaxSizeMB int
+	// redis: redis://[:password@]host:port[/db]
+	RedisDSN string
+}
+
+// New returns the store of the configured backend, nil if caching is off
+func New(config Config) (Store, error) {
+	switch config.Backend {
+	case BackendNone:
+		return nil, nil
+	case BackendMemory:
+		return NewMemoryStore(config.TTL, config.MaxSizeMB)
+	case BackendRedis:
+		return NewRedisStore(config.RedisDSN, config.TTL)
+	default:
+		return nil, fmt.Errorf("unknown cache backend %q", config.Backend)
+	}
+}
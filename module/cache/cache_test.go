@@ -0,0 +1,68 @@
+package cache
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMemoryStore(t *testing.T) {
+	store, err := New(Config{Backend: BackendMemory, TTL: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get("a"); err != ErrNotFound {
+		t.Error("want", ErrNotFound, "got", err)
+	}
+	store.Set("a", []byte("1"))
+	if v, err := store.Get("a"); err != nil || string(v) != "1" {
+		t.Error("want", "1", "got", string(v), err)
+	}
+
+	if store, err := New(Config{}); store != nil || err != nil {
+		t.Error("want no store", "got", store, err)
+	}
+	if _, err := New(Config{Backend: "disk"}); err == nil {
+		t.Error("want error for unknown backend")
+	}
+}
+
+func TestGroup(t *testing.T) {
+	var g Group
+	var calls int32
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	values := make([]string, 5)
+	for i := range values {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			v, _, _ := g.Do("k", func() ([]byte, error) {
+				atomic.AddInt32(&calls, 1)
+				<-release
+				return []byte("v"), nil
+			})
+			values[i] = string(v)
+		}(i)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if calls != 1 {
+		t.Error("want", 1, "call", "got", calls)
+	}
+	for i, v := range values {
+		if v != "v" {
+			t.Error(i, ":", "want", "v", "got", v)
+		}
+	}
+}
+
+func TestRedisDSN(t *testing.T) {
+	for i, dsn := range []string{"http://127.0.0.1:6379", "redis://127.0.0.1:6379/x"} {
+		if _, err := NewRedisStore(dsn, time.Minute); err == nil {
+			t.Error(i, ":", "want error for", dsn)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package cache
+
+import (
+	"fmt"
+	"sync"
+)
+
+type call struct {
+	done  chan struct{}
+	value []byte
+	err   error
+}
+
+// Result is what a call of Group.DoChan delivers
+type Result struct {
+	Value []byte
+	// Shared reports whether the result came from another caller's call
+	Shared bool
+	Err    error
+}
+
+// Group runs only one call of a function per key at a time. Callers asking
+// for a key already in flight wait for it and share its result.
+type Group struct {
+	mu    sync.Mutex
+	calls map[string]*call
+}
+
+// Do calls fn unless a call for key is in flight, then it waits for that one.
+// shared reports whether the result came from another caller's call.
+func (g *Group) Do(key string, fn func() ([]byte, error)) (value []byte, shared bool, err error) {
+	r := <-g.DoChan(key, fn)
+	return r.Value, r.Shared, r.Err
+}
+
+// DoChan is like Do but returns at once. The result is sent on the channel
+// when fn returns. fn runs in its own goroutine, so callers can stop waiting
+// without stopping a call other callers share.
+func (g *Group) DoChan(key string, fn func() ([]byte, error)) <-chan Result {
+	ch := make(chan Result, 1)
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*call)
+	}
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		go func() {
+			<-c.done
+			ch <- Result{c.value, true, c.err}
+		}()
+		return ch
+	}
+	c := &call{done: make(chan struct{})}
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	go func() {
+		defer func() {
+			// a panic of fn would end the process, as nobody can recover it here
+			if r := recover(); r != nil {
+				c.value, c.err = nil, fmt.Errorf("cache: call panic: %v", r)
+			}
+			g.mu.Lock()
+			delete(g.calls, key)
+			g.mu.Unlock()
+			close(c.done)
+			ch <- Result{c.value, false, c.err}
+		}()
+		c.value, c.err = fn()
+	}()
+	return ch
+}
@@ -0,0 +1,41 @@
+package cache
+
+import (
+	"time"
+
+	"github.com/allegro/bigcache"
+)
+
+type memoryStore struct {
+	cache *bigcache.BigCache
+}
+
+// NewMemoryStore returns a Store kept in process by bigcache
+func NewMemoryStore(ttl time.Duration, maxSizeMB int) (Store, error) {
+	config := bigcache.DefaultConfig(ttl)
+	config.CleanWindow = time.Minute
+	config.HardMaxCacheSize = maxSizeMB
+	config.MaxEntrySize = 4096
+	config.Verbose = false
+	cache, err := bigcache.NewBigCache(config)
+	if err != nil {
+		return nil, err
+	}
+	return memoryStore{cache}, nil
+}
+
+func (s memoryStore) Get(key string) ([]byte, error) {
+	value, err := s.cache.Get(key)
+	switch err.(type) {
+	case nil:
+		return value, nil
+	case *bigcache.EntryNotFoundError, bigcache.EntryNotFoundError:
+		return nil, ErrNotFound
+	default:
+		return nil, err
+	}
+}
+
+func (s memoryStore) Set(key string, value []byte) error {
+	return s.cache.Set(key, value)
+}
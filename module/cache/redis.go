@@ -0,0 +1,45 @@
+package cache
+
+import (
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+const redisTimeout = 2 * time.Second
+
+// redisStore keeps values in a redis server
+type redisStore struct {
+	client *redis.Client
+	ttl    time.Duration
+}
+
+// NewRedisStore returns a Store kept by the redis server at dsn,
+// redis://[:password@]host:port[/db]
+func NewRedisStore(dsn string, ttl time.Duration) (Store, error) {
+	options, err := redis.ParseURL(dsn)
+	if err != nil {
+		return nil, err
+	}
+	options.DialTimeout = redisTimeout
+	options.ReadTimeout = redisTimeout
+	options.WriteTimeout = redisTimeout
+	client := redis.NewClient(options)
+	if err := client.Ping().Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &redisStore{client: client, ttl: ttl}, nil
+}
+
+func (s *redisStore) Get(key string) ([]byte, error) {
+	value, err := s.client.Get(key).Bytes()
+	if err == redis.Nil {
+		return nil, ErrNotFound
+	}
+	return value, err
+}
+
+func (s *redisStore) Set(key string, value []byte) error {
+	return s.client.Set(key, value, s.ttl).Err()
+}
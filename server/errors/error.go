@@ -11,4 +11,6 @@ var (
 	ErrUnauthorized          = New(http.StatusOK, 4, "Unauthorized")
 	ErrInvalidNameOrPassword = New(http.StatusOK, 5, "Invalid Email or Password")
 	ErrNoData          		 = New(http.StatusOK, 6, "No Data")
+	ErrQueryTimeout          = New(http.StatusOK, 7, "Query Timed Out")
+	ErrInvalidFigure         = New(http.StatusOK, 8, "Invalid Figure")
 )
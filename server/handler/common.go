@@ -1,5 +1,16 @@
 package handler
 
+import (
+	"context"
+
+	"github.com/bluecover/lm/figure_parser"
+	"github.com/bluecover/lm/models"
+	"github.com/bluecover/lm/server/errors"
+	"github.com/bluecover/lm/server/middleware/authware"
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+)
+
 // Date const
 const (
 	DateFormat       = "2006/01/02"
@@ -14,3 +25,29 @@ type ReqFingerprint struct {
 	Hash4 string `json:"d"`
 	Plain string `json:"info"`
 }
+
+// parseError returns the error rendered for a failed figure parse
+func parseError(err error) error {
+	if err == figure_parser.ErrTimeout || err == context.DeadlineExceeded {
+		return errors.ErrQueryTimeout
+	}
+	// a figure which is invalid, or refers to results its queries lack
+	if _, ok := err.(figure_parser.ValidationErrors); ok {
+		return errors.ErrInvalidFigure
+	}
+	return err
+}
+
+// debugRequested reports whether a request asks for the debug trace of its
+// figures with "debug=1", which only staff users may see
+func debugRequested(c *gin.Context, db *gorm.DB) (bool, error) {
+	switch c.Query("debug") {
+	case "", "0", "false":
+		return false, nil
+	}
+	user := models.GetUserByID(db, authware.GetCurrentUserID(c))
+	if user == nil || !user.Staff {
+		return false, errors.ErrUnauthorized
+	}
+	return true, nil
+}
@@ -43,6 +43,8 @@ func DatasetList(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		userID := authware.GetCurrentUserID(c)
 		userDatasets := auth.GetAuthorizedDatasets(db, userID)
+		ctx, cancel := figure_parser.WithRequestBudget(c.Request.Context())
+		defer cancel()
 
 		resultDatasets := make([]Dataset, 0)
 		for _, dataset := range userDatasets {
@@ -64,8 +66,7 @@ func DatasetList(db *gorm.DB) gin.HandlerFunc {
 				if len(coreIndexQuery) <= 0 {
 					break
 				}
-				var fig map[string]interface{}
-				err := json.Unmarshal([]byte(coreIndexQuery), &fig)
+				query, err := figure_parser.DecodeQuery([]byte(coreIndexQuery))
 				if err != nil {
 					break
 				}
@@ -75,7 +76,7 @@ func DatasetList(db *gorm.DB) gin.HandlerFunc {
 					End:    now.New(time.Now().UTC().Add(-24 * time.Hour)).BeginningOfDay(),
 					Period: timing.PeriodDate,
 				}
-				result, err := figure_parser.ParseQuery(fig, args, db)
+				result, err := figure_parser.ParseQuery(ctx, query, args, db)
 				if err != nil {
 					break
 				}
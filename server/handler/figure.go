@@ -2,6 +2,7 @@ package handler
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -49,6 +50,10 @@ func GetFinger(db *gorm.DB) gin.HandlerFunc {
 			if period == "day" {
 				period = "date"
 			}
+		case "5":
+			period = timing.PeriodWeek
+		case "6":
+			period = timing.PeriodHalfYear
 		}
 		beginningTime := time.Time{}
 		endTime := time.Time{}
@@ -73,59 +78,99 @@ func GetFinger(db *gorm.DB) gin.HandlerFunc {
 			Start:  beginningTime,
 			End:    endTime,
 			Period: period,
+			Locale: requestLocale(c, db),
 		}
-		filters := make([]map[string]interface{}, 0)
-		if err := json.Unmarshal([]byte(c.Query("filters")), &filters); err == nil {
+		if f := c.Query("filters"); len(f) > 0 {
+			filters := make([]figure_parser.Filter, 0)
+			if err := json.Unmarshal([]byte(f), &filters); err != nil {
+				render.Fail(c, errors.ErrInvalidParameters)
+				return
+			}
+			if err := figure_parser.ValidateFilters(filters); err != nil {
+				render.Fail(c, errors.ErrInvalidParameters)
+				logrus.Errorf("invalid filters %s: %s", f, err)
+				return
+			}
 			parseArgs.Filters = filters
 		}
 
-		figureIds := strings.Split(idstr, ",")
+		debug, err := debugRequested(c, db)
+		if err != nil {
+			render.Fail(c, err)
+			return
+		}
 
-		figures := make([]map[string]interface{}, 0)
-		for _, id := range figureIds {
+		figureIds := strings.Split(idstr, ",")
+		ctx, cancel := figure_parser.WithRequestBudget(c.Request.Context())
+		defer cancel()
+
+		// figures are parsed concurrently into their slot, skipped ones stay nil
+		parsedFigures := make([]map[string]interface{}, len(figureIds))
+		err = figure_parser.RunConcurrently(ctx, len(figureIds), func(ctx context.Context, i int) error {
+			id := figureIds[i]
+			var trace *figure_parser.Trace
+			if debug {
+				ctx, trace = figure_parser.WithTrace(ctx)
+			}
 			figure := models.GetFigure(db, id)
 			if figure == nil {
-				continue
+				return nil
 			}
 
-			var fj map[string]interface{}
-			err := json.Unmarshal([]byte(figure.Data), &fj)
+			fig, err := figure_parser.DecodeFigure([]byte(figure.Data))
 			if err != nil {
-				continue
+				logrus.Errorf("decode figure %s error %s", id, err)
+				return nil
 			}
+			// figure ids start with the dataset they show
+			args := parseArgs
+			args.Calendar = figure_parser.CalendarOfDataset(strings.SplitN(id, ".", 2)[0], db)
 
-			var parsedFigure map[string]interface{}
-			figureType := fj["type"].(string)
-			if figureType == "table" {
+			if fig.IsTable() {
 				page, err := strconv.Atoi(c.Query("page"))
 				if err != nil {
-					continue
+					return nil
 				}
 				sortBy := c.Query("sortBy")
 				if len(sortBy) == 0 {
 					sortBy = "date"
 				}
 
-				if !parseArgs.Start.IsZero() && !parseArgs.End.IsZero() {
-					parseArgs.Start, parseArgs.End = timing.AlignPeriodRange(
-						parseArgs.Start,
-						parseArgs.End,
-						parseArgs.Period,
+				tableArgs := args
+				if !tableArgs.Start.IsZero() && !tableArgs.End.IsZero() {
+					tableArgs.Start, tableArgs.End = tableArgs.Calendar.AlignPeriodRange(
+						tableArgs.Start,
+						tableArgs.End,
+						tableArgs.Period,
 					)
 				}
-				parsedFigure, err = figure_parser.ParseTable(fj, parseArgs, page, 12, sortBy, db)
+				parsedFigures[i], err = figure_parser.ParseTable(ctx, fig, tableArgs, page, 12, sortBy, db)
 				if err != nil {
-					render.Fail(c, err)
-					return
+					logrus.Errorf("parse table figure %s error %s", id, err)
+					return err
 				}
 			} else {
-				parsedFigure, err = figure_parser.ParseFigureB([]byte(figure.Data), parseArgs, db)
+				parsedFigures[i], err = figure_parser.ParseFigure(ctx, fig, args, db)
 				if err != nil {
-					render.Fail(c, err)
-					return
+					logrus.Errorf("parse figure %s error %s", id, err)
+					return err
 				}
 			}
-			figures = append(figures, parsedFigure)
+			if trace != nil {
+				parsedFigures[i]["debug"] = trace
+			}
+			return nil
+		})
+		if err != nil {
+			render.Fail(c, parseError(err))
+			return
+		}
+
+		figures := make([]map[string]interface{}, 0)
+		for _, parsedFigure := range parsedFigures {
+			if parsedFigure != nil {
+				figures = append(figures, parsedFigure)
+			}
 		}
 
 		render.OK(c, gin.H{"figures": figures})
@@ -158,14 +203,24 @@ func DataExport(db *gorm.DB) gin.HandlerFunc {
 			render.Fail(c, err, true)
 			return
 		}
+		// figure ids start with the dataset they show
+		parseArgs.Calendar = figure_parser.CalendarOfDataset(strings.SplitN(figure.ID, ".", 2)[0], db)
+		parseArgs.Start, parseArgs.End = parseArgs.Calendar.AlignPeriodRange(
+			parseArgs.Start,
+			parseArgs.End,
+			parseArgs.Period,
+		)
 
 		sortBy := c.Query("sortBy")
 		if len(sortBy) == 0 {
 			sortBy = "date"
 		}
-		queryResult, err := figure_parser.NewQuery(figure, parseArgs, 0, 0, sortBy).Run(db)
+		ctx, cancel := figure_parser.WithRequestBudget(c.Request.Context())
+		defer cancel()
+		queryResult, err := figure_parser.ExportTable(ctx, figure, parseArgs, sortBy, db)
 		if err != nil {
-			render.Fail(c, err, true)
+			logrus.Errorf("export table figure of %s error %s", id, err)
+			render.Fail(c, parseError(err), true)
 			return
 		}
 
@@ -180,7 +235,7 @@ func DataExport(db *gorm.DB) gin.HandlerFunc {
 	}
 }
 
-func getFigureFromPageID(db *gorm.DB, id string) (map[string]interface{}, error) {
+func getFigureFromPageID(db *gorm.DB, id string) (*figure_parser.FigureSpec, error) {
 	r := models.GetFigurePage(db, id)
 	if r == nil {
 		return nil, errors.ErrInvalidParameters
@@ -202,11 +257,13 @@ func getFigureFromPageID(db *gorm.DB, id string) (map[string]interface{}, error)
 		return nil, errors.ErrInvalidParameters
 	}
 
-	f := map[string]interface{}{}
-	err = json.Unmarshal([]byte(figure.Data), &f)
+	f, err := figure_parser.DecodeFigure([]byte(figure.Data))
 	if err != nil {
 		return nil, err
 	}
+	if err := f.Validate(); err != nil {
+		return nil, err
+	}
 	return f, nil
 }
 
@@ -248,6 +305,10 @@ func getParseArgsFromRequest(c *gin.Context) (args figure_parser.ParseArgs, err
 		period = timing.PeriodQuarter
 	case "4":
 		selfDefinedTime = true
+	case "5":
+		period = timing.PeriodWeek
+	case "6":
+		period = timing.PeriodHalfYear
 	}
 	endTime := time.Time{}
 	beginningTime := time.Time{}
@@ -266,12 +327,6 @@ func getParseArgsFromRequest(c *gin.Context) (args figure_parser.ParseArgs, err
 		End:    endTime,
 		Period: period,
 	}
-
-	args.Start, args.End = timing.AlignPeriodRange(
-		args.Start,
-		args.End,
-		args.Period,
-	)
 	return args, nil
 }
 
@@ -1,7 +1,7 @@
 package handler
 
 import (
-	"encoding/json"
+	"strings"
 	"time"
 
 	"github.com/bluecover/lm/business/timing"
@@ -27,12 +27,16 @@ func GetFingerPage(db *gorm.DB) gin.HandlerFunc {
 		dateViewMonth
 		dateViewQuarter
 		dateViewCustom
+		dateViewWeek
+		dateViewHalfYear
 	)
 
 	var period2int = map[string]int{
-		timing.PeriodDate:    dateViewDate,
-		timing.PeriodMonth:   dateViewMonth,
-		timing.PeriodQuarter: dateViewQuarter,
+		timing.PeriodDate:     dateViewDate,
+		timing.PeriodWeek:     dateViewWeek,
+		timing.PeriodMonth:    dateViewMonth,
+		timing.PeriodQuarter:  dateViewQuarter,
+		timing.PeriodHalfYear: dateViewHalfYear,
 	}
 
 	return func(c *gin.Context) {
@@ -48,20 +52,32 @@ func GetFingerPage(db *gorm.DB) gin.HandlerFunc {
 			return
 		}
 
-		var figurePage map[string]interface{}
-		err := json.Unmarshal([]byte(r.Data), &figurePage)
+		page, err := figure_parser.DecodePage([]byte(r.Data))
 		if err != nil {
 			render.Fail(c, errors.ErrInvalidParameters)
 			return
 		}
+		debug, err := debugRequested(c, db)
+		if err != nil {
+			render.Fail(c, err)
+			return
+		}
+		figurePage := page.Raw
+		ctx, cancel := figure_parser.WithRequestBudget(c.Request.Context())
+		defer cancel()
+		var trace *figure_parser.Trace
+		if debug {
+			ctx, trace = figure_parser.WithTrace(ctx)
+		}
 
 		var beginning, end time.Time
 		var period string
 		var dateViewFlag = dateViewCustom
-		if table, ok := figurePage["table"].(string); ok {
-			periods := []string{timing.PeriodQuarter, timing.PeriodMonth, timing.PeriodDate}
+		if table := page.Table; len(table) > 0 {
+			periods := []string{timing.PeriodHalfYear, timing.PeriodQuarter, timing.PeriodMonth,
+				timing.PeriodWeek, timing.PeriodDate}
 			for _, p := range periods {
-				b, e, err := timing.GetDateRangeOfTable(table, p, db, nil)
+				b, e, err := figure_parser.DateRangeOfTable(ctx, table, p, nil, db)
 				if err == nil {
 					beginning, end = b, e
 					period = p
@@ -77,28 +93,32 @@ func GetFingerPage(db *gorm.DB) gin.HandlerFunc {
 			return
 		}
 
-		dateView, ok := figurePage["dateView"].(float64)
-		if ok && dateView != dateViewFixed {
-			figurePage["dateView"] = int(dateView) & dateViewFlag
+		if page.DateView != dateViewFixed {
+			figurePage["dateView"] = page.DateView & dateViewFlag
 		}
 		figurePage["dateRange"] = DateRange{
 			Min: beginning.Format(DateFormat),
 			Max: end.Format(DateFormat),
 		}
 
-		if _, ok := figurePage["#query"]; ok {
+		if page.Queries != nil {
 			parseArgs := figure_parser.ParseArgs{
-				Start:  beginning,
-				End:    end,
-				Period: period,
+				Start:    beginning,
+				End:      end,
+				Period:   period,
+				Locale:   requestLocale(c, db),
+				Calendar: figure_parser.CalendarOfDataset(strings.SplitN(figureID, ".", 2)[0], db),
 			}
-			parsedFigurePage, err := figure_parser.ParseFigureB([]byte(r.Data), parseArgs, db)
+			parsedFigurePage, err := figure_parser.ParsePage(ctx, page, parseArgs, db)
 			if err == nil {
 				figurePage = parsedFigurePage
 			} else {
 				logrus.Errorf("parse figure page %s error %s", figureID, err)
 			}
 		}
+		if trace != nil {
+			figurePage["debug"] = trace
+		}
 
 		render.OK(c, figurePage)
 	}
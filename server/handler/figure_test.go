@@ -1,8 +1,22 @@
 package handler
 
 import (
+	"database/sql"
+	"database/sql/driver"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/tealeg/xlsx"
 )
 
 var tableFigureTests = []struct {
@@ -115,3 +129,129 @@ func TestGetTableFigureID(t *testing.T) {
 		}
 	}
 }
+
+// fakeAnswer is the rows a fakeDriver returns for statements containing match
+type fakeAnswer struct {
+	match   string
+	columns []string
+	rows    [][]driver.Value
+}
+
+// fakeDriver answers statements by the first answer they match, and with no
+// rows otherwise, so that handlers can run without a database
+type fakeDriver struct {
+	answers []fakeAnswer
+}
+
+func (d *fakeDriver) Open(string) (driver.Conn, error) { return fakeConn{d}, nil }
+
+type fakeConn struct{ d *fakeDriver }
+
+func (c fakeConn) Prepare(statement string) (driver.Stmt, error) {
+	return fakeStmt{c.d, statement}, nil
+}
+func (fakeConn) Close() error              { return nil }
+func (fakeConn) Begin() (driver.Tx, error) { return nil, errors.New("no transactions") }
+
+type fakeStmt struct {
+	d         *fakeDriver
+	statement string
+}
+
+func (fakeStmt) Close() error  { return nil }
+func (fakeStmt) NumInput() int { return -1 }
+func (fakeStmt) Exec([]driver.Value) (driver.Result, error) {
+	return nil, errors.New("no statements")
+}
+func (s fakeStmt) Query([]driver.Value) (driver.Rows, error) {
+	for _, a := range s.d.answers {
+		if strings.Contains(s.statement, a.match) {
+			return &fakeRows{a.columns, a.rows}, nil
+		}
+	}
+	return &fakeRows{}, nil
+}
+
+type fakeRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+func (*fakeRows) Close() error        { return nil }
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+func fakeDB(t *testing.T, name string, answers ...fakeAnswer) *gorm.DB {
+	sql.Register(name, &fakeDriver{answers})
+	sqlDB, err := sql.Open(name, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := gorm.Open("common", sqlDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestDataExportPivot(t *testing.T) {
+	page := `{"id": "YRD.Borrowers", "dataView": [{"type": "tableView",
+		"figures": [{"id": "YRD.Borrowers.Table", "type": "table"}]}]}`
+	figure := `{"id": "YRD.Borrowers.Table", "type": "table", "#query": {"type": "pivot",
+		"table": "YRD.borrower", "row_key": "city", "column_key": "education", "function": "count(*)"}}`
+	jan := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	mar := time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC)
+	db := fakeDB(t, fmt.Sprintf("handler_fake_%d", time.Now().UnixNano()),
+		fakeAnswer{`"figure_pages"`, []string{"id", "data"}, [][]driver.Value{{int64(1), page}}},
+		fakeAnswer{`"figures"`, []string{"id", "data"}, [][]driver.Value{{int64(2), figure}}},
+		fakeAnswer{"information_schema.columns", []string{"table_name", "column_name"}, [][]driver.Value{
+			{"YRD.borrower", "date"}, {"YRD.borrower", "period"},
+			{"YRD.borrower", "city"}, {"YRD.borrower", "education"},
+		}},
+		fakeAnswer{"min(date)", []string{"min", "max"}, [][]driver.Value{{jan, mar}}},
+		fakeAnswer{"GROUPING(", []string{"city", "education", "value", "grouping"}, [][]driver.Value{
+			{"Beijing", "college", 3.0, int64(0)},
+			{"Beijing", "school", 1.0, int64(0)},
+			{"Shanghai", "college", 2.0, int64(0)},
+			{"Beijing", nil, 4.0, int64(1)},
+			{"Shanghai", nil, 2.0, int64(1)},
+			{nil, "college", 5.0, int64(2)},
+			{nil, "school", 1.0, int64(2)},
+			{nil, nil, 6.0, int64(3)},
+		}},
+	)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/export", DataExport(db))
+	w := httptest.NewRecorder()
+	url := fmt.Sprintf("/export?id=YRD.Borrowers&dateType=2&time=%d", time.Now().Unix())
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+	if w.Code != http.StatusOK {
+		t.Fatal("want", http.StatusOK, "got", w.Code, w.Body.String())
+	}
+
+	file, err := xlsx.OpenBinary(w.Body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sheets, err := file.ToSlice()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{"city", "college", "school", "Total"},
+		{"Beijing", "3.00", "1.00", "4.00"},
+		{"Shanghai", "2.00", "-", "2.00"},
+	}
+	if !reflect.DeepEqual(want, sheets[0]) {
+		t.Error("want", want, "got", sheets[0])
+	}
+}
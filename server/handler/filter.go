@@ -24,10 +24,23 @@ func Filter(db *gorm.DB) gin.HandlerFunc {
 			return
 		}
 
-		figurePage, err := figure_parser.ParseFigureB([]byte(m.Data), figure_parser.ParseArgs{}, db)
+		page, err := figure_parser.DecodePage([]byte(m.Data))
+		if err != nil {
+			render.Fail(c, errors.ErrInvalidParameters)
+			return
+		}
+
+		ctx, cancel := figure_parser.WithRequestBudget(c.Request.Context())
+		defer cancel()
+		figurePage, err := figure_parser.ParsePage(ctx, page, figure_parser.ParseArgs{}, db)
+		if err == figure_parser.ErrTimeout {
+			render.Fail(c, errors.ErrQueryTimeout)
+			return
+		}
 		if err != nil {
 			logrus.Errorf("parse figure page for filter %s error %s", figureID, err)
 			render.Fail(c, errors.ErrInternal)
+			return
 		}
 
 		filter := figurePage["filter"]
@@ -1,12 +1,15 @@
 package handler
 
 import (
+	"github.com/bluecover/lm/figure_parser"
 	"github.com/bluecover/lm/models"
 	"github.com/bluecover/lm/server/errors"
 	"github.com/bluecover/lm/server/middleware/authware"
 	"github.com/bluecover/lm/server/render"
 	"github.com/gin-gonic/gin"
 	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/text/language"
 )
 
 func UserInfo(db *gorm.DB) gin.HandlerFunc {
@@ -19,13 +22,52 @@ func UserInfo(db *gorm.DB) gin.HandlerFunc {
 			return
 		}
 
+		locale := user.Locale
+		if len(locale) == 0 {
+			locale = figure_parser.DefaultLocale
+		}
 		userInfo := gin.H{
 			"accountName": user.Email,
 			"email":       user.Email,
 			"expiresIn":   "2018/12/31",
-			"locale":      "en-US",
+			"locale":      locale,
 		}
 
 		render.OK(c, gin.H{"user": userInfo})
 	}
 }
+
+// SetUserLocale saves the locale the current user reads figures in
+func SetUserLocale(db *gorm.DB) gin.HandlerFunc {
+
+	return func(c *gin.Context) {
+		locale, ok := figure_parser.ValidLocale(c.PostForm("locale"))
+		if !ok {
+			render.Fail(c, errors.ErrInvalidParameters)
+			return
+		}
+		if err := models.SetUserLocale(db, authware.GetCurrentUserID(c), locale); err != nil {
+			logrus.Errorf("set user locale error %s", err)
+			render.Fail(c, errors.ErrInternal)
+			return
+		}
+		render.OK(c, gin.H{"locale": locale})
+	}
+}
+
+// requestLocale returns the locale of a request: the "locale" parameter,
+// the locale saved by the user or the first of Accept-Language
+func requestLocale(c *gin.Context, db *gorm.DB) string {
+	if locale, ok := figure_parser.ValidLocale(c.Query("locale")); ok {
+		return locale
+	}
+	if user := models.GetUserByID(db, authware.GetCurrentUserID(c)); user != nil && len(user.Locale) > 0 {
+		return user.Locale
+	}
+	if tags, _, err := language.ParseAcceptLanguage(c.Request.Header.Get("Accept-Language")); err == nil && len(tags) > 0 {
+		if locale, ok := figure_parser.ValidLocale(tags[0].String()); ok {
+			return locale
+		}
+	}
+	return figure_parser.DefaultLocale
+}
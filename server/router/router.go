@@ -34,6 +34,7 @@ func addREST(r *gin.Engine, db *gorm.DB) {
 	authGroup.POST("ping", handler.Ping)
 
 	authGroup.GET("user/info", handler.UserInfo(db))
+	authGroup.POST("user/locale", handler.SetUserLocale(db))
 	authGroup.GET("dataset/list", handler.DatasetList(db))
 	authGroup.GET("dataset/figurePage", handler.GetFingerPage(db))
 	authGroup.GET("dataset/figure", handler.GetFinger(db))
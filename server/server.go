@@ -6,6 +6,8 @@ import (
 	"os/signal"
 	"syscall"
 
+	"github.com/bluecover/lm/figure_parser"
+	"github.com/bluecover/lm/module/cache"
 	"github.com/bluecover/lm/server/codec"
 	"github.com/bluecover/lm/server/render"
 	"github.com/bluecover/lm/server/router"
@@ -31,6 +33,19 @@ func Start(addr string, db *gorm.DB) error {
 		dec = codec.NewPlainCodec()
 	}
 
+	figure_parser.SetConcurrency(viper.GetInt("query.concurrency"))
+	figure_parser.SetTimeouts(viper.GetDuration("query.figure_timeout"), viper.GetDuration("query.request_timeout"))
+	store, err := cache.New(cache.Config{
+		Backend:   viper.GetString("cache.backend"),
+		TTL:       viper.GetDuration("cache.ttl"),
+		MaxSizeMB: viper.GetInt("cache.max_size_mb"),
+		RedisDSN:  viper.GetString("redis.dsn"),
+	})
+	if err != nil {
+		return err
+	}
+	figure_parser.SetCache(store, viper.GetDuration("cache.version_check"))
+
 	if viper.GetBool("debug") {
 		render.PrintData()
 		gin.SetMode(gin.DebugMode)